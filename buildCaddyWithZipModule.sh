@@ -2,4 +2,4 @@
 
 set -ex
 
-xcaddy build --with github.com/codemicro/palmatum/caddyZipFs --replace github.com/codemicro/palmatum=$(pwd)
+xcaddy build --with github.com/codemicro/palmatum/caddyZipFs --with github.com/codemicro/palmatum/caddySiteMetrics --with github.com/codemicro/palmatum/caddyRateLimit --replace github.com/codemicro/palmatum=$(pwd)
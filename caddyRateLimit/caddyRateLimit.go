@@ -0,0 +1,330 @@
+package caddyRateLimit
+
+import (
+	"errors"
+	"fmt"
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/caddyconfig/httpcaddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"golang.org/x/time/rate"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+func init() {
+	caddy.RegisterModule(new(RateLimit))
+	httpcaddyfile.RegisterHandlerDirective("palmatum_rate_limit", parseCaddyfile)
+	// This runs after the directives that set up logging for the request so that rejected requests are still
+	// attributed to the right site, but before anything that does real work to serve the request
+	httpcaddyfile.RegisterDirectiveOrder("palmatum_rate_limit", httpcaddyfile.Before, "header")
+}
+
+// limiters holds the state of every limit that's in use. Caddy provisions a new config before cleaning up the old one,
+// so keeping the state here means that it survives reloads as long as the limits themselves don't change.
+var limiters = caddy.NewUsagePool()
+
+// clientIdleTimeout is how long a client's request limiter is kept after their last request. Once a client has been
+// idle for longer than a second their bucket is full again, so forgetting about them changes nothing.
+const clientIdleTimeout = 5 * time.Second
+
+// maxTrackedClients is the most clients that a site keeps a request limiter for, so that a flood of requests from
+// many different addresses can't use up an unbounded amount of memory between sweeps of idle clients.
+const maxTrackedClients = 100_000
+
+var errRateLimited = errors.New("rate limit exceeded")
+
+// RateLimit rejects requests for a Palmatum site with 429 Too Many Requests when a client makes too many requests or
+// when the site as a whole is sending too much data. Both limits allow a burst of one second's worth before they take
+// effect, and zero means no limit.
+type RateLimit struct {
+	Site string `json:"site"`
+	// RequestsPerSecond is the number of requests that each client IP address can make every second.
+	RequestsPerSecond int `json:"requests_per_second,omitempty"`
+	// BytesPerSecond is the number of bytes that can be sent in response bodies every second, across all clients.
+	BytesPerSecond int64 `json:"bytes_per_second,omitempty"`
+
+	key     string
+	limiter *siteLimiter
+}
+
+var (
+	_ caddyhttp.MiddlewareHandler = (*RateLimit)(nil)
+	_ caddyfile.Unmarshaler       = (*RateLimit)(nil)
+	_ caddy.Provisioner           = (*RateLimit)(nil)
+	_ caddy.CleanerUpper          = (*RateLimit)(nil)
+)
+
+func (*RateLimit) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "http.handlers.palmatum_rate_limit",
+		New: func() caddy.Module { return new(RateLimit) },
+	}
+}
+
+func (m *RateLimit) Provision(caddy.Context) error {
+	if m.RequestsPerSecond < 0 || m.BytesPerSecond < 0 {
+		return errors.New("limits cannot be negative")
+	}
+
+	// Every route for a site shares the same limiter
+	m.key = fmt.Sprintf("%s/%d/%d", m.Site, m.RequestsPerSecond, m.BytesPerSecond)
+	val, _, err := limiters.LoadOrNew(m.key, func() (caddy.Destructor, error) {
+		return newSiteLimiter(m.RequestsPerSecond, m.BytesPerSecond), nil
+	})
+	if err != nil {
+		return err
+	}
+	m.limiter = val.(*siteLimiter)
+	return nil
+}
+
+func (m *RateLimit) Cleanup() error {
+	_, err := limiters.Delete(m.key)
+	return err
+}
+
+func (m *RateLimit) ServeHTTP(w http.ResponseWriter, r *http.Request, next caddyhttp.Handler) error {
+	now := time.Now()
+
+	if m.RequestsPerSecond != 0 {
+		if wait := m.limiter.takeRequest(clientIP(r), now); wait > 0 {
+			return tooManyRequests(w, wait)
+		}
+	}
+
+	if m.BytesPerSecond == 0 {
+		return next.ServeHTTP(w, r)
+	}
+
+	if wait := m.limiter.bandwidth.wait(now); wait > 0 {
+		return tooManyRequests(w, wait)
+	}
+
+	// The size of a response isn't known until it's been sent, so it's paid for afterwards. This can take the
+	// bandwidth allowance into debt, which later requests have to wait to be paid off. The debt is capped so that one
+	// large response can't lock every other client out for longer than a second.
+	rec := caddyhttp.NewResponseRecorder(w, nil, nil)
+	err := next.ServeHTTP(rec, r)
+	m.limiter.bandwidth.take(time.Now(), rec.Size())
+	return err
+}
+
+func tooManyRequests(w http.ResponseWriter, wait time.Duration) error {
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+	return caddyhttp.Error(http.StatusTooManyRequests, errRateLimited)
+}
+
+// clientIP returns the IP address of the client that made r, taking into account any trusted proxies.
+func clientIP(r *http.Request) string {
+	if ip, ok := caddyhttp.GetVar(r.Context(), caddyhttp.ClientIPVarKey).(string); ok && ip != "" {
+		return ip
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// siteLimiter is the state of the limits for one site.
+type siteLimiter struct {
+	requestsPerSecond int
+
+	mu      sync.Mutex
+	clients map[string]*clientLimiter
+
+	bandwidth *byteBucket
+
+	stop chan struct{}
+}
+
+type clientLimiter struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+func newSiteLimiter(requestsPerSecond int, bytesPerSecond int64) *siteLimiter {
+	sl := &siteLimiter{
+		requestsPerSecond: requestsPerSecond,
+		clients:           make(map[string]*clientLimiter),
+		stop:              make(chan struct{}),
+	}
+	if bytesPerSecond != 0 {
+		sl.bandwidth = newByteBucket(bytesPerSecond)
+	}
+	if requestsPerSecond != 0 {
+		go sl.forgetIdleClients()
+	}
+	return sl
+}
+
+// takeRequest uses up one of ip's requests. If it has none left, the time until it next has one is returned.
+func (sl *siteLimiter) takeRequest(ip string, now time.Time) time.Duration {
+	sl.mu.Lock()
+	cl, found := sl.clients[ip]
+	if !found {
+		if len(sl.clients) >= maxTrackedClients {
+			sl.evictClients(now)
+		}
+		cl = &clientLimiter{limiter: rate.NewLimiter(rate.Limit(sl.requestsPerSecond), sl.requestsPerSecond)}
+		sl.clients[ip] = cl
+	}
+	cl.lastSeen = now
+	sl.mu.Unlock()
+
+	res := cl.limiter.ReserveN(now, 1)
+	if wait := res.DelayFrom(now); wait > 0 {
+		// The request isn't going to be made, so the token shouldn't be used up
+		res.CancelAt(now)
+		return wait
+	}
+	return 0
+}
+
+// evictClients makes room for a new client. Clients that have been idle for long enough to have a full bucket are
+// dropped first, since that's free, and if none have then an arbitrary client is dropped instead, which at worst
+// gives them a fresh bucket. sl.mu must be held.
+func (sl *siteLimiter) evictClients(now time.Time) {
+	for ip, cl := range sl.clients {
+		if now.Sub(cl.lastSeen) > time.Second {
+			delete(sl.clients, ip)
+		}
+	}
+	for ip := range sl.clients {
+		if len(sl.clients) < maxTrackedClients {
+			break
+		}
+		delete(sl.clients, ip)
+	}
+}
+
+func (sl *siteLimiter) forgetIdleClients() {
+	ticker := time.NewTicker(clientIdleTimeout)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-sl.stop:
+			return
+		case now := <-ticker.C:
+			sl.mu.Lock()
+			for ip, cl := range sl.clients {
+				if now.Sub(cl.lastSeen) > clientIdleTimeout {
+					delete(sl.clients, ip)
+				}
+			}
+			sl.mu.Unlock()
+		}
+	}
+}
+
+func (sl *siteLimiter) Destruct() error {
+	close(sl.stop)
+	return nil
+}
+
+// byteBucket is a token bucket that's allowed to go into debt, since a response can be bigger than the whole bucket.
+// The debt can't be more than the size of the bucket, so it's always paid off within a second.
+type byteBucket struct {
+	rate float64
+
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+func newByteBucket(bytesPerSecond int64) *byteBucket {
+	return &byteBucket{
+		rate:   float64(bytesPerSecond),
+		tokens: float64(bytesPerSecond),
+		last:   time.Now(),
+	}
+}
+
+// refill adds the tokens that have accumulated since the bucket was last used. b.mu must be held.
+func (b *byteBucket) refill(now time.Time) {
+	if elapsed := now.Sub(b.last).Seconds(); elapsed > 0 {
+		b.tokens = min(b.rate, b.tokens+elapsed*b.rate)
+		b.last = now
+	}
+}
+
+// wait returns how long it'll be until the bucket is out of debt, or zero if it isn't in debt.
+func (b *byteBucket) wait(now time.Time) time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.refill(now)
+	if b.tokens > 0 {
+		return 0
+	}
+	return time.Duration((-b.tokens/b.rate)*float64(time.Second)) + 1
+}
+
+func (b *byteBucket) take(now time.Time, n int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.refill(now)
+	b.tokens = max(-b.rate, b.tokens-float64(n))
+}
+
+// UnmarshalCaddyfile unmarshals the palmatum_rate_limit directive from a Caddyfile.
+//
+// Example syntax:
+//
+//	palmatum_rate_limit my-site {
+//		requests 10
+//		bandwidth 1000000
+//	}
+func (m *RateLimit) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	d.Next()
+	if !d.Args(&m.Site) {
+		return d.Err("missing site slug")
+	}
+	if d.NextArg() {
+		return d.ArgErr()
+	}
+
+	for d.NextBlock(0) {
+		subdirective := d.Val()
+
+		var arg string
+		if !d.Args(&arg) {
+			return d.ArgErr()
+		}
+
+		switch subdirective {
+		case "requests":
+			n, err := strconv.Atoi(arg)
+			if err != nil || n < 0 {
+				return d.Errf("invalid number of requests per second: %s", arg)
+			}
+			m.RequestsPerSecond = n
+		case "bandwidth":
+			n, err := strconv.ParseInt(arg, 10, 64)
+			if err != nil || n < 0 {
+				return d.Errf("invalid number of bytes per second: %s", arg)
+			}
+			m.BytesPerSecond = n
+		default:
+			return d.Errf("unknown subdirective %s", subdirective)
+		}
+
+		if d.NextArg() {
+			return d.ArgErr()
+		}
+	}
+	return nil
+}
+
+func parseCaddyfile(h httpcaddyfile.Helper) (caddyhttp.MiddlewareHandler, error) {
+	m := new(RateLimit)
+	err := m.UnmarshalCaddyfile(h.Dispenser)
+	return m, err
+}
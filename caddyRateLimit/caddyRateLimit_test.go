@@ -0,0 +1,64 @@
+package caddyRateLimit
+
+import (
+	"bytes"
+	"errors"
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestByteBucketDebtIsCapped(t *testing.T) {
+	now := time.Now()
+	b := newByteBucket(1000)
+	b.last = now
+
+	// A response that's much bigger than the bucket only puts it a bucket's worth into debt
+	b.take(now, 1_000_000_000)
+	if wait := b.wait(now); wait <= 0 || wait > time.Second+1 {
+		t.Errorf("expected to wait at most a second, got %s", wait)
+	}
+	if wait := b.wait(now.Add(time.Second + time.Millisecond)); wait != 0 {
+		t.Errorf("expected the debt to be paid off after a second, got %s left", wait)
+	}
+
+	// Smaller debts are paid off in proportion to their size
+	b.take(now.Add(time.Second+time.Millisecond), 500)
+	if wait := b.wait(now.Add(time.Second + time.Millisecond)); wait < 400*time.Millisecond || wait > 600*time.Millisecond {
+		t.Errorf("expected to wait about half a second, got %s", wait)
+	}
+}
+
+func TestOversizedResponseDoesNotLockOutClients(t *testing.T) {
+	m := &RateLimit{Site: "oversized", BytesPerSecond: 1000}
+	if err := m.Provision(caddy.Context{}); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = m.Cleanup() })
+
+	request := func(ip string, size int) error {
+		rq := httptest.NewRequest(http.MethodGet, "/", nil)
+		rq.RemoteAddr = ip + ":1234"
+		return m.ServeHTTP(httptest.NewRecorder(), rq, caddyhttp.HandlerFunc(func(rw http.ResponseWriter, rq *http.Request) error {
+			_, err := rw.Write(bytes.Repeat([]byte("x"), size))
+			return err
+		}))
+	}
+
+	if err := request("192.0.2.1", 10_000_000); err != nil {
+		t.Fatal(err)
+	}
+
+	var he caddyhttp.HandlerError
+	if err := request("192.0.2.2", 10); !errors.As(err, &he) || he.StatusCode != http.StatusTooManyRequests {
+		t.Fatalf("expected other clients to be limited straight after a large response, got %v", err)
+	}
+
+	time.Sleep(time.Second + 50*time.Millisecond)
+	if err := request("192.0.2.2", 10); err != nil {
+		t.Errorf("expected other clients to be served once a second has passed, got %v", err)
+	}
+}
@@ -0,0 +1,109 @@
+package caddySiteMetrics
+
+import (
+	"errors"
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/caddyconfig/httpcaddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+func init() {
+	caddy.RegisterModule(new(SiteMetrics))
+	httpcaddyfile.RegisterHandlerDirective("palmatum_site_metrics", parseCaddyfile)
+	// This needs to wrap every other handler so that it sees responses generated by them, including errors
+	httpcaddyfile.RegisterDirectiveOrder("palmatum_site_metrics", httpcaddyfile.Before, "map")
+}
+
+// These are registered with the default registry, which is what Caddy serves on its admin API's /metrics endpoint.
+var (
+	requestCount = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "palmatum",
+		Subsystem: "site",
+		Name:      "requests_total",
+		Help:      "Number of requests served for each site.",
+	}, []string{"site", "code"})
+	responseSize = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "palmatum",
+		Subsystem: "site",
+		Name:      "response_size_bytes_total",
+		Help:      "Number of bytes sent in response bodies for each site.",
+	}, []string{"site"})
+	requestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "palmatum",
+		Subsystem: "site",
+		Name:      "request_duration_seconds",
+		Help:      "Time taken to serve requests for each site.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"site"})
+)
+
+// SiteMetrics records the number and size of responses for a Palmatum site.
+type SiteMetrics struct {
+	Site string `json:"site"`
+}
+
+var (
+	_ caddyhttp.MiddlewareHandler = (*SiteMetrics)(nil)
+	_ caddyfile.Unmarshaler       = (*SiteMetrics)(nil)
+)
+
+func (*SiteMetrics) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "http.handlers.palmatum_site_metrics",
+		New: func() caddy.Module { return new(SiteMetrics) },
+	}
+}
+
+func (m *SiteMetrics) ServeHTTP(w http.ResponseWriter, r *http.Request, next caddyhttp.Handler) error {
+	start := time.Now()
+
+	rec := caddyhttp.NewResponseRecorder(w, nil, nil)
+	err := next.ServeHTTP(rec, r)
+
+	status := rec.Status()
+	if err != nil {
+		// The response will be written by an error handler further up the chain
+		var handlerErr caddyhttp.HandlerError
+		if errors.As(err, &handlerErr) && handlerErr.StatusCode != 0 {
+			status = handlerErr.StatusCode
+		} else {
+			status = http.StatusInternalServerError
+		}
+	} else if status == 0 {
+		status = http.StatusOK
+	}
+
+	requestCount.WithLabelValues(m.Site, strconv.Itoa(status)).Inc()
+	responseSize.WithLabelValues(m.Site).Add(float64(rec.Size()))
+	requestDuration.WithLabelValues(m.Site).Observe(time.Since(start).Seconds())
+
+	return err
+}
+
+// UnmarshalCaddyfile unmarshals the palmatum_site_metrics directive from a Caddyfile.
+//
+// Example syntax:
+//
+//	palmatum_site_metrics my-site
+func (m *SiteMetrics) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	d.Next()
+	if !d.Args(&m.Site) {
+		return d.Err("missing site slug")
+	}
+	if d.NextArg() {
+		return d.ArgErr()
+	}
+	return nil
+}
+
+func parseCaddyfile(h httpcaddyfile.Helper) (caddyhttp.MiddlewareHandler, error) {
+	m := new(SiteMetrics)
+	err := m.UnmarshalCaddyfile(h.Dispenser)
+	return m, err
+}
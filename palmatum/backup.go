@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"git.tdpain.net/codemicro/palmatum/palmatum/internal/core"
+	"io"
+	"os"
+	"time"
+)
+
+// backup writes a backup of the database and every site archive to a file, or to stdout if the file is "-". It can be
+// run while Palmatum is serving sites. It returns the exit code for the process.
+func backup(args []string) int {
+	fs := flag.NewFlagSet("backup", flag.ContinueOnError)
+	output := fs.String("o", "palmatum-backup-"+time.Now().UTC().Format("20060102-150405")+".tar", "file to write the backup to, or - for stdout")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: palmatum backup [-o file]")
+		fmt.Fprintln(fs.Output(), "\nWrites the database and every site archive to a tarball that can be restored with palmatum restore.")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	ctx := context.Background()
+
+	conf, db, stop, err := startDatabase(ctx, false)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "error:", err)
+		return 1
+	}
+	defer stop()
+
+	b, err := core.CreateBackup(ctx, db, conf.Platform.SitesDirectory)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "error:", err)
+		return 1
+	}
+	defer b.Close()
+
+	if *output == "-" {
+		if err := b.Write(os.Stdout); err != nil {
+			fmt.Fprintln(os.Stderr, "error:", err)
+			return 1
+		}
+		return 0
+	}
+
+	f, err := os.OpenFile(*output, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "error:", err)
+		return 1
+	}
+
+	err = b.Write(f)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		_ = os.Remove(*output)
+		fmt.Fprintln(os.Stderr, "error:", err)
+		return 1
+	}
+
+	fmt.Fprintf(os.Stderr, "backup written to %s\n", *output)
+	return 0
+}
+
+// restore loads a backup written by palmatum backup into an instance without any sites. Palmatum shouldn't be running
+// while this happens. It returns the exit code for the process.
+func restore(args []string) int {
+	fs := flag.NewFlagSet("restore", flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: palmatum restore file")
+		fmt.Fprintln(fs.Output(), "\nChecks a backup written by palmatum backup and loads it into an instance without any sites. Use - to read the backup from stdin.")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return 2
+	}
+
+	var r io.Reader = os.Stdin
+	if fname := fs.Arg(0); fname != "-" {
+		f, err := os.Open(fname)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "error:", err)
+			return 1
+		}
+		defer f.Close()
+		r = f
+	}
+
+	ctx := context.Background()
+
+	conf, db, stop, err := startDatabase(ctx, true)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "error:", err)
+		return 1
+	}
+	defer stop()
+
+	if err := core.RestoreBackup(ctx, db, conf.Platform.SitesDirectory, r); err != nil {
+		fmt.Fprintln(os.Stderr, "error:", err)
+		return 1
+	}
+
+	fmt.Fprintln(os.Stderr, "backup restored")
+	return 0
+}
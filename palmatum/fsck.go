@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"git.tdpain.net/codemicro/palmatum/palmatum/internal/config"
+	"git.tdpain.net/codemicro/palmatum/palmatum/internal/core"
+	"git.tdpain.net/codemicro/palmatum/palmatum/internal/database"
+	"git.tdpain.net/codemicro/palmatum/palmatum/internal/tracing"
+	"github.com/jmoiron/sqlx"
+	"go.uber.org/fx"
+	"os"
+	"time"
+)
+
+const fsckTimeout = time.Minute
+
+// startDatabase opens the database without starting anything else. Unless migrate is set, the database isn't changed,
+// so that commands can be run alongside a running instance. stop must be called once the database is no longer needed.
+func startDatabase(ctx context.Context, migrate bool) (conf *config.Config, db *sqlx.DB, stop func(), err error) {
+	newDatabase := database.NewExisting
+	if migrate {
+		newDatabase = database.New
+	}
+
+	app := fx.New(
+		fx.NopLogger,
+		fx.Provide(
+			provideLogger,
+			config.Load,
+			tracing.NewTracerProvider,
+			newDatabase,
+		),
+		fx.Populate(&conf, &db),
+	)
+
+	if err := app.Start(ctx); err != nil {
+		return nil, nil, nil, err
+	}
+
+	stop = func() {
+		ctx, cancel := context.WithTimeout(context.Background(), fx.DefaultTimeout)
+		defer cancel()
+		if err := app.Stop(ctx); err != nil {
+			fmt.Fprintln(os.Stderr, "error:", err)
+		}
+	}
+
+	return conf, db, stop, nil
+}
+
+// fsck checks that the archive of every site in the database can be served, optionally quarantining the archives of
+// any that can't. It returns the exit code for the process.
+func fsck(args []string) int {
+	fs := flag.NewFlagSet("fsck", flag.ContinueOnError)
+	repair := fs.Bool("repair", false, "move archives that are corrupt into the quarantine directory and remove the content of their sites, so that they can be deployed to again")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: palmatum fsck [-repair]")
+		fmt.Fprintln(fs.Output(), "\nChecks that the archive of every site in the database exists and can be opened.")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), fsckTimeout)
+	defer cancel()
+
+	conf, db, stop, err := startDatabase(ctx, false)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "error:", err)
+		return 1
+	}
+	defer stop()
+
+	problems, err := core.CheckSiteArchives(db, conf.Platform.SitesDirectory)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "error:", err)
+		return 1
+	}
+
+	if len(problems) == 0 {
+		fmt.Println("no problems found")
+		return 0
+	}
+
+	for _, p := range problems {
+		fmt.Printf("%s: %s (%s)\n", p.Site, p.Problem, p.ContentPath)
+	}
+
+	if !*repair {
+		fmt.Printf("%d sites can't be served, run with -repair to remove their content\n", len(problems))
+		return 1
+	}
+
+	if err := core.RepairSiteArchives(db, conf.Platform.SitesDirectory, problems); err != nil {
+		fmt.Fprintln(os.Stderr, "error:", err)
+		return 1
+	}
+
+	fmt.Printf("removed the content of %d sites, which can now be deployed to again. Any archives that were present have been moved to %s\n", len(problems), core.QuarantineDirectory(conf.Platform.SitesDirectory))
+	return 0
+}
@@ -3,18 +3,26 @@ package caddyController
 import (
 	"bytes"
 	"context"
+	_ "embed"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"git.tdpain.net/codemicro/palmatum/palmatum/internal/config"
+	"git.tdpain.net/codemicro/palmatum/palmatum/internal/logging"
+	"git.tdpain.net/codemicro/palmatum/palmatum/internal/tracing"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel/trace"
 	"go.uber.org/fx"
 	"io"
 	"log/slog"
+	"maps"
 	"math"
 	"net/http"
 	"net/url"
-	"os"
 	"os/exec"
 	"path"
+	"reflect"
+	"slices"
 	"strconv"
 	"strings"
 	"syscall"
@@ -24,22 +32,52 @@ import (
 type Controller struct {
 	logger *slog.Logger
 	config *config.Config
+	client *http.Client
 
 	cmd            *exec.Cmd
 	adminApiSocket string
+	startedAt      time.Time
+
+	// accessLogAddress is where Caddy sends access logs to. If empty, requests aren't logged.
+	accessLogAddress string
 }
 
-func NewController(lc fx.Lifecycle, logger *slog.Logger, conf *config.Config) *Controller {
+func NewController(lc fx.Lifecycle, logger *slog.Logger, conf *config.Config, tp trace.TracerProvider) *Controller {
+	logger = logger.With(logging.AreaKey, "caddy")
+
 	csc := &Controller{
-		logger:         logger,
-		config:         conf,
-		adminApiSocket: "localhost:52019",
+		logger: logger,
+		config: conf,
+		client: &http.Client{
+			Transport: otelhttp.NewTransport(http.DefaultTransport,
+				otelhttp.WithTracerProvider(tp),
+				otelhttp.WithPropagators(tracing.Propagator),
+				// Health checks and the like shouldn't start traces of their own
+				otelhttp.WithFilter(func(rq *http.Request) bool {
+					return tracing.HasSpan(rq.Context())
+				}),
+				otelhttp.WithSpanNameFormatter(func(_ string, rq *http.Request) string {
+					return "Caddy admin API " + rq.Method + " " + rq.URL.Path
+				}),
+			),
+		},
+		adminApiSocket: conf.Platform.CaddyAdminAddress,
 	}
 
 	csc.cmd = exec.Command(conf.Platform.CaddyExecutablePath, "run")
 	csc.cmd.Env = append(csc.cmd.Env, "CADDY_ADMIN="+csc.adminApiSocket)
-	csc.cmd.Stdout = os.Stdout
-	csc.cmd.Stderr = os.Stderr
+	if conf.Tracing.Enabled() {
+		// Caddy's tracing module is configured with the standard OpenTelemetry environment variables
+		csc.cmd.Env = append(csc.cmd.Env,
+			"OTEL_EXPORTER_OTLP_TRACES_ENDPOINT="+conf.Tracing.OTLPEndpoint,
+			"OTEL_SERVICE_NAME="+conf.Tracing.ServiceName+"-caddy",
+			"OTEL_TRACES_SAMPLER=parentbased_traceidratio",
+			"OTEL_TRACES_SAMPLER_ARG="+strconv.FormatFloat(tracing.SampleRatio(conf.Tracing), 'f', -1, 64),
+		)
+	}
+	// Caddy logs to stderr, so anything written to stdout is unexpected
+	csc.cmd.Stdout = &logWriter{logger: logger, defaultLevel: slog.LevelWarn}
+	csc.cmd.Stderr = &logWriter{logger: logger, defaultLevel: slog.LevelInfo}
 
 	lc.Append(fx.Hook{
 		OnStart: csc.start,
@@ -54,6 +92,7 @@ func (csc *Controller) start(context.Context) error {
 	if err := csc.cmd.Start(); err != nil {
 		return err
 	}
+	csc.startedAt = time.Now()
 
 	var i int
 	for ; i < 5; i += 1 {
@@ -91,12 +130,43 @@ func (csc *Controller) stop(context.Context) error {
 	return csc.cmd.Wait()
 }
 
-func (csc *Controller) Reconfigure(routes RouteSpec) error {
+// PID returns the process ID of the Caddy server, or zero if it hasn't been started.
+func (csc *Controller) PID() int {
+	if csc.cmd.Process == nil {
+		return 0
+	}
+	return csc.cmd.Process.Pid
+}
+
+// StartedAt returns the time that the Caddy server was started.
+func (csc *Controller) StartedAt() time.Time {
+	return csc.startedAt
+}
+
+// SetAccessLogAddress sets the network address that Caddy sends access logs to, in Caddy's format (eg.
+// unix//path/to/socket). It must be called before the first call to Reconfigure.
+func (csc *Controller) SetAccessLogAddress(addr string) {
+	csc.accessLogAddress = addr
+}
+
+// Ping checks that Caddy's admin API is responding.
+func (csc *Controller) Ping(ctx context.Context) error {
+	resp, err := csc.doApiRequestContext(ctx, http.MethodGet, "/config/", "", nil)
+	if resp != nil {
+		resp.Body.Close()
+	}
+	if err != nil {
+		return fmt.Errorf("call Caddy admin API: %w", err)
+	}
+	return nil
+}
+
+func (csc *Controller) Reconfigure(ctx context.Context, routes RouteSpec) error {
 	cfg := csc.buildCaddyConfig(routes)
 
 	csc.logger.Debug("applying new Caddy config", "config", cfg)
 
-	resp, err := csc.doApiRequest(http.MethodPost, "/load", "text/caddyfile", cfg)
+	resp, err := csc.doApiRequestContext(ctx, http.MethodPost, "/load", "text/caddyfile", cfg)
 	if err != nil {
 		if errors.Is(err, errFailedRequest) {
 			b, _ := io.ReadAll(resp.Body)
@@ -111,15 +181,102 @@ func (csc *Controller) Reconfigure(routes RouteSpec) error {
 	return nil
 }
 
+// ConfigError is returned by Validate when Caddy won't accept a configuration.
+type ConfigError struct {
+	Message string
+}
+
+func (e *ConfigError) Error() string {
+	return e.Message
+}
+
+// adaptConfig asks Caddy to convert the config for routes into JSON, which checks that it's valid without applying
+// it.
+func (csc *Controller) adaptConfig(ctx context.Context, routes RouteSpec) (json.RawMessage, error) {
+	cfg := csc.buildCaddyConfig(routes)
+
+	resp, err := csc.doApiRequestContext(ctx, http.MethodPost, "/adapt", "text/caddyfile", cfg)
+	if err != nil {
+		if errors.Is(err, errFailedRequest) {
+			b, _ := io.ReadAll(resp.Body)
+			resp.Body.Close()
+
+			var body struct {
+				Error string `json:"error"`
+			}
+			msg := strings.TrimSpace(string(b))
+			if json.Unmarshal(b, &body) == nil && body.Error != "" {
+				msg = body.Error
+			}
+			return nil, &ConfigError{Message: msg}
+		}
+		return nil, fmt.Errorf("adapt Caddy config: %w", err)
+	}
+	defer resp.Body.Close()
+
+	var body struct {
+		Result json.RawMessage `json:"result"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return nil, fmt.Errorf("decode adapted Caddy config: %w", err)
+	}
+
+	return body.Result, nil
+}
+
+// Validate checks that Caddy would accept the config for routes without applying it. If it wouldn't, a *ConfigError
+// is returned.
+func (csc *Controller) Validate(ctx context.Context, routes RouteSpec) error {
+	_, err := csc.adaptConfig(ctx, routes)
+	return err
+}
+
+// Drift reports whether the config that Caddy is currently running differs from the config for routes.
+func (csc *Controller) Drift(ctx context.Context, routes RouteSpec) (bool, error) {
+	desired, err := csc.adaptConfig(ctx, routes)
+	if err != nil {
+		return false, err
+	}
+
+	resp, err := csc.doApiRequestContext(ctx, http.MethodGet, "/config/", "", nil)
+	if err != nil {
+		if resp != nil {
+			resp.Body.Close()
+		}
+		return false, fmt.Errorf("get live Caddy config: %w", err)
+	}
+	defer resp.Body.Close()
+
+	live, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return false, fmt.Errorf("read live Caddy config: %w", err)
+	}
+
+	// Compare the decoded values so that differences in formatting and key order are ignored
+	var desiredValue, liveValue any
+	if err := json.Unmarshal(desired, &desiredValue); err != nil {
+		return false, fmt.Errorf("decode adapted Caddy config: %w", err)
+	}
+	if err := json.Unmarshal(live, &liveValue); err != nil {
+		return false, fmt.Errorf("decode live Caddy config: %w", err)
+	}
+
+	return !reflect.DeepEqual(desiredValue, liveValue), nil
+}
+
 var errFailedRequest = errors.New("failed request (non-2xx status code)")
 
 func (csc *Controller) doApiRequest(method, path, contentType string, body []byte) (*http.Response, error) {
+	return csc.doApiRequestContext(context.Background(), method, path, contentType, body)
+}
+
+func (csc *Controller) doApiRequestContext(ctx context.Context, method, path, contentType string, body []byte) (*http.Response, error) {
 	var bodyReader io.Reader
 	if body != nil {
 		bodyReader = bytes.NewReader(body)
 	}
 
-	rq, err := http.NewRequest(method, (&url.URL{
+	rq, err := http.NewRequestWithContext(ctx, method, (&url.URL{
 		Scheme: "http",
 		Host:   csc.adminApiSocket,
 		Path:   path,
@@ -133,7 +290,7 @@ func (csc *Controller) doApiRequest(method, path, contentType string, body []byt
 	}
 	rq.Close = true
 
-	resp, err := http.DefaultClient.Do(rq)
+	resp, err := csc.client.Do(rq)
 	if err != nil {
 		return nil, fmt.Errorf("do HTTP request: %w", err)
 	}
@@ -145,8 +302,112 @@ func (csc *Controller) doApiRequest(method, path, contentType string, body []byt
 	return resp, nil
 }
 
+// hiddenFilenames is a space-separated list of files within a site bundle that are used to configure Palmatum and
+// shouldn't be served to visitors.
+const hiddenFilenames = "_headers"
+
+const (
+	// SiteLoginCallbackPath is where visitors are sent back to on a site's own domain after logging in to it with
+	// single sign-on.
+	SiteLoginCallbackPath = "/.palmatum/auth/callback"
+	// ManagementSiteLoginCallbackPath is the route on the management server that SiteLoginCallbackPath is proxied to.
+	ManagementSiteLoginCallbackPath = "/auth/callback"
+)
+
+// quoteCaddyfileString turns s into a single Caddyfile token, regardless of any whitespace, quotes or backslashes it
+// may contain.
+//
+// Nothing is escaped inside backticks, so they're used unless s contains one. Otherwise, inside double quotes Caddy
+// only treats a backslash as an escape if it's followed by a quote, so backslashes are escaped along with quotes to
+// stop one at the end of s from escaping the closing quote. The backslashes are then doubled in the token, but the
+// token can never be ended early.
+func quoteCaddyfileString(s string) string {
+	if !strings.Contains(s, "`") {
+		return "`" + s + "`"
+	}
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s) + `"`
+}
+
+// writeFallbackErrorSnippet writes the fallback_error snippet, which handles any error that hasn't already been handled
+// by a site's own error pages.
+func (csc *Controller) writeFallbackErrorSnippet(sb *bytes.Buffer) {
+	sb.WriteString("(fallback_error) {\nhandle {\n")
+	if p := csc.config.Platform.ErrorPagePath; p != "" {
+		sb.WriteString("root * ")
+		sb.WriteString(quoteCaddyfileString(path.Dir(p)))
+		sb.WriteString("\nrewrite * ")
+		sb.WriteString(quoteCaddyfileString("/" + path.Base(p)))
+		sb.WriteString("\nfile_server {\nfs default\nstatus {err.status_code}\n}\n")
+	} else {
+		sb.WriteString(`respond "{err.status_code} {err.status_text}" {err.status_code}`)
+		sb.WriteRune('\n')
+	}
+	sb.WriteString("}\n}\n")
+}
+
+// unknownHostPage is served by respond, which expands placeholders in it without escaping them for HTML, so it mustn't
+// contain any.
+//
+//go:embed unknownHost.html
+var unknownHostPage string
+
+// writeUnknownHostBlock writes a site block that responds to any request for a domain that doesn't have any routes.
+func (csc *Controller) writeUnknownHostBlock(sb *bytes.Buffer) {
+	status := strconv.Itoa(http.StatusNotFound)
+	if csc.config.Platform.UnknownHostMisdirected {
+		status = strconv.Itoa(http.StatusMisdirectedRequest)
+	}
+
+	sb.WriteString("http:// {\n")
+	if p := csc.config.Platform.UnknownHostPagePath; p != "" {
+		sb.WriteString("root * ")
+		sb.WriteString(quoteCaddyfileString(path.Dir(p)))
+		sb.WriteString("\nrewrite * ")
+		sb.WriteString(quoteCaddyfileString("/" + path.Base(p)))
+		sb.WriteString("\nfile_server {\nfs default\nstatus ")
+		sb.WriteString(status)
+		sb.WriteString("\n}\n")
+	} else {
+		sb.WriteString("header Content-Type \"text/html; charset=utf-8\"\nrespond <<PALMATUM_HTML\n")
+		sb.WriteString(unknownHostPage)
+		if !strings.HasSuffix(unknownHostPage, "\n") {
+			sb.WriteRune('\n')
+		}
+		sb.WriteString("PALMATUM_HTML ")
+		sb.WriteString(status)
+		sb.WriteRune('\n')
+	}
+	sb.WriteString("handle_errors {\nimport fallback_error\n}\n}\n")
+}
+
+// writeErrorPageHandler writes a handler for use inside a handle_errors block that serves page from filesystem fsid when
+// the error came from the route with ID routeID and matches the CEL expression condition. If page is empty, nothing is
+// written.
+func writeErrorPageHandler(sb *bytes.Buffer, routeID int, name, condition, page, fsid string) {
+	if page == "" {
+		return
+	}
+
+	matcher := "@error_" + strconv.Itoa(routeID) + "_" + name
+
+	sb.WriteString(matcher)
+	sb.WriteString(" {\nvars palmatum_route ")
+	sb.WriteString(strconv.Itoa(routeID))
+	sb.WriteString("\nexpression `")
+	sb.WriteString(condition)
+	sb.WriteString("`\n}\nhandle ")
+	sb.WriteString(matcher)
+	sb.WriteString(" {\nrewrite * ")
+	sb.WriteString(quoteCaddyfileString(page))
+	sb.WriteString("\nfile_server {\nfs ")
+	sb.WriteString(fsid)
+	sb.WriteString("\nstatus {err.status_code}\n}\n}\n")
+}
+
 func (csc *Controller) buildCaddyConfig(kr RouteSpec) []byte {
-	filesystemCounter := 0
+	// Filesystems are numbered in the order that they're first used, and domains are written in sorted order, so that
+	// the same routes always produce the same config. Otherwise, Drift would report differences that don't exist.
+	var filesystemPaths []string
 	filesystems := make(map[string]int)
 
 	var rsb bytes.Buffer
@@ -156,8 +417,17 @@ func (csc *Controller) buildCaddyConfig(kr RouteSpec) []byte {
 }
 `)
 
+	csc.writeFallbackErrorSnippet(&rsb)
+
 	kr.sortValues()
-	for domain, routes := range kr {
+	for _, domain := range slices.Sorted(maps.Keys(kr)) {
+		routes := kr[domain]
+		var (
+			hasRootRoute bool
+			hasOIDCRoute bool
+			esb          bytes.Buffer
+		)
+
 		rsb.WriteString("http://")
 		rsb.WriteString(domain)
 		rsb.WriteString(" {\n")
@@ -168,6 +438,13 @@ func (csc *Controller) buildCaddyConfig(kr RouteSpec) []byte {
 }
 `)
 
+		if csc.accessLogAddress != "" {
+			// Every domain writes to the same address, which Caddy shares a single connection between
+			rsb.WriteString("log {\noutput net ")
+			rsb.WriteString(quoteCaddyfileString(csc.accessLogAddress))
+			rsb.WriteString(" {\nsoft_start\n}\nformat json\n}\n")
+		}
+
 		for _, route := range routes {
 			if route.ContentPath == "" {
 				continue
@@ -177,30 +454,152 @@ func (csc *Controller) buildCaddyConfig(kr RouteSpec) []byte {
 			if v, found := filesystems[route.ContentPath]; found {
 				fsno = v
 			} else {
-				fsno = filesystemCounter
-				filesystemCounter += 1
+				fsno = len(filesystemPaths)
+				filesystemPaths = append(filesystemPaths, route.ContentPath)
 				filesystems[route.ContentPath] = fsno
 			}
 			fsid := strconv.Itoa(fsno)
 
+			// Every route gets its own handle block, even if it's mounted at the root of the domain, so that
+			// directives specific to one site (eg. custom headers) can't leak into other routes on the same domain.
 			if route.Path != "/" {
 				rsb.WriteString("handle_path ")
 				rsb.WriteString(strings.TrimSuffix(route.Path, "/"))
 				rsb.WriteString("* {\n")
+			} else {
+				rsb.WriteString("handle {\n")
+				hasRootRoute = true
+			}
+
+			if route.Site != "" {
+				if csc.config.Tracing.Enabled() {
+					// Continues any trace that the request is part of
+					rsb.WriteString("tracing {\nspan ")
+					rsb.WriteString(quoteCaddyfileString(route.Site))
+					rsb.WriteString("\n}\n")
+				}
+
+				rsb.WriteString("palmatum_site_metrics ")
+				rsb.WriteString(route.Site)
+				rsb.WriteRune('\n')
+
+				if csc.accessLogAddress != "" {
+					rsb.WriteString("log_append palmatum_site ")
+					rsb.WriteString(route.Site)
+					rsb.WriteRune('\n')
+				}
+
+				if route.RateLimitRequests != 0 || route.RateLimitBandwidthKilobytes != 0 {
+					rsb.WriteString("palmatum_rate_limit ")
+					rsb.WriteString(route.Site)
+					rsb.WriteString(" {\nrequests ")
+					rsb.WriteString(strconv.Itoa(route.RateLimitRequests))
+					rsb.WriteString("\nbandwidth ")
+					rsb.WriteString(strconv.FormatInt(int64(route.RateLimitBandwidthKilobytes)*1000, 10))
+					rsb.WriteString("\n}\n")
+				}
+			}
+
+			if route.ErrorPages != nil {
+				// handle_errors can only be used at the top level of a site block, so this is used to work out which
+				// route the error came from.
+				rsb.WriteString("vars palmatum_route ")
+				rsb.WriteString(strconv.Itoa(route.ID))
+				rsb.WriteRune('\n')
+
+				writeErrorPageHandler(&esb, route.ID, "404", "{err.status_code} == 404", route.ErrorPages.NotFound, fsid)
+				writeErrorPageHandler(&esb, route.ID, "5xx", "{err.status_code} >= 500", route.ErrorPages.ServerError, fsid)
+			}
+
+			for _, rule := range route.Headers {
+				for _, field := range rule.Headers {
+					rsb.WriteString("header ")
+					rsb.WriteString(quoteCaddyfileString(rule.Path))
+					rsb.WriteRune(' ')
+					rsb.WriteString(field.Name)
+					rsb.WriteRune(' ')
+					rsb.WriteString(quoteCaddyfileString(field.Value))
+					rsb.WriteRune('\n')
+				}
+			}
+
+			if route.SPAFallback {
+				// Any request for something that doesn't exist gets the root index page instead of a 404, so that
+				// client-side routing can take over. Since this is inside the handle block, {path} and /index.html
+				// are both relative to the root of the site.
+				rsb.WriteString("fs ")
+				rsb.WriteString(fsid)
+				rsb.WriteString("\n@spa_fallback not file {path}\nrewrite @spa_fallback /index.html\n")
+			}
+
+			if route.AllowedIPs != "" || len(route.Credentials) != 0 || route.OIDC {
+				// This is wrapped in a route block so that the IP allowlist is checked before asking for credentials
+				rsb.WriteString("route {\n")
+				if route.AllowedIPs != "" {
+					rsb.WriteString("@ip_not_allowed not remote_ip ")
+					rsb.WriteString(route.AllowedIPs)
+					rsb.WriteString("\nerror @ip_not_allowed 403\n")
+				}
+				if len(route.Credentials) != 0 {
+					rsb.WriteString("basic_auth {\n")
+					for _, cred := range route.Credentials {
+						rsb.WriteString(cred.Username)
+						rsb.WriteRune(' ')
+						rsb.WriteString(quoteCaddyfileString(cred.PasswordHash))
+						rsb.WriteRune('\n')
+					}
+					rsb.WriteString("}\n")
+				}
+				if route.OIDC {
+					hasOIDCRoute = true
+					rsb.WriteString("forward_auth ")
+					rsb.WriteString(csc.config.HTTP.InternalManagementAddress())
+					rsb.WriteString(" {\nuri /auth/forward?site=")
+					rsb.WriteString(url.QueryEscape(route.Site))
+					// handle_path has already stripped the route's path from {uri} by now, so visitors would be sent
+					// back to the wrong page after logging in to anything other than a root route
+					rsb.WriteString("\nheader_up X-Forwarded-Uri {http.request.orig_uri}\n}\n")
+				}
+				rsb.WriteString("}\n")
 			}
 
 			rsb.WriteString("import canonical_redir\nfile_server {\nfs ")
 			rsb.WriteString(fsid)
+			rsb.WriteString("\nhide ")
+			rsb.WriteString(hiddenFilenames)
 			rsb.WriteString("\n}\n")
 
-			if route.Path != "/" {
-				rsb.WriteString("}\n")
-			}
+			rsb.WriteString("}\n")
+		}
+
+		if hasOIDCRoute {
+			// The OIDC callback has to be on the same domain as the site so that the session cookie can be set. Only the
+			// callback is proxied, since the rest of the management server shouldn't be reachable from sites.
+			rsb.WriteString("handle ")
+			rsb.WriteString(SiteLoginCallbackPath)
+			rsb.WriteString(" {\nrewrite * ")
+			rsb.WriteString(ManagementSiteLoginCallbackPath)
+			rsb.WriteString("\nreverse_proxy ")
+			rsb.WriteString(csc.config.HTTP.InternalManagementAddress())
+			rsb.WriteString("\n}\n")
+		}
+
+		if !hasRootRoute {
+			// Without this, Caddy would respond to any request that doesn't match a route with an empty 200.
+			rsb.WriteString("handle {\nerror 404\n}\n")
 		}
 
+		rsb.WriteString("handle_errors {\n")
+		rsb.Write(esb.Bytes())
+		rsb.WriteString("import fallback_error\n}\n")
+
 		rsb.WriteString("}\n")
 	}
 
+	if _, found := kr[""]; !found {
+		csc.writeUnknownHostBlock(&rsb)
+	}
+
 	var gsb bytes.Buffer
 
 	gsb.WriteString(`{
@@ -211,19 +610,13 @@ admin `)
 	gsb.WriteString(strconv.Itoa(csc.config.HTTP.SitesPort))
 	gsb.WriteString("\ndefault_bind ")
 	gsb.WriteString(csc.config.HTTP.SitesHost)
-	gsb.WriteString("\nlog {\nlevel ")
-
-	if csc.config.Debug {
-		gsb.WriteString("DEBUG")
-	} else {
-		gsb.WriteString("WARN")
-	}
-
-	gsb.WriteString("\n}\n")
+	gsb.WriteString("\nlog {\nformat json\nlevel ")
+	gsb.WriteString(caddyLogLevel(csc.config.Logging.LevelFor("caddy")))
+	gsb.WriteString("\n}\nservers {\nmetrics\n}\n")
 
-	for zipfilePath, val := range filesystems {
+	for fsno, zipfilePath := range filesystemPaths {
 		gsb.WriteString("filesystem ")
-		gsb.WriteString(strconv.Itoa(val))
+		gsb.WriteString(strconv.Itoa(fsno))
 		gsb.WriteString(" zipfile ")
 		gsb.WriteString(fmt.Sprintf("%#v", path.Join(csc.config.Platform.SitesDirectory, zipfilePath)))
 		gsb.WriteRune('\n')
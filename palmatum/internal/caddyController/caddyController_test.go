@@ -0,0 +1,111 @@
+package caddyController
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	_ "git.tdpain.net/codemicro/palmatum/caddyRateLimit"
+	_ "git.tdpain.net/codemicro/palmatum/caddySiteMetrics"
+	_ "git.tdpain.net/codemicro/palmatum/caddyZipFs"
+	"git.tdpain.net/codemicro/palmatum/palmatum/internal/config"
+	"github.com/caddyserver/caddy/v2/caddyconfig"
+	_ "github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	_ "github.com/caddyserver/caddy/v2/modules/standard"
+	"strings"
+	"testing"
+)
+
+func newTestController() *Controller {
+	return &Controller{
+		config: &config.Config{
+			Logging:  &config.Logging{},
+			Tracing:  &config.Tracing{},
+			HTTP:     &config.HTTP{SitesHost: "0.0.0.0", SitesPort: 8081, ManagementHost: "127.0.0.1", ManagementPort: 8080},
+			Platform: &config.Platform{SitesDirectory: "/srv/sites"},
+		},
+		adminApiSocket: "localhost:52019",
+	}
+}
+
+func TestBuildCaddyConfigIsStable(t *testing.T) {
+	csc := newTestController()
+
+	// A new spec is made each time so that map iteration order can differ between builds
+	spec := func() RouteSpec {
+		kr := make(RouteSpec)
+		for i := range 20 {
+			domain := fmt.Sprintf("site%d.example.com", i)
+			kr[domain] = []*RouteDestination{
+				{Site: fmt.Sprintf("site%d", i), Domain: domain, Path: "/", ContentPath: fmt.Sprintf("site%d.zip", i)},
+				{Site: "shared", Domain: domain, Path: "/b/", ContentPath: "shared.zip"},
+				{Site: "docs", Domain: domain, Path: "/a/", ContentPath: "docs.zip"},
+			}
+		}
+		return kr
+	}
+
+	first := csc.buildCaddyConfig(spec())
+	for range 10 {
+		if next := csc.buildCaddyConfig(spec()); !bytes.Equal(first, next) {
+			t.Fatalf("config changed between builds:\n%s\n\n%s", first, next)
+		}
+	}
+
+	// Filesystems are numbered in the order that they're first used, with the longest paths of the first domain first
+	if !strings.Contains(string(first), "filesystem 0 zipfile \"/srv/sites/docs.zip\"\nfilesystem 1 zipfile \"/srv/sites/shared.zip\"\nfilesystem 2 zipfile \"/srv/sites/site0.zip\"\n") {
+		t.Errorf("unexpected filesystem numbering:\n%s", first)
+	}
+}
+
+func TestForwardAuthOriginalURI(t *testing.T) {
+	csc := newTestController()
+	cfg := csc.buildCaddyConfig(RouteSpec{
+		"example.com": {{Site: "docs", Domain: "example.com", Path: "/docs/", ContentPath: "docs.zip", OIDC: true}},
+	})
+
+	adapted, _, err := caddyconfig.GetAdapter("caddyfile").Adapt(cfg, nil)
+	if err != nil {
+		t.Fatalf("adapt config: %v\n%s", err, cfg)
+	}
+
+	// The login flow sends visitors back to X-Forwarded-Uri, which has to include the route's path even though
+	// handle_path strips it before forward_auth runs
+	var found bool
+	var walk func(v any)
+	walk = func(v any) {
+		switch v := v.(type) {
+		case map[string]any:
+			if v["handler"] == "reverse_proxy" {
+				if rewrite, ok := v["rewrite"].(map[string]any); ok && strings.HasPrefix(fmt.Sprint(rewrite["uri"]), "/auth/forward") {
+					found = true
+					set, _ := json.Marshal(v["headers"])
+					if !strings.Contains(string(set), `"X-Forwarded-Uri":["{http.request.orig_uri}"]`) {
+						t.Errorf("forward_auth doesn't send the original URI: %s", set)
+					}
+				}
+			}
+			for _, child := range v {
+				walk(child)
+			}
+		case []any:
+			for _, child := range v {
+				walk(child)
+			}
+		}
+	}
+	var decoded any
+	if err := json.Unmarshal(adapted, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	walk(decoded)
+	if !found {
+		t.Errorf("no forward_auth handler in adapted config:\n%s", adapted)
+	}
+}
+
+func TestUnknownHostPageHasNoPlaceholders(t *testing.T) {
+	// Placeholders in the page would be filled in with request headers, such as the Host header, without being escaped
+	if strings.ContainsAny(unknownHostPage, "{}") {
+		t.Errorf("unknown host page contains a placeholder:\n%s", unknownHostPage)
+	}
+}
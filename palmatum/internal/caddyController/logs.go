@@ -0,0 +1,132 @@
+package caddyController
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"maps"
+	"math"
+	"slices"
+	"strings"
+	"time"
+)
+
+// caddyLogLevel returns the Caddy log level that lets through the same messages as level.
+func caddyLogLevel(level slog.Level) string {
+	switch {
+	case level <= slog.LevelDebug:
+		return "DEBUG"
+	case level <= slog.LevelInfo:
+		return "INFO"
+	case level <= slog.LevelWarn:
+		return "WARN"
+	default:
+		return "ERROR"
+	}
+}
+
+// parseCaddyLogLevel converts the level of a message logged by Caddy into a slog level.
+func parseCaddyLogLevel(level string) slog.Level {
+	switch strings.ToLower(level) {
+	case "debug":
+		return slog.LevelDebug
+	case "info":
+		return slog.LevelInfo
+	case "warn":
+		return slog.LevelWarn
+	default:
+		// error, dpanic, panic and fatal
+		return slog.LevelError
+	}
+}
+
+// logWriter receives the output of the Caddy process and writes each line to logger. Lines that Caddy logged in JSON
+// keep their level, time and fields. Anything else is logged at defaultLevel.
+type logWriter struct {
+	logger       *slog.Logger
+	defaultLevel slog.Level
+	buf          []byte
+	// discarding is set once a line has been truncated, until the end of that line is reached.
+	discarding bool
+}
+
+// maxLogLineLength is the longest line that's buffered. Anything after that is dropped, so that output without any
+// newlines can't use an unlimited amount of memory.
+const maxLogLineLength = 64 * 1024
+
+func (lw *logWriter) Write(p []byte) (int, error) {
+	n := len(p)
+	for len(p) > 0 {
+		i := bytes.IndexByte(p, '\n')
+		chunk := p
+		if i != -1 {
+			chunk = p[:i]
+		}
+
+		if !lw.discarding {
+			if room := maxLogLineLength - len(lw.buf); len(chunk) > room {
+				lw.buf = append(lw.buf, chunk[:room]...)
+				lw.logger.Log(context.Background(), lw.defaultLevel, string(bytes.TrimSpace(lw.buf)), "truncated", true)
+				lw.buf = lw.buf[:0]
+				lw.discarding = true
+			} else {
+				lw.buf = append(lw.buf, chunk...)
+			}
+		}
+
+		if i == -1 {
+			break
+		}
+
+		if !lw.discarding {
+			lw.logLine(lw.buf)
+		}
+		lw.buf = lw.buf[:0]
+		lw.discarding = false
+		p = p[i+1:]
+	}
+	return n, nil
+}
+
+func (lw *logWriter) logLine(line []byte) {
+	line = bytes.TrimSpace(line)
+	if len(line) == 0 {
+		return
+	}
+
+	ctx := context.Background()
+
+	var fields map[string]any
+	if line[0] != '{' || json.Unmarshal(line, &fields) != nil {
+		lw.logger.Log(ctx, lw.defaultLevel, string(line))
+		return
+	}
+
+	level := lw.defaultLevel
+	if v, ok := fields["level"].(string); ok {
+		level = parseCaddyLogLevel(v)
+	}
+	if !lw.logger.Enabled(ctx, level) {
+		return
+	}
+
+	t := time.Now()
+	if v, ok := fields["ts"].(float64); ok {
+		secs, frac := math.Modf(v)
+		t = time.Unix(int64(secs), int64(frac*1e9))
+	}
+
+	msg, _ := fields["msg"].(string)
+
+	record := slog.NewRecord(t, level, msg, 0)
+	for _, key := range slices.Sorted(maps.Keys(fields)) {
+		switch key {
+		case "level", "ts", "msg":
+			continue
+		}
+		record.AddAttrs(slog.Any(key, fields[key]))
+	}
+
+	_ = lw.logger.Handler().Handle(ctx, record)
+}
@@ -0,0 +1,51 @@
+package caddyController
+
+import (
+	"fmt"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// caddyMetricPrefixes are the metric families from Caddy's admin API that are passed through. Everything else (eg. Go
+// runtime metrics) would clash with Palmatum's own metrics.
+var caddyMetricPrefixes = []string{"caddy_", "palmatum_site_"}
+
+// Gather fetches metrics from Caddy's admin API, so that the controller can be used as a prometheus.Gatherer.
+func (csc *Controller) Gather() ([]*dto.MetricFamily, error) {
+	resp, err := csc.doApiRequest(http.MethodGet, "/metrics", "", nil)
+	if err != nil {
+		if resp != nil {
+			resp.Body.Close()
+		}
+		return nil, fmt.Errorf("get Caddy metrics: %w", err)
+	}
+	defer resp.Body.Close()
+
+	var parser expfmt.TextParser
+	families, err := parser.TextToMetricFamilies(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("parse Caddy metrics: %w", err)
+	}
+
+	var res []*dto.MetricFamily
+	for name, family := range families {
+		for _, prefix := range caddyMetricPrefixes {
+			if strings.HasPrefix(name, prefix) {
+				res = append(res, family)
+				break
+			}
+		}
+	}
+
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].GetName() < res[j].GetName()
+	})
+
+	return res, nil
+}
+
+var _ prometheus.Gatherer = (*Controller)(nil)
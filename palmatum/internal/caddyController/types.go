@@ -7,17 +7,54 @@ import (
 
 type RouteDestination struct {
 	ID          int    `db:"id"`
+	Site        string `db:"site"`
 	Domain      string `db:"domain"`
 	Path        string `db:"path"`
 	ContentPath string `db:"content_path"`
+	SPAFallback bool   `db:"spa_fallback"`
+	AllowedIPs  string `db:"allowed_ips"` // space-separated list of IP addresses and CIDR ranges
+	OIDC        bool   `db:"oidc"`        // whether visitors must log in with single sign-on
+
+	RateLimitRequests           int `db:"rate_limit_requests"`            // per second per client IP, zero for no limit
+	RateLimitBandwidthKilobytes int `db:"rate_limit_bandwidth_kilobytes"` // per second across all clients, zero for no limit
+
+	Headers     []*HeaderRule `db:"-"`
+	ErrorPages  *ErrorPages   `db:"-"`
+	Credentials []*Credential `db:"-"`
+}
+
+// Credential is a username and bcrypt password hash that can be used to access a route with HTTP Basic Auth.
+type Credential struct {
+	Username     string
+	PasswordHash string
+}
+
+// ErrorPages contains the paths of pages within a site that should be served in place of an error response. Empty
+// paths are ignored.
+type ErrorPages struct {
+	NotFound    string
+	ServerError string
+}
+
+// HeaderRule is a set of response headers to be applied to all requests whose path matches Path. Path is relative to
+// the root of the site, not the root of the domain.
+type HeaderRule struct {
+	Path    string
+	Headers []*HeaderField
+}
+
+type HeaderField struct {
+	Name  string
+	Value string
 }
 
-// RouteSpec maps domains to a set of routes within them and describes how to map them all together
+// RouteSpec maps domains to a set of routes within them and describes how to map them all together. Routes under the
+// empty domain are served for any domain that doesn't otherwise have any routes.
 type RouteSpec map[string][]*RouteDestination
 
 func (rs RouteSpec) sortValues() {
 	for _, v := range rs {
-		// sort longest path first and hence match longest path first
+		// sort longest path first and hence match longest path first, then by path so that the order is always the same
 		slices.SortFunc(v, func(a, b *RouteDestination) int {
 			sa := len(strings.Split(strings.TrimRight(a.Path, "/"), "/"))
 			sb := len(strings.Split(strings.TrimRight(b.Path, "/"), "/"))
@@ -27,7 +64,7 @@ func (rs RouteSpec) sortValues() {
 			} else if sa > sb {
 				return -1
 			}
-			return 0
+			return strings.Compare(a.Path, b.Path)
 		})
 	}
 }
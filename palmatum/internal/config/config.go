@@ -3,8 +3,10 @@ package config
 import (
 	"fmt"
 	"go.akpain.net/cfger"
+	"log/slog"
 	"os"
 	"path"
+	"strings"
 )
 
 type HTTP struct {
@@ -12,12 +14,28 @@ type HTTP struct {
 	ManagementHost string
 	SitesPort      int
 	SitesHost      string
+	// SitesPublicScheme is the scheme that visitors use to access sites, which may be different to what Caddy serves
+	// if Palmatum is behind a reverse proxy that terminates TLS.
+	SitesPublicScheme string
 }
 
 func (h *HTTP) ManagementAddress() string {
 	return fmt.Sprintf("%s:%d", h.ManagementHost, h.ManagementPort)
 }
 
+// InternalManagementAddress returns an address that can be used to connect to the management server from the same
+// machine.
+func (h *HTTP) InternalManagementAddress() string {
+	host := h.ManagementHost
+	switch host {
+	case "", "0.0.0.0":
+		host = "127.0.0.1"
+	case "::", "[::]":
+		host = "[::1]"
+	}
+	return fmt.Sprintf("%s:%d", host, h.ManagementPort)
+}
+
 func (h *HTTP) SitesAddress() string {
 	return fmt.Sprintf("%s:%d", h.SitesHost, h.SitesPort)
 }
@@ -30,13 +48,140 @@ type Platform struct {
 	SitesDirectory         string
 	MaxUploadSizeMegabytes int
 	CaddyExecutablePath    string
+	// CaddyAdminAddress is the address that Caddy's admin API listens on, which must only be reachable from this
+	// machine.
+	CaddyAdminAddress string
+	// GitExecutablePath is the path to the git binary used to fetch sites that are deployed from a Git repository.
+	GitExecutablePath string
+	// BuildDirectory is where site sources are stored while they're waiting to be built, and where builds are run.
+	//
+	// Build commands are run with sh -c as the same user as Palmatum, so they have all of its privileges and can read
+	// and write anything that it can, including its database, config file and the content of every other site. Only
+	// give the admin role, which is needed to set a build command, to people who you'd trust with a shell on this
+	// machine, or run Palmatum in a container or as an unprivileged user.
+	BuildDirectory string
+	// JobWorkers is the number of background jobs, other than builds, that can run at once.
+	JobWorkers int
+	// BuildWorkers is the number of site builds that can run at once.
+	BuildWorkers int
+	// BuildTimeoutMinutes is how long a build command can run for before it's killed.
+	BuildTimeoutMinutes int
+	// ErrorPagePath is the path to an HTML file that's served for any error that a site doesn't have its own page for,
+	// and for any request that doesn't match a route. If empty, a plain text response is used instead.
+	ErrorPagePath string
+	// UnknownHostSite is the slug of a site that's served for requests to any domain that doesn't have a route. If
+	// empty, the page at UnknownHostPagePath is served instead.
+	UnknownHostSite string
+	// UnknownHostPagePath is the path to an HTML file that's served for requests to any domain that doesn't have a
+	// route. If empty, a built-in page is used.
+	UnknownHostPagePath string
+	// UnknownHostMisdirected causes requests for unknown domains to be responded to with a 421 Misdirected Request
+	// status instead of a 404.
+	UnknownHostMisdirected bool
+	// AccessLogRetentionDays is how long requests to sites are kept in the access log for. If zero, requests aren't
+	// logged. Client IP addresses are stored with their last octet (or last 80 bits for IPv6) removed.
+	AccessLogRetentionDays int
+	// SessionSecret is used to sign the session cookies of visitors that have logged in to a site protected by single
+	// sign-on. If empty, a random secret is generated on startup.
+	SessionSecret string
+	// SiteQuotaMegabytes is how much disk space each site's content can use, unless the site has its own quota. If
+	// zero, sites can use any amount.
+	SiteQuotaMegabytes int
+	// TotalQuotaMegabytes is how much disk space the content of every site can use between them. If zero, there's no
+	// limit.
+	TotalQuotaMegabytes int
+	// OrphanCollectionIntervalMinutes is how often archives that aren't used by any site are removed from
+	// SitesDirectory. If zero, they're only removed when asked to through the API.
+	OrphanCollectionIntervalMinutes int
+	// OrphanGracePeriodMinutes is how long an unused archive is kept for after it was last modified before it can be
+	// removed. Archives that are still being deployed are never removed, so this only matters for recovering archives
+	// that were left behind.
+	OrphanGracePeriodMinutes int
+}
+
+// ManagementAuth configures OpenID Connect login for the management UI. If OIDCIssuer is empty, the management UI
+// doesn't require users to log in.
+type ManagementAuth struct {
+	OIDCIssuer       string
+	OIDCClientID     string
+	OIDCClientSecret string
+	// PublicURL is the URL that users use to access the management UI, which is used to build the login callback URL.
+	// If empty, it's inferred from each request.
+	PublicURL string
+	// AdminGroups, DeployerGroups and ReadOnlyGroups are lists of OIDC group claims, separated by commas or spaces,
+	// that grant their respective roles to users that log in.
+	AdminGroups    string
+	DeployerGroups string
+	ReadOnlyGroups string
+	// DefaultRole is the role given to users that don't have a role assigned to them either by their groups or by an
+	// admin. If empty, these users cannot log in.
+	DefaultRole string
+}
+
+func (m *ManagementAuth) Enabled() bool {
+	return m.OIDCIssuer != ""
+}
+
+type Logging struct {
+	// Format is either "text" or "json".
+	Format string
+	// Level is the minimum level of log messages that are written.
+	Level slog.Level
+	// AreaLevels overrides Level for log messages from particular parts of Palmatum, such as "caddy" or "http".
+	AreaLevels map[string]slog.Level
+}
+
+// LevelFor returns the minimum level of log messages that are written for area.
+func (l *Logging) LevelFor(area string) slog.Level {
+	if level, found := l.AreaLevels[area]; found {
+		return level
+	}
+	return l.Level
+}
+
+// parseAreaLevels parses a list of area=level pairs, separated by commas or spaces.
+func parseAreaLevels(s string) (map[string]slog.Level, error) {
+	res := make(map[string]slog.Level)
+	for _, item := range strings.FieldsFunc(s, func(r rune) bool { return r == ',' || r == ' ' }) {
+		area, levelString, found := strings.Cut(item, "=")
+		if !found || area == "" {
+			return nil, fmt.Errorf("invalid area log level %q (expected area=level)", item)
+		}
+		var level slog.Level
+		if err := level.UnmarshalText([]byte(levelString)); err != nil {
+			return nil, fmt.Errorf("invalid log level for area %s: %w", area, err)
+		}
+		res[area] = level
+	}
+	return res, nil
+}
+
+// Tracing configures the export of OpenTelemetry traces from Palmatum and Caddy. If OTLPEndpoint is empty, traces
+// aren't recorded.
+type Tracing struct {
+	// OTLPEndpoint is the URL of an OTLP gRPC receiver, such as http://localhost:4317. Traces are sent without TLS if
+	// the scheme is http.
+	OTLPEndpoint string
+	// SamplePercent is the percentage of traces that are recorded, unless the trace was started by a caller that has
+	// already decided whether to record it.
+	SamplePercent int
+	// ServiceName is the name that Palmatum's spans are recorded under. Caddy's spans are recorded under the same name
+	// with "-caddy" appended.
+	ServiceName string
+}
+
+func (t *Tracing) Enabled() bool {
+	return t.OTLPEndpoint != ""
 }
 
 type Config struct {
-	Debug    bool
-	HTTP     *HTTP
-	Database *Database
-	Platform *Platform
+	Debug          bool
+	Logging        *Logging
+	Tracing        *Tracing
+	HTTP           *HTTP
+	Database       *Database
+	Platform       *Platform
+	ManagementAuth *ManagementAuth
 }
 
 func Load() (*Config, error) {
@@ -57,13 +202,41 @@ func Load() (*Config, error) {
 		return nil, err
 	}
 
+	debug := cl.Get("debug").WithDefault(false).AsBool()
+
+	defaultLevel := "info"
+	if debug {
+		defaultLevel = "debug"
+	}
+
+	var logLevel slog.Level
+	if err := logLevel.UnmarshalText([]byte(cl.Get("logging.level").WithDefault(defaultLevel).AsString())); err != nil {
+		return nil, fmt.Errorf("invalid log level: %w", err)
+	}
+
+	areaLevels, err := parseAreaLevels(cl.Get("logging.areaLevels").WithDefault("").AsString())
+	if err != nil {
+		return nil, err
+	}
+
 	conf := &Config{
-		Debug: cl.Get("debug").WithDefault(false).AsBool(),
+		Debug: debug,
+		Logging: &Logging{
+			Format:     cl.Get("logging.format").WithDefault("text").AsString(),
+			Level:      logLevel,
+			AreaLevels: areaLevels,
+		},
+		Tracing: &Tracing{
+			OTLPEndpoint:  cl.Get("tracing.otlpEndpoint").WithDefault("").AsString(),
+			SamplePercent: cl.Get("tracing.samplePercent").WithDefault(100).AsInt(),
+			ServiceName:   cl.Get("tracing.serviceName").WithDefault("palmatum").AsString(),
+		},
 		HTTP: &HTTP{
-			ManagementHost: cl.Get("http.managementHost").WithDefault("127.0.0.1").AsString(),
-			ManagementPort: cl.Get("http.managementPort").WithDefault(8080).AsInt(),
-			SitesHost:      cl.Get("http.sitesHost").WithDefault("0.0.0.0").AsString(),
-			SitesPort:      cl.Get("http.sitesPort").WithDefault(8081).AsInt(),
+			ManagementHost:    cl.Get("http.managementHost").WithDefault("127.0.0.1").AsString(),
+			ManagementPort:    cl.Get("http.managementPort").WithDefault(8080).AsInt(),
+			SitesHost:         cl.Get("http.sitesHost").WithDefault("0.0.0.0").AsString(),
+			SitesPort:         cl.Get("http.sitesPort").WithDefault(8081).AsInt(),
+			SitesPublicScheme: cl.Get("http.sitesPublicScheme").WithDefault("http").AsString(),
 		},
 		Database: &Database{
 			DSN: cl.Get("database.dsn").WithDefault("palmatum.db").AsString(),
@@ -72,8 +245,53 @@ func Load() (*Config, error) {
 			SitesDirectory:         cl.Get("platform.sitesDirectory").Required().AsString(),
 			MaxUploadSizeMegabytes: cl.Get("platform.maxUploadSizeMegabytes").WithDefault(512).AsInt(),
 			CaddyExecutablePath:    cl.Get("platform.caddyExecutablePath").WithDefault(path.Join(path.Dir(exePath), "caddy")).AsString(),
+			CaddyAdminAddress:      cl.Get("platform.caddyAdminAddress").WithDefault("localhost:52019").AsString(),
+			GitExecutablePath:      cl.Get("platform.gitExecutablePath").WithDefault("git").AsString(),
+			BuildDirectory:         cl.Get("platform.buildDirectory").WithDefault(path.Join(os.TempDir(), "palmatum-builds")).AsString(),
+			JobWorkers:             cl.Get("platform.jobWorkers").WithDefault(2).AsInt(),
+			BuildWorkers:           cl.Get("platform.buildWorkers").WithDefault(2).AsInt(),
+			BuildTimeoutMinutes:    cl.Get("platform.buildTimeoutMinutes").WithDefault(15).AsInt(),
+			ErrorPagePath:          cl.Get("platform.errorPagePath").WithDefault("").AsString(),
+			UnknownHostSite:        cl.Get("platform.unknownHostSite").WithDefault("").AsString(),
+			UnknownHostPagePath:    cl.Get("platform.unknownHostPagePath").WithDefault("").AsString(),
+			UnknownHostMisdirected: cl.Get("platform.unknownHostMisdirected").WithDefault(false).AsBool(),
+			AccessLogRetentionDays: cl.Get("platform.accessLogRetentionDays").WithDefault(7).AsInt(),
+			SessionSecret:          cl.Get("platform.sessionSecret").WithDefault("").AsString(),
+			SiteQuotaMegabytes:     cl.Get("platform.siteQuotaMegabytes").WithDefault(0).AsInt(),
+			TotalQuotaMegabytes:    cl.Get("platform.totalQuotaMegabytes").WithDefault(0).AsInt(),
+
+			OrphanCollectionIntervalMinutes: cl.Get("platform.orphanCollectionIntervalMinutes").WithDefault(60).AsInt(),
+			OrphanGracePeriodMinutes:        cl.Get("platform.orphanGracePeriodMinutes").WithDefault(60).AsInt(),
+		},
+		ManagementAuth: &ManagementAuth{
+			OIDCIssuer:       cl.Get("managementAuth.oidcIssuer").WithDefault("").AsString(),
+			OIDCClientID:     cl.Get("managementAuth.oidcClientID").WithDefault("").AsString(),
+			OIDCClientSecret: cl.Get("managementAuth.oidcClientSecret").WithDefault("").AsString(),
+			PublicURL:        cl.Get("managementAuth.publicURL").WithDefault("").AsString(),
+			AdminGroups:      cl.Get("managementAuth.adminGroups").WithDefault("").AsString(),
+			DeployerGroups:   cl.Get("managementAuth.deployerGroups").WithDefault("").AsString(),
+			ReadOnlyGroups:   cl.Get("managementAuth.readOnlyGroups").WithDefault("").AsString(),
+			DefaultRole:      cl.Get("managementAuth.defaultRole").WithDefault("").AsString(),
 		},
 	}
 
+	switch conf.Logging.Format {
+	case "text", "json":
+	default:
+		return nil, fmt.Errorf("invalid log format %q (expected text or json)", conf.Logging.Format)
+	}
+
+	if p := conf.Tracing.SamplePercent; p < 0 || p > 100 {
+		return nil, fmt.Errorf("invalid tracing sample percentage %d (expected between 0 and 100)", p)
+	}
+
+	if conf.Platform.SiteQuotaMegabytes < 0 || conf.Platform.TotalQuotaMegabytes < 0 {
+		return nil, fmt.Errorf("storage quotas cannot be negative")
+	}
+
+	if conf.Platform.OrphanGracePeriodMinutes < 0 {
+		return nil, fmt.Errorf("orphaned archive grace period cannot be negative")
+	}
+
 	return conf, nil
 }
@@ -0,0 +1,172 @@
+package core
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"git.tdpain.net/codemicro/palmatum/palmatum/internal/database"
+	"github.com/mattn/go-sqlite3"
+	"golang.org/x/crypto/bcrypt"
+	"net/netip"
+	"regexp"
+	"strings"
+)
+
+var (
+	ErrInvalidIPAddress   = newError("invalid IP address or CIDR range")
+	ErrInvalidUsername    = newError("invalid username")
+	ErrInvalidPassword    = newError("invalid password (must be between 8 and 72 characters)")
+	ErrDuplicateUsername  = newError("username in use")
+	ErrCredentialNotFound = newError("credential not found")
+
+	UsernameValidationRegexp = regexp.MustCompile(`^[\w\-.@]+$`)
+)
+
+// ParseIPAllowlist parses a list of IP addresses and CIDR ranges separated by commas or whitespace into a normalised
+// space-separated form.
+func ParseIPAllowlist(s string) (string, error) {
+	var res []string
+	for _, item := range splitList(s) {
+		if strings.ContainsRune(item, '/') {
+			prefix, err := netip.ParsePrefix(item)
+			if err != nil {
+				return "", ErrInvalidIPAddress
+			}
+			res = append(res, prefix.Masked().String())
+		} else {
+			addr, err := netip.ParseAddr(item)
+			if err != nil {
+				return "", ErrInvalidIPAddress
+			}
+			res = append(res, addr.String())
+		}
+	}
+	return strings.Join(res, " "), nil
+}
+
+// SetSiteAllowedIPs restricts access to a site to only the IP addresses and CIDR ranges in allowedIPs. If allowedIPs
+// is empty, the site is accessible from any address.
+func (c *Core) SetSiteAllowedIPs(siteSlug string, allowedIPs string) error {
+	allowedIPs, err := ParseIPAllowlist(allowedIPs)
+	if err != nil {
+		return err
+	}
+
+	tx, err := c.Database.Beginx()
+	if err != nil {
+		return fmt.Errorf("begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec(`UPDATE sites SET allowed_ips = ? WHERE slug = ?`, allowedIPs, siteSlug)
+	if err != nil {
+		return fmt.Errorf("call database: %w", err)
+	}
+
+	if n, err := res.RowsAffected(); err != nil {
+		return fmt.Errorf("get number of affected rows: %w", err)
+	} else if n == 0 {
+		return ErrInvalidSlug
+	}
+
+	if err := c.validateRoutes(tx); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("commit transaction: %w", err)
+	}
+
+	c.scheduleRouteRebuild()
+
+	return nil
+}
+
+// AddSiteCredential adds a username and password that can be used to access a site with HTTP Basic Auth. Once a site
+// has at least one credential, visitors must use one of them to access it.
+func (c *Core) AddSiteCredential(siteSlug, username, password string) error {
+	if !UsernameValidationRegexp.MatchString(username) {
+		return ErrInvalidUsername
+	}
+
+	// bcrypt won't accept anything longer than 72 bytes
+	if len(password) < 8 || len(password) > 72 {
+		return ErrInvalidPassword
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return fmt.Errorf("hash password: %w", err)
+	}
+
+	tx, err := c.Database.Beginx()
+	if err != nil {
+		return fmt.Errorf("begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	// Foreign keys aren't enforced, so the site has to be checked for explicitly
+	if _, err := database.GetSite(tx, siteSlug); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrInvalidSlug
+		}
+		return fmt.Errorf("get site from database: %w", err)
+	}
+
+	_, err = tx.Exec(`INSERT INTO site_credentials(site, username, password_hash) VALUES (?, ?, ?)`, siteSlug, username, string(hash))
+	if err != nil {
+		var e sqlite3.Error
+		if errors.As(err, &e) {
+			if e.ExtendedCode == sqlite3.ErrConstraintForeignKey {
+				return ErrInvalidSlug
+			}
+			if e.ExtendedCode == sqlite3.ErrConstraintUnique {
+				return ErrDuplicateUsername
+			}
+		}
+		return fmt.Errorf("call database: %w", err)
+	}
+
+	if err := c.validateRoutes(tx); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("commit transaction: %w", err)
+	}
+
+	c.scheduleRouteRebuild()
+
+	return nil
+}
+
+func (c *Core) DeleteSiteCredential(siteSlug, username string) error {
+	tx, err := c.Database.Beginx()
+	if err != nil {
+		return fmt.Errorf("begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec(`DELETE FROM site_credentials WHERE site = ? AND username = ?`, siteSlug, username)
+	if err != nil {
+		return fmt.Errorf("call database: %w", err)
+	}
+
+	if n, err := res.RowsAffected(); err != nil {
+		return fmt.Errorf("get number of affected rows: %w", err)
+	} else if n == 0 {
+		return ErrCredentialNotFound
+	}
+
+	if err := c.validateRoutes(tx); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("commit transaction: %w", err)
+	}
+
+	c.scheduleRouteRebuild()
+
+	return nil
+}
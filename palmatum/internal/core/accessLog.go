@@ -0,0 +1,321 @@
+package core
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"git.tdpain.net/codemicro/palmatum/palmatum/internal/database"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	accessLogBatchSize     = 250
+	accessLogFlushInterval = time.Second
+	accessLogPruneInterval = time.Hour
+	// accessLogMaxFieldLength is the longest that a user agent or referrer can be before it's cut short.
+	accessLogMaxFieldLength = 512
+)
+
+// caddyAccessLogEntry is the subset of an access log entry written by Caddy that's stored. Site is added to the entry
+// by the log_append directive in each route.
+type caddyAccessLogEntry struct {
+	Timestamp float64 `json:"ts"`
+	Request   struct {
+		ClientIP string      `json:"client_ip"`
+		Method   string      `json:"method"`
+		Host     string      `json:"host"`
+		URI      string      `json:"uri"`
+		Headers  http.Header `json:"headers"`
+	} `json:"request"`
+	Duration float64 `json:"duration"`
+	Size     int64   `json:"size"`
+	Status   int     `json:"status"`
+	Site     string  `json:"palmatum_site"`
+}
+
+// accessLogSink receives access logs from Caddy, stores them in the database and adds them to the analytics rollups.
+type accessLogSink struct {
+	// dir contains the socket that listener is listening on.
+	dir      string
+	listener net.Listener
+	entries  chan *database.AccessLogModel
+}
+
+// startAccessLogSink starts listening for access logs from Caddy, which must be done before Caddy is configured so
+// that it knows where to send them.
+//
+// Logs are received on a Unix socket in a directory that only the current user can access, rather than on a TCP port,
+// so that other users on the same machine can't write fake entries.
+func (c *Core) startAccessLogSink(ctx context.Context) error {
+	dir, err := os.MkdirTemp("", "palmatum-access-log-")
+	if err != nil {
+		return fmt.Errorf("create access log socket directory: %w", err)
+	}
+
+	socketPath := filepath.Join(dir, "access.sock")
+	l, err := net.Listen("unix", socketPath)
+	if err != nil {
+		_ = os.RemoveAll(dir)
+		return fmt.Errorf("listen for access logs: %w", err)
+	}
+
+	if err := os.Chmod(socketPath, 0600); err != nil {
+		_ = l.Close()
+		_ = os.RemoveAll(dir)
+		return fmt.Errorf("set access log socket permissions: %w", err)
+	}
+
+	c.accessLogs.dir = dir
+	c.accessLogs.listener = l
+	c.accessLogs.entries = make(chan *database.AccessLogModel, accessLogBatchSize*4)
+	c.CaddyController.SetAccessLogAddress("unix/" + socketPath)
+
+	go c.acceptAccessLogConnections()
+	go c.runAccessLogWriter(ctx)
+	go c.runAccessLogPruner(ctx)
+
+	return nil
+}
+
+func (c *Core) acceptAccessLogConnections() {
+	for {
+		conn, err := c.accessLogs.listener.Accept()
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				c.Logger.Error("unable to accept access log connection", "error", err)
+			}
+			return
+		}
+		go c.readAccessLogs(conn)
+	}
+}
+
+func (c *Core) readAccessLogs(conn net.Conn) {
+	defer conn.Close()
+
+	scanner := bufio.NewScanner(conn)
+	scanner.Buffer(nil, 1024*1024)
+	for scanner.Scan() {
+		var raw caddyAccessLogEntry
+		if err := json.Unmarshal(scanner.Bytes(), &raw); err != nil {
+			c.Logger.Debug("unable to parse access log entry", "error", err)
+			continue
+		}
+
+		if raw.Site == "" {
+			// Requests that didn't match a route
+			continue
+		}
+
+		entry := &database.AccessLogModel{
+			Site:       raw.Site,
+			Timestamp:  int64(raw.Timestamp),
+			Method:     raw.Request.Method,
+			Host:       raw.Request.Host,
+			Path:       raw.Request.URI,
+			Status:     raw.Status,
+			Size:       raw.Size,
+			DurationMS: raw.Duration * 1000,
+			RemoteIP:   raw.Request.ClientIP,
+			UserAgent:  truncateString(raw.Request.Headers.Get("User-Agent"), accessLogMaxFieldLength),
+			Referer:    truncateString(raw.Request.Headers.Get("Referer"), accessLogMaxFieldLength),
+		}
+
+		// The query string is dropped since it might contain something sensitive
+		if u, err := url.ParseRequestURI(raw.Request.URI); err == nil {
+			entry.Path = u.Path
+		}
+
+		select {
+		case c.accessLogs.entries <- entry:
+		default:
+			c.Logger.Warn("access log buffer full, dropping entry", "site", entry.Site)
+		}
+	}
+
+	if err := scanner.Err(); err != nil && !errors.Is(err, net.ErrClosed) {
+		c.Logger.Warn("error reading access logs", "error", err)
+	}
+}
+
+// runAccessLogWriter writes access log entries to the database in batches until ctx is cancelled.
+func (c *Core) runAccessLogWriter(ctx context.Context) {
+	ticker := time.NewTicker(accessLogFlushInterval)
+	defer ticker.Stop()
+
+	var batch []*database.AccessLogModel
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		if err := c.insertAccessLogs(batch); err != nil {
+			c.Logger.Error("unable to store access logs", "error", err, "count", len(batch))
+		}
+		batch = batch[:0]
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			flush()
+			return
+		case entry := <-c.accessLogs.entries:
+			batch = append(batch, entry)
+			if len(batch) >= accessLogBatchSize {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		}
+	}
+}
+
+func (c *Core) insertAccessLogs(entries []*database.AccessLogModel) error {
+	tx, err := c.Database.Beginx()
+	if err != nil {
+		return fmt.Errorf("begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	stmt, err := tx.PrepareNamed(`INSERT INTO access_log(site, timestamp, method, host, path, status, size, duration_ms, remote_ip, user_agent, referer) VALUES (:site, :timestamp, :method, :host, :path, :status, :size, :duration_ms, :remote_ip, :user_agent, :referer)`)
+	if err != nil {
+		return fmt.Errorf("prepare statement: %w", err)
+	}
+	defer stmt.Close()
+
+	for _, entry := range entries {
+		// The full address is only needed to count visitors, which doesn't store it
+		stored := *entry
+		stored.RemoteIP = anonymiseIP(entry.RemoteIP)
+		if _, err := stmt.Exec(&stored); err != nil {
+			return fmt.Errorf("call database: %w", err)
+		}
+		if err := recordAnalytics(tx, entry); err != nil {
+			return fmt.Errorf("record analytics: %w", err)
+		}
+	}
+
+	return tx.Commit()
+}
+
+// runAccessLogPruner removes access log entries that are older than the retention period, and analytics data that's no
+// longer needed, until ctx is cancelled.
+func (c *Core) runAccessLogPruner(ctx context.Context) {
+	ticker := time.NewTicker(accessLogPruneInterval)
+	defer ticker.Stop()
+
+	for {
+		cutoff := time.Now().AddDate(0, 0, -c.Config.Platform.AccessLogRetentionDays)
+		if _, err := c.Database.Exec(`DELETE FROM access_log WHERE timestamp < ?`, cutoff.Unix()); err != nil {
+			c.Logger.Error("unable to prune access logs", "error", err)
+		}
+		if err := c.pruneAnalytics(); err != nil {
+			c.Logger.Error("unable to prune analytics", "error", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// anonymiseIP removes the part of an IP address that identifies a single host, keeping the first 24 bits of an IPv4
+// address or the first 48 bits of an IPv6 address. Invalid addresses are removed entirely.
+func anonymiseIP(ip string) string {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return ""
+	}
+	addr = addr.Unmap()
+
+	bits := 24
+	if addr.Is6() {
+		bits = 48
+	}
+
+	prefix, err := addr.Prefix(bits)
+	if err != nil {
+		return ""
+	}
+	return prefix.Addr().String()
+}
+
+// truncateString cuts s short at n bytes, without leaving part of a multi-byte character at the end.
+func truncateString(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	return strings.ToValidUTF8(s[:n], "")
+}
+
+func (c *Core) stopAccessLogSink() error {
+	if c.accessLogs.listener == nil {
+		return nil
+	}
+	err := c.accessLogs.listener.Close()
+	if rmErr := os.RemoveAll(c.accessLogs.dir); err == nil {
+		err = rmErr
+	}
+	return err
+}
+
+var ErrInvalidStatusFilter = newError("invalid status filter (expected a status code like 404, or a class like 4xx)")
+
+// AccessLogFilter restricts the entries returned by QueryAccessLog. Empty fields don't filter anything.
+type AccessLogFilter struct {
+	// Status is either a status code (eg. 404) or a class of status codes (eg. 4xx).
+	Status string
+	// Path matches any entry with a path that starts with it.
+	Path string
+	// Limit is the maximum number of entries to return. If zero, all matching entries are returned.
+	Limit int
+}
+
+// QueryAccessLog returns requests to a site that match filter, newest first.
+func (c *Core) QueryAccessLog(siteSlug string, filter *AccessLogFilter) ([]*database.AccessLogModel, error) {
+	conditions := []string{"site = ?"}
+	args := []any{siteSlug}
+
+	if s := strings.ToLower(filter.Status); s != "" {
+		if len(s) == 3 && s[0] >= '1' && s[0] <= '5' && s[1:] == "xx" {
+			class := int(s[0]-'0') * 100
+			conditions = append(conditions, "status >= ? AND status < ?")
+			args = append(args, class, class+100)
+		} else if code, err := strconv.Atoi(s); err == nil && code >= 100 && code <= 599 {
+			conditions = append(conditions, "status = ?")
+			args = append(args, code)
+		} else {
+			return nil, ErrInvalidStatusFilter
+		}
+	}
+
+	if filter.Path != "" {
+		conditions = append(conditions, "substr(path, 1, length(?)) = ?")
+		args = append(args, filter.Path, filter.Path)
+	}
+
+	query := "SELECT * FROM access_log WHERE " + strings.Join(conditions, " AND ") + " ORDER BY id DESC"
+	if filter.Limit > 0 {
+		query += " LIMIT ?"
+		args = append(args, filter.Limit)
+	}
+
+	var res []*database.AccessLogModel
+	if err := c.Database.Select(&res, query, args...); err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return nil, fmt.Errorf("call database: %w", err)
+	}
+	return res, nil
+}
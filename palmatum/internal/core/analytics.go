@@ -0,0 +1,278 @@
+package core
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"git.tdpain.net/codemicro/palmatum/palmatum/internal/database"
+	"github.com/jmoiron/sqlx"
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+)
+
+const (
+	analyticsKindPath     = "path"
+	analyticsKindReferrer = "referrer"
+	analyticsKindNotFound = "not_found"
+
+	// analyticsRetentionDays is how long daily rollups are kept for.
+	analyticsRetentionDays = 400
+	// MaxAnalyticsDays is the longest period that analytics can be queried for at once.
+	MaxAnalyticsDays  = 366
+	analyticsTopLimit = 10
+
+	// analyticsMaxTopValues is the number of different values of each kind that are counted for a site each day.
+	// Anything else is counted as analyticsOtherValue, so that requests for random paths can't grow the table without
+	// limit.
+	analyticsMaxTopValues = 1000
+	analyticsOtherValue   = "(other)"
+	// analyticsMaxValueLength is the longest that a value can be before it's cut short.
+	analyticsMaxValueLength = 512
+)
+
+func analyticsDay(t time.Time) string {
+	return t.UTC().Format(time.DateOnly)
+}
+
+// getAnalyticsSalt returns the random value mixed into visitor hashes for day, creating it if it doesn't exist yet.
+// Since it's thrown away once the day is over, hashes can't be linked to visitors after that, or to the same visitor
+// on a different day. It's stored in the database so that visitors aren't counted twice if Palmatum restarts.
+func getAnalyticsSalt(tx *sqlx.Tx, day string) ([]byte, error) {
+	var salt []byte
+	err := tx.QueryRowx(`SELECT salt FROM analytics_salts WHERE day = ?`, day).Scan(&salt)
+	if err == nil {
+		return salt, nil
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		return nil, fmt.Errorf("get salt: %w", err)
+	}
+
+	salt = make([]byte, 32)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, fmt.Errorf("generate salt: %w", err)
+	}
+
+	if _, err := tx.Exec(`INSERT INTO analytics_salts(day, salt) VALUES (?, ?)`, day, salt); err != nil {
+		return nil, fmt.Errorf("store salt: %w", err)
+	}
+
+	return salt, nil
+}
+
+// isPageView reports whether a request was for a page, as opposed to an asset like an image or stylesheet.
+func isPageView(entry *database.AccessLogModel) bool {
+	if entry.Method != http.MethodGet {
+		return false
+	}
+	if !(entry.Status >= 200 && entry.Status < 300) && entry.Status != http.StatusNotModified {
+		return false
+	}
+
+	ext := path.Ext(entry.Path)
+	return strings.HasSuffix(entry.Path, "/") || ext == "" || ext == ".html" || ext == ".htm"
+}
+
+// referrerHost returns the host of referrer, or an empty string if it's the same host as the request or isn't a valid
+// URL. Only the host is kept since the rest of the URL could identify the visitor.
+func referrerHost(referrer, host string) string {
+	u, err := url.Parse(referrer)
+	if err != nil || u.Host == "" {
+		return ""
+	}
+
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	if strings.EqualFold(u.Hostname(), host) {
+		return ""
+	}
+
+	return strings.ToLower(u.Hostname())
+}
+
+func incrementAnalyticsTop(tx *sqlx.Tx, site, day, kind, value string) error {
+	value = truncateString(value, analyticsMaxValueLength)
+
+	res, err := tx.Exec(`UPDATE analytics_top SET count = count + 1 WHERE site = ? AND day = ? AND kind = ? AND value = ?`, site, day, kind, value)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n != 0 {
+		return nil
+	}
+
+	var distinct int
+	if err := tx.QueryRow(`SELECT COUNT(*) FROM analytics_top WHERE site = ? AND day = ? AND kind = ?`, site, day, kind).Scan(&distinct); err != nil {
+		return err
+	}
+	if distinct >= analyticsMaxTopValues {
+		value = analyticsOtherValue
+	}
+
+	_, err = tx.Exec(`INSERT INTO analytics_top(site, day, kind, value, count) VALUES (?, ?, ?, ?, 1) ON CONFLICT DO UPDATE SET count = count + 1`, site, day, kind, value)
+	return err
+}
+
+// recordAnalytics adds an access log entry to the daily rollups for its site.
+func recordAnalytics(tx *sqlx.Tx, entry *database.AccessLogModel) error {
+	day := analyticsDay(time.Unix(entry.Timestamp, 0))
+
+	if entry.Method == http.MethodGet && entry.Status == http.StatusNotFound {
+		if _, err := tx.Exec(`INSERT INTO analytics_daily(site, day, not_found) VALUES (?, ?, 1) ON CONFLICT DO UPDATE SET not_found = not_found + 1`, entry.Site, day); err != nil {
+			return fmt.Errorf("update daily rollup: %w", err)
+		}
+		if err := incrementAnalyticsTop(tx, entry.Site, day, analyticsKindNotFound, entry.Path); err != nil {
+			return fmt.Errorf("update top missing pages: %w", err)
+		}
+		return nil
+	}
+
+	if !isPageView(entry) {
+		return nil
+	}
+
+	salt, err := getAnalyticsSalt(tx, day)
+	if err != nil {
+		return err
+	}
+
+	hasher := sha256.New()
+	hasher.Write(salt)
+	for _, s := range []string{entry.Site, entry.RemoteIP, entry.UserAgent} {
+		hasher.Write([]byte(s))
+		hasher.Write([]byte{0})
+	}
+
+	res, err := tx.Exec(`INSERT INTO analytics_visitors(site, day, hash) VALUES (?, ?, ?) ON CONFLICT DO NOTHING`, entry.Site, day, hex.EncodeToString(hasher.Sum(nil)))
+	if err != nil {
+		return fmt.Errorf("record visitor: %w", err)
+	}
+
+	var newVisitors int64
+	if newVisitors, err = res.RowsAffected(); err != nil {
+		return fmt.Errorf("record visitor: %w", err)
+	}
+
+	if _, err := tx.Exec(`INSERT INTO analytics_daily(site, day, page_views, visitors) VALUES (?, ?, 1, ?) ON CONFLICT DO UPDATE SET page_views = page_views + 1, visitors = visitors + excluded.visitors`, entry.Site, day, newVisitors); err != nil {
+		return fmt.Errorf("update daily rollup: %w", err)
+	}
+
+	if err := incrementAnalyticsTop(tx, entry.Site, day, analyticsKindPath, entry.Path); err != nil {
+		return fmt.Errorf("update top pages: %w", err)
+	}
+
+	if host := referrerHost(entry.Referer, entry.Host); host != "" {
+		if err := incrementAnalyticsTop(tx, entry.Site, day, analyticsKindReferrer, host); err != nil {
+			return fmt.Errorf("update top referrers: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// pruneAnalytics removes visitor hashes and salts from previous days, and rollups that are older than the retention
+// period.
+func (c *Core) pruneAnalytics() error {
+	today := analyticsDay(time.Now())
+
+	if _, err := c.Database.Exec(`DELETE FROM analytics_visitors WHERE day < ?`, today); err != nil {
+		return fmt.Errorf("delete visitor hashes: %w", err)
+	}
+	if _, err := c.Database.Exec(`DELETE FROM analytics_salts WHERE day < ?`, today); err != nil {
+		return fmt.Errorf("delete salts: %w", err)
+	}
+
+	cutoff := analyticsDay(time.Now().AddDate(0, 0, -analyticsRetentionDays))
+	if _, err := c.Database.Exec(`DELETE FROM analytics_daily WHERE day < ?`, cutoff); err != nil {
+		return fmt.Errorf("delete daily rollups: %w", err)
+	}
+	if _, err := c.Database.Exec(`DELETE FROM analytics_top WHERE day < ?`, cutoff); err != nil {
+		return fmt.Errorf("delete top rollups: %w", err)
+	}
+
+	return nil
+}
+
+// AnalyticsCount is the number of times a path or referrer was seen.
+type AnalyticsCount struct {
+	Value string `db:"value" json:"value"`
+	Count int    `db:"count" json:"count"`
+}
+
+// SiteAnalytics summarises the traffic to a site over a number of days.
+type SiteAnalytics struct {
+	// Days contains an entry for every day in the period, oldest first, even if there were no requests on that day.
+	Days      []*database.AnalyticsDayModel `json:"days"`
+	PageViews int                           `json:"pageViews"`
+	// Visitors is the sum of the unique visitors on each day. Visitors can't be tracked from one day to the next, so
+	// someone that visits on two days is counted twice.
+	Visitors     int               `json:"visitors"`
+	NotFound     int               `json:"notFound"`
+	TopPaths     []*AnalyticsCount `json:"topPaths"`
+	TopReferrers []*AnalyticsCount `json:"topReferrers"`
+	TopNotFound  []*AnalyticsCount `json:"topNotFound"`
+}
+
+var ErrInvalidAnalyticsPeriod = newError(fmt.Sprintf("invalid number of days (must be between 1 and %d)", MaxAnalyticsDays))
+
+// GetSiteAnalytics returns the traffic to a site over the last number of days, including today.
+func (c *Core) GetSiteAnalytics(siteSlug string, days int) (*SiteAnalytics, error) {
+	if days < 1 || days > MaxAnalyticsDays {
+		return nil, ErrInvalidAnalyticsPeriod
+	}
+
+	if _, err := database.GetSite(c.Database, siteSlug); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrInvalidSlug
+		}
+		return nil, fmt.Errorf("get site: %w", err)
+	}
+
+	now := time.Now().UTC()
+	since := analyticsDay(now.AddDate(0, 0, -(days - 1)))
+
+	var rows []*database.AnalyticsDayModel
+	if err := c.Database.Select(&rows, `SELECT * FROM analytics_daily WHERE site = ? AND day >= ?`, siteSlug, since); err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return nil, fmt.Errorf("get daily rollups: %w", err)
+	}
+
+	byDay := make(map[string]*database.AnalyticsDayModel, len(rows))
+	for _, row := range rows {
+		byDay[row.Day] = row
+	}
+
+	res := new(SiteAnalytics)
+	for i := days - 1; i >= 0; i -= 1 {
+		day := analyticsDay(now.AddDate(0, 0, -i))
+		row, found := byDay[day]
+		if !found {
+			row = &database.AnalyticsDayModel{Site: siteSlug, Day: day}
+		}
+		res.Days = append(res.Days, row)
+		res.PageViews += row.PageViews
+		res.Visitors += row.Visitors
+		res.NotFound += row.NotFound
+	}
+
+	for kind, dest := range map[string]*[]*AnalyticsCount{
+		analyticsKindPath:     &res.TopPaths,
+		analyticsKindReferrer: &res.TopReferrers,
+		analyticsKindNotFound: &res.TopNotFound,
+	} {
+		*dest = []*AnalyticsCount{}
+		if err := c.Database.Select(dest, `SELECT value, SUM(count) AS count FROM analytics_top WHERE site = ? AND day >= ? AND kind = ? GROUP BY value ORDER BY count DESC, value LIMIT ?`, siteSlug, since, kind, analyticsTopLimit); err != nil && !errors.Is(err, sql.ErrNoRows) {
+			return nil, fmt.Errorf("get top %s: %w", kind, err)
+		}
+	}
+
+	return res, nil
+}
@@ -0,0 +1,92 @@
+package core
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"git.tdpain.net/codemicro/palmatum/palmatum/internal/database"
+	"strings"
+	"time"
+)
+
+const (
+	AuditResultSuccess = "success"
+	AuditResultFailure = "failure"
+)
+
+// RecordAudit adds an entry to the audit log. If the entry has no timestamp, the current time is used.
+func (c *Core) RecordAudit(entry *database.AuditLogModel) error {
+	if entry.Timestamp == 0 {
+		entry.Timestamp = time.Now().Unix()
+	}
+
+	c.Logger.Info("audit", "actor", entry.Actor, "action", entry.Action, "target", entry.Target, "sourceIP", entry.SourceIP, "result", entry.Result, "detail", entry.Detail)
+
+	_, err := c.Database.NamedExec(`INSERT INTO audit_log(timestamp, actor, action, target, source_ip, result, detail) VALUES (:timestamp, :actor, :action, :target, :source_ip, :result, :detail)`, entry)
+	if err != nil {
+		return fmt.Errorf("call database: %w", err)
+	}
+	return nil
+}
+
+// AuditLogFilter restricts the entries returned by QueryAuditLog. Empty fields don't filter anything. Target matches
+// any entry with a target containing it.
+type AuditLogFilter struct {
+	Actor  string
+	Action string
+	Target string
+	Result string
+	Since  time.Time
+	Until  time.Time
+	// Limit is the maximum number of entries to return. If zero, all matching entries are returned.
+	Limit int
+}
+
+// QueryAuditLog returns entries from the audit log that match filter, newest first.
+func (c *Core) QueryAuditLog(filter *AuditLogFilter) ([]*database.AuditLogModel, error) {
+	var (
+		conditions []string
+		args       []any
+	)
+
+	if filter.Actor != "" {
+		conditions = append(conditions, "actor = ?")
+		args = append(args, filter.Actor)
+	}
+	if filter.Action != "" {
+		conditions = append(conditions, "action = ?")
+		args = append(args, filter.Action)
+	}
+	if filter.Target != "" {
+		conditions = append(conditions, "instr(target, ?) > 0")
+		args = append(args, filter.Target)
+	}
+	if filter.Result != "" {
+		conditions = append(conditions, "result = ?")
+		args = append(args, filter.Result)
+	}
+	if !filter.Since.IsZero() {
+		conditions = append(conditions, "timestamp >= ?")
+		args = append(args, filter.Since.Unix())
+	}
+	if !filter.Until.IsZero() {
+		conditions = append(conditions, "timestamp < ?")
+		args = append(args, filter.Until.Unix())
+	}
+
+	query := "SELECT * FROM audit_log"
+	if len(conditions) != 0 {
+		query += " WHERE " + strings.Join(conditions, " AND ")
+	}
+	query += " ORDER BY id DESC"
+	if filter.Limit > 0 {
+		query += " LIMIT ?"
+		args = append(args, filter.Limit)
+	}
+
+	var res []*database.AuditLogModel
+	if err := c.Database.Select(&res, query, args...); err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return nil, fmt.Errorf("call database: %w", err)
+	}
+	return res, nil
+}
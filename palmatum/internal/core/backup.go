@@ -0,0 +1,442 @@
+package core
+
+import (
+	"archive/tar"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"git.tdpain.net/codemicro/palmatum/palmatum/internal/database"
+	"github.com/jmoiron/sqlx"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+const (
+	backupFormatVersion    = 1
+	backupManifestName     = "manifest.json"
+	backupDatabaseName     = "palmatum.db"
+	backupArchiveDirectory = "archives/"
+
+	// backupAttempts is the number of times a snapshot is retaken if an archive it refers to is removed before it can
+	// be opened, which happens when a site is deployed to at the same time.
+	backupAttempts = 5
+
+	// maxManifestSize stops a damaged backup from making a restore read an unbounded amount into memory.
+	maxManifestSize = 64 << 20
+)
+
+var ErrInstanceNotEmpty = newError("instance is not empty (backups can only be restored into an instance without any sites)")
+
+// BackupManifest describes the contents of a backup. It's the last file in the backup, so a backup that was cut short
+// won't have one.
+type BackupManifest struct {
+	FormatVersion int           `json:"formatVersion"`
+	CreatedAt     int64         `json:"createdAt"`
+	Files         []*BackupFile `json:"files"`
+}
+
+type BackupFile struct {
+	Name   string `json:"name"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// These prefix the temporary directories that backups and restores use in the sites directory.
+const (
+	backupTempPrefix  = ".backup-"
+	restoreTempPrefix = ".restore-"
+)
+
+// Backup is a consistent snapshot of the database along with every archive that it refers to, ready to be written out
+// as a tarball. It must be closed once it's no longer needed.
+type Backup struct {
+	dir       string
+	createdAt time.Time
+	archives  map[string]*os.File
+}
+
+// CreateBackup snapshots the database and opens every archive that the snapshot refers to. The database stays in use
+// while this happens, and archives that are removed afterwards are still included in the backup.
+func CreateBackup(ctx context.Context, db *sqlx.DB, sitesDirectory string) (*Backup, error) {
+	// The snapshot is kept in the sites directory since that's where there's known to be space for site content
+	dir, err := os.MkdirTemp(sitesDirectory, backupTempPrefix)
+	if err != nil {
+		return nil, fmt.Errorf("create temporary directory: %w", err)
+	}
+
+	b := &Backup{dir: dir, createdAt: time.Now()}
+
+	for attempt := 1; ; attempt++ {
+		missing, err := b.snapshot(ctx, db, sitesDirectory)
+		if err != nil {
+			_ = b.Close()
+			return nil, err
+		}
+		if missing == "" {
+			return b, nil
+		}
+		if attempt == backupAttempts {
+			_ = b.Close()
+			return nil, fmt.Errorf("archive %s was removed before it could be backed up", missing)
+		}
+	}
+}
+
+// CreateBackup is like the package-level CreateBackup, for this instance.
+func (c *Core) CreateBackup(ctx context.Context) (b *Backup, err error) {
+	ctx, span := c.tracer.Start(ctx, "CreateBackup")
+	defer func() { endSpan(span, err) }()
+
+	return CreateBackup(ctx, c.Database, c.Config.Platform.SitesDirectory)
+}
+
+// snapshot takes a new snapshot of db and opens the archives that it refers to. If one of them has been removed since
+// the snapshot was taken, its name is returned so that another snapshot can be taken.
+func (b *Backup) snapshot(ctx context.Context, db *sqlx.DB, sitesDirectory string) (string, error) {
+	b.closeArchives()
+
+	fname := filepath.Join(b.dir, backupDatabaseName)
+	if err := os.Remove(fname); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return "", fmt.Errorf("remove previous snapshot: %w", err)
+	}
+
+	if err := database.Snapshot(ctx, db, fname); err != nil {
+		return "", fmt.Errorf("snapshot database: %w", err)
+	}
+
+	snapshot, err := database.OpenSnapshot(fname)
+	if err != nil {
+		return "", err
+	}
+	defer snapshot.Close()
+
+	referenced, err := referencedArchives(ctx, snapshot)
+	if err != nil {
+		return "", err
+	}
+
+	b.archives = make(map[string]*os.File, len(referenced))
+	for name := range referenced {
+		f, err := os.Open(path.Join(sitesDirectory, name))
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return name, nil
+			}
+			return "", fmt.Errorf("open archive: %w", err)
+		}
+		b.archives[name] = f
+	}
+
+	return "", nil
+}
+
+func (b *Backup) closeArchives() {
+	for _, f := range b.archives {
+		_ = f.Close()
+	}
+	b.archives = nil
+}
+
+func (b *Backup) Close() error {
+	b.closeArchives()
+	return os.RemoveAll(b.dir)
+}
+
+// removeStaleTemporaryDirectories removes the temporary directories left in sitesDirectory by backups and restores
+// that were interrupted, for example by the process being killed. It must only be called when no backup or restore is
+// running. The names of the directories that were removed are returned.
+func removeStaleTemporaryDirectories(sitesDirectory string) ([]string, error) {
+	entries, err := os.ReadDir(sitesDirectory)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("read sites directory: %w", err)
+	}
+
+	var removed []string
+	for _, entry := range entries {
+		name := entry.Name()
+		if !entry.IsDir() || !(strings.HasPrefix(name, backupTempPrefix) || strings.HasPrefix(name, restoreTempPrefix)) {
+			continue
+		}
+		if err := os.RemoveAll(path.Join(sitesDirectory, name)); err != nil {
+			return removed, fmt.Errorf("remove %s: %w", name, err)
+		}
+		removed = append(removed, name)
+	}
+	return removed, nil
+}
+
+// Write writes the backup to w as a tarball, followed by its manifest.
+func (b *Backup) Write(w io.Writer) error {
+	tw := tar.NewWriter(w)
+
+	manifest := &BackupManifest{
+		FormatVersion: backupFormatVersion,
+		CreatedAt:     b.createdAt.Unix(),
+	}
+
+	addFile := func(name string, f *os.File) error {
+		fi, err := f.Stat()
+		if err != nil {
+			return fmt.Errorf("stat %s: %w", name, err)
+		}
+
+		if err := tw.WriteHeader(&tar.Header{
+			Typeflag: tar.TypeReg,
+			Name:     name,
+			Size:     fi.Size(),
+			Mode:     0644,
+			ModTime:  fi.ModTime(),
+		}); err != nil {
+			return fmt.Errorf("write header for %s: %w", name, err)
+		}
+
+		h := sha256.New()
+		// A section is used so that the backup can be written more than once
+		if _, err := io.Copy(io.MultiWriter(tw, h), io.NewSectionReader(f, 0, fi.Size())); err != nil {
+			return fmt.Errorf("write %s: %w", name, err)
+		}
+
+		manifest.Files = append(manifest.Files, &BackupFile{
+			Name:   name,
+			Size:   fi.Size(),
+			SHA256: hex.EncodeToString(h.Sum(nil)),
+		})
+		return nil
+	}
+
+	dbFile, err := os.Open(filepath.Join(b.dir, backupDatabaseName))
+	if err != nil {
+		return fmt.Errorf("open snapshot: %w", err)
+	}
+	defer dbFile.Close()
+
+	if err := addFile(backupDatabaseName, dbFile); err != nil {
+		return err
+	}
+
+	names := make([]string, 0, len(b.archives))
+	for name := range b.archives {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+
+	for _, name := range names {
+		if err := addFile(backupArchiveDirectory+name, b.archives[name]); err != nil {
+			return err
+		}
+	}
+
+	manifestJSON, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return fmt.Errorf("encode manifest: %w", err)
+	}
+
+	if err := tw.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     backupManifestName,
+		Size:     int64(len(manifestJSON)),
+		Mode:     0644,
+		ModTime:  b.createdAt,
+	}); err != nil {
+		return fmt.Errorf("write header for manifest: %w", err)
+	}
+	if _, err := tw.Write(manifestJSON); err != nil {
+		return fmt.Errorf("write manifest: %w", err)
+	}
+
+	if err := tw.Close(); err != nil {
+		return fmt.Errorf("finish backup: %w", err)
+	}
+	return nil
+}
+
+// checkInstanceEmpty returns ErrInstanceNotEmpty if there are any sites in db or any archives in the sites directory.
+func checkInstanceEmpty(ctx context.Context, db *sqlx.DB, sitesDirectory string) error {
+	var sites int
+	if err := db.QueryRowxContext(ctx, `SELECT COUNT(*) FROM sites`).Scan(&sites); err != nil {
+		return fmt.Errorf("count sites: %w", err)
+	}
+	if sites != 0 {
+		return ErrInstanceNotEmpty
+	}
+
+	entries, err := os.ReadDir(sitesDirectory)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("read sites directory: %w", err)
+	}
+	for _, entry := range entries {
+		if filepath.Ext(entry.Name()) == ".zip" {
+			return ErrInstanceNotEmpty
+		}
+	}
+
+	return nil
+}
+
+// extractBackupFile writes r to fname, returning its size and checksum.
+func extractBackupFile(fname string, r io.Reader) (*BackupFile, error) {
+	f, err := os.OpenFile(fname, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("create file: %w", err)
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	n, err := io.Copy(io.MultiWriter(f, h), r)
+	if err != nil {
+		return nil, fmt.Errorf("write file: %w", err)
+	}
+
+	if err := f.Close(); err != nil {
+		return nil, fmt.Errorf("close file: %w", err)
+	}
+
+	return &BackupFile{Size: n, SHA256: hex.EncodeToString(h.Sum(nil))}, nil
+}
+
+// RestoreBackup checks a backup written by Backup.Write and loads it into an instance that doesn't have any sites yet.
+// Nothing is changed unless the whole backup is valid.
+func RestoreBackup(ctx context.Context, db *sqlx.DB, sitesDirectory string, r io.Reader) error {
+	if err := checkInstanceEmpty(ctx, db, sitesDirectory); err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(sitesDirectory, 0777); err != nil {
+		return fmt.Errorf("create sites directory: %w", err)
+	}
+
+	dir, err := os.MkdirTemp(sitesDirectory, restoreTempPrefix)
+	if err != nil {
+		return fmt.Errorf("create temporary directory: %w", err)
+	}
+	defer os.RemoveAll(dir)
+
+	var (
+		manifest *BackupManifest
+		found    = make(map[string]*BackupFile)
+		archives []string
+	)
+
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			return fmt.Errorf("read backup: %w", err)
+		}
+
+		if hdr.Typeflag != tar.TypeReg {
+			return fmt.Errorf("invalid backup: %s is not a regular file", hdr.Name)
+		}
+		if _, seen := found[hdr.Name]; seen || (hdr.Name == backupManifestName && manifest != nil) {
+			return fmt.Errorf("invalid backup: %s appears more than once", hdr.Name)
+		}
+
+		var fname string
+		switch {
+		case hdr.Name == backupManifestName:
+			manifest = new(BackupManifest)
+			if err := json.NewDecoder(io.LimitReader(tr, maxManifestSize)).Decode(manifest); err != nil {
+				return fmt.Errorf("invalid backup: decode manifest: %w", err)
+			}
+			continue
+		case hdr.Name == backupDatabaseName:
+			fname = filepath.Join(dir, backupDatabaseName)
+		case strings.HasPrefix(hdr.Name, backupArchiveDirectory):
+			name := strings.TrimPrefix(hdr.Name, backupArchiveDirectory)
+			if name == "" || name != filepath.Base(name) || strings.HasPrefix(name, ".") || filepath.Ext(name) != ".zip" {
+				return fmt.Errorf("invalid backup: invalid archive name %s", hdr.Name)
+			}
+			fname = filepath.Join(dir, name)
+			archives = append(archives, name)
+		default:
+			return fmt.Errorf("invalid backup: unexpected file %s", hdr.Name)
+		}
+
+		bf, err := extractBackupFile(fname, tr)
+		if err != nil {
+			return fmt.Errorf("extract %s: %w", hdr.Name, err)
+		}
+		bf.Name = hdr.Name
+		found[hdr.Name] = bf
+	}
+
+	if manifest == nil {
+		return errors.New("invalid backup: missing manifest, so the backup may be incomplete")
+	}
+	if manifest.FormatVersion != backupFormatVersion {
+		return fmt.Errorf("invalid backup: unsupported format version %d", manifest.FormatVersion)
+	}
+
+	if len(manifest.Files) != len(found) {
+		return fmt.Errorf("invalid backup: manifest lists %d files but backup contains %d", len(manifest.Files), len(found))
+	}
+	for _, mf := range manifest.Files {
+		bf, ok := found[mf.Name]
+		if !ok {
+			return fmt.Errorf("invalid backup: %s is missing", mf.Name)
+		}
+		if bf.Size != mf.Size || bf.SHA256 != mf.SHA256 {
+			return fmt.Errorf("invalid backup: %s does not match its checksum", mf.Name)
+		}
+	}
+
+	if _, ok := found[backupDatabaseName]; !ok {
+		return errors.New("invalid backup: missing database snapshot")
+	}
+
+	snapshotFname := filepath.Join(dir, backupDatabaseName)
+	if err := checkBackupArchives(ctx, snapshotFname, found); err != nil {
+		return err
+	}
+
+	if err := database.Restore(ctx, db, snapshotFname); err != nil {
+		return fmt.Errorf("restore database: %w", err)
+	}
+
+	// The archives are moved last since a database restore is far more likely to fail, and leaving them behind would
+	// stop the restore from being tried again.
+	for _, name := range archives {
+		if err := os.Rename(filepath.Join(dir, name), filepath.Join(sitesDirectory, name)); err != nil {
+			return fmt.Errorf("move archive %s into sites directory: %w", name, err)
+		}
+	}
+
+	return nil
+}
+
+// checkBackupArchives checks that every archive used by the snapshot at fname is part of the backup.
+func checkBackupArchives(ctx context.Context, fname string, found map[string]*BackupFile) error {
+	snapshot, err := database.OpenSnapshot(fname)
+	if err != nil {
+		return err
+	}
+	defer snapshot.Close()
+
+	referenced, err := referencedArchives(ctx, snapshot)
+	if err != nil {
+		return fmt.Errorf("invalid backup: %w", err)
+	}
+
+	for name := range referenced {
+		if _, ok := found[backupArchiveDirectory+name]; !ok {
+			return fmt.Errorf("invalid backup: archive %s is used by the database but isn't in the backup", name)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,528 @@
+package core
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"git.tdpain.net/codemicro/palmatum/palmatum/internal/database"
+	"go.opentelemetry.io/otel/trace"
+	"io"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+var (
+	ErrInvalidBuildCommand = newError("build command cannot be empty")
+	ErrInvalidEnvironment  = newError("invalid environment variable (expected KEY=value)")
+	ErrBuildNotFound       = newError("build not found")
+
+	environmentKeyRegexp = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+)
+
+const (
+	maxBuildLogSize = 1000 * 1000
+	buildKillDelay  = time.Second * 10
+)
+
+// buildRunner holds the state shared between build jobs.
+type buildRunner struct {
+	lock sync.Mutex
+	logs map[int]*buildLog // logs of builds that are currently running
+}
+
+// buildLog collects the output of a build. It's safe to read from while the build is still writing to it.
+type buildLog struct {
+	lock      sync.Mutex
+	buf       bytes.Buffer
+	truncated bool
+}
+
+func (l *buildLog) Write(p []byte) (int, error) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if l.truncated {
+		return len(p), nil
+	}
+
+	if remaining := maxBuildLogSize - l.buf.Len(); len(p) > remaining {
+		l.buf.Write(p[:remaining])
+		l.buf.WriteString("\n[log truncated]\n")
+		l.truncated = true
+		return len(p), nil
+	}
+
+	return l.buf.Write(p)
+}
+
+// Printf writes a message from Palmatum (as opposed to the build command) to the log.
+func (l *buildLog) Printf(format string, args ...any) {
+	_, _ = fmt.Fprintf(l, "==> "+format+"\n", args...)
+}
+
+func (l *buildLog) String() string {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.buf.String()
+}
+
+// parseBuildEnvironment parses newline-separated KEY=value pairs. Blank lines and lines starting with # are ignored.
+func parseBuildEnvironment(s string) ([]string, error) {
+	var res []string
+	for _, line := range strings.Split(s, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		key, _, found := strings.Cut(line, "=")
+		if !found || !environmentKeyRegexp.MatchString(key) {
+			return nil, ErrInvalidEnvironment
+		}
+		res = append(res, line)
+	}
+	return res, nil
+}
+
+// SetSiteBuild configures the command used to build a site, or updates an existing configuration. Once a site has a
+// build command, anything deployed to it is treated as source code and built before being served.
+func (c *Core) SetSiteBuild(conf *database.SiteBuildModel) error {
+	conf.Command = strings.TrimSpace(conf.Command)
+	if conf.Command == "" {
+		return ErrInvalidBuildCommand
+	}
+
+	conf.OutputDirectory = strings.Trim(strings.TrimSpace(conf.OutputDirectory), "/")
+	if conf.OutputDirectory != "" && (path.Clean(conf.OutputDirectory) != conf.OutputDirectory || strings.HasPrefix(conf.OutputDirectory, "..")) {
+		return ErrInvalidDirectory
+	}
+
+	env, err := parseBuildEnvironment(conf.Environment)
+	if err != nil {
+		return err
+	}
+	conf.Environment = strings.Join(env, "\n")
+
+	tx, err := c.Database.Beginx()
+	if err != nil {
+		return fmt.Errorf("begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	// Foreign keys aren't enforced, so the site has to be checked for explicitly
+	if _, err := database.GetSite(tx, conf.Site); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrInvalidSlug
+		}
+		return fmt.Errorf("get site from database: %w", err)
+	}
+
+	_, err = tx.NamedExec(`INSERT INTO site_build(site, command, output_directory, environment) VALUES (:site, :command, :output_directory, :environment)
+		ON CONFLICT (site) DO UPDATE SET command = excluded.command, output_directory = excluded.output_directory, environment = excluded.environment`, conf)
+	if err != nil {
+		return fmt.Errorf("call database: %w", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("commit transaction: %w", err)
+	}
+
+	return nil
+}
+
+func (c *Core) DisableSiteBuild(siteSlug string) error {
+	if _, err := c.Database.Exec(`DELETE FROM site_build WHERE site = ?`, siteSlug); err != nil {
+		return fmt.Errorf("call database: %w", err)
+	}
+	return nil
+}
+
+func (c *Core) buildDirectory(id int) string {
+	return path.Join(c.Config.Platform.BuildDirectory, strconv.Itoa(id))
+}
+
+// QueueBuild stores a ZIP archive of a site's source and queues it to be built. If info is nil, the source is assumed
+// to have been uploaded.
+func (c *Core) QueueBuild(ctx context.Context, siteSlug string, source io.Reader, info *DeploymentInfo) (_ *database.JobModel, err error) {
+	ctx, span := c.tracer.Start(ctx, "QueueBuild", trace.WithAttributes(siteAttribute(siteSlug)))
+	defer func() { endSpan(span, err) }()
+
+	if info == nil {
+		info = &DeploymentInfo{Source: DeploymentSourceUpload}
+	}
+
+	tx, err := c.Database.BeginTxx(ctx, nil)
+	if err != nil {
+		return nil, fmt.Errorf("begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	// Foreign keys aren't enforced, so the site has to be checked for explicitly
+	if _, err := database.GetSite(tx, siteSlug); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrInvalidSlug
+		}
+		return nil, fmt.Errorf("get site from database: %w", err)
+	}
+
+	var id int
+	err = tx.QueryRowContext(ctx, `INSERT INTO builds(site, status, source, commit_sha, created_at) VALUES (?, ?, ?, ?, ?) RETURNING id`, siteSlug, database.BuildStatusQueued, info.Source, info.CommitSHA, time.Now().Unix()).Scan(&id)
+	if err != nil {
+		return nil, fmt.Errorf("call database: %w", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("commit transaction: %w", err)
+	}
+
+	var job *database.JobModel
+	err = c.storeBuildSource(id, source)
+	if err == nil {
+		job, err = c.EnqueueJob(ctx, JobTypeBuild, &buildJob{Build: id, Site: siteSlug})
+	}
+	if err != nil {
+		c.finishBuild(id, database.BuildStatusFailed, "", err.Error())
+		_ = os.RemoveAll(c.buildDirectory(id))
+		return nil, err
+	}
+
+	return job, nil
+}
+
+func (c *Core) storeBuildSource(id int, source io.Reader) error {
+	dir := c.buildDirectory(id)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return fmt.Errorf("create build directory: %w", err)
+	}
+
+	f, err := os.Create(path.Join(dir, "source.zip"))
+	if err != nil {
+		return fmt.Errorf("create source archive: %w", err)
+	}
+	defer f.Close()
+
+	if _, err := io.Copy(f, source); err != nil {
+		return fmt.Errorf("write source archive: %w", err)
+	}
+
+	return nil
+}
+
+// GetBuild returns a build, including its log so far if it's still running.
+func (c *Core) GetBuild(id int) (*database.BuildModel, error) {
+	b, err := database.GetBuild(c.Database, id)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrBuildNotFound
+		}
+		return nil, fmt.Errorf("get build: %w", err)
+	}
+
+	if b.Status == database.BuildStatusRunning {
+		c.builds.lock.Lock()
+		if l, ok := c.builds.logs[id]; ok {
+			b.Log = l.String()
+		}
+		c.builds.lock.Unlock()
+	}
+
+	return b, nil
+}
+
+type buildJob struct {
+	Build int    `json:"build"`
+	Site  string `json:"site"`
+}
+
+func (j *buildJob) jobSite() string { return j.Site }
+
+// runBuildJob runs a queued build. If the build has already finished (for example, because Palmatum stopped after the
+// build finished but before the job did), it isn't run again.
+func (c *Core) runBuildJob(ctx context.Context, payload []byte) (string, error) {
+	var job buildJob
+	if err := json.Unmarshal(payload, &job); err != nil {
+		return "", fmt.Errorf("decode payload: %w", err)
+	}
+
+	b, err := c.GetBuild(job.Build)
+	if err != nil {
+		return "", err
+	}
+
+	result := fmt.Sprintf("build %d", b.ID)
+
+	switch b.Status {
+	case database.BuildStatusSucceeded:
+		return result, nil
+	case database.BuildStatusFailed:
+		return result, errors.New(b.Error)
+	}
+
+	b.StartedAt = time.Now().Unix()
+	if _, err := c.Database.Exec(`UPDATE builds SET status = ?, started_at = ? WHERE id = ?`, database.BuildStatusRunning, b.StartedAt, b.ID); err != nil {
+		return "", fmt.Errorf("mark build as running: %w", err)
+	}
+
+	return result, c.runBuild(ctx, b)
+}
+
+func (c *Core) finishBuild(id int, status, log, errorMessage string) {
+	if _, err := c.Database.Exec(`UPDATE builds SET status = ?, log = ?, error = ?, finished_at = ? WHERE id = ?`, status, log, errorMessage, time.Now().Unix(), id); err != nil {
+		c.Logger.Error("unable to record build result", "build", id, "error", err)
+	}
+}
+
+func (c *Core) runBuild(ctx context.Context, b *database.BuildModel) error {
+	log := new(buildLog)
+
+	c.builds.lock.Lock()
+	c.builds.logs[b.ID] = log
+	c.builds.lock.Unlock()
+
+	defer func() {
+		c.builds.lock.Lock()
+		delete(c.builds.logs, b.ID)
+		c.builds.lock.Unlock()
+	}()
+
+	c.Logger.Info("starting build", "site", b.Site, "build", b.ID)
+
+	err := c.executeBuild(ctx, b, log)
+	if ctx.Err() != nil {
+		// Palmatum is stopping, so the build will be restarted when the job is requeued
+		return err
+	}
+
+	if err != nil {
+		log.Printf("Build failed: %s", err)
+		c.Logger.Warn("build failed", "site", b.Site, "build", b.ID, "error", err)
+		c.finishBuild(b.ID, database.BuildStatusFailed, log.String(), err.Error())
+	} else {
+		log.Printf("Build succeeded")
+		c.Logger.Info("build succeeded", "site", b.Site, "build", b.ID)
+		c.finishBuild(b.ID, database.BuildStatusSucceeded, log.String(), "")
+	}
+
+	if err := os.RemoveAll(c.buildDirectory(b.ID)); err != nil {
+		c.Logger.Warn("unable to remove build directory", "build", b.ID, "error", err)
+	}
+
+	return err
+}
+
+// executeBuild extracts the source of a build into a fresh working directory, runs the site's build command in it and
+// deploys the output. The command runs with a minimal environment and its own home and temporary directories, but
+// otherwise with the same permissions as Palmatum.
+func (c *Core) executeBuild(ctx context.Context, b *database.BuildModel, log *buildLog) error {
+	conf, err := database.GetSiteBuild(c.Database, b.Site)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return errors.New("site no longer has a build command")
+		}
+		return fmt.Errorf("get build configuration: %w", err)
+	}
+
+	env, err := parseBuildEnvironment(conf.Environment)
+	if err != nil {
+		return err
+	}
+
+	var (
+		dir       = c.buildDirectory(b.ID)
+		sourceDir = path.Join(dir, "src")
+		homeDir   = path.Join(dir, "home")
+		tmpDir    = path.Join(dir, "tmp")
+	)
+
+	// The build may have been interrupted part way through by Palmatum stopping, so anything left behind is removed
+	for _, d := range []string{sourceDir, homeDir, tmpDir} {
+		if err := os.RemoveAll(d); err != nil {
+			return fmt.Errorf("clean working directory: %w", err)
+		}
+		if err := os.MkdirAll(d, 0700); err != nil {
+			return fmt.Errorf("create working directory: %w", err)
+		}
+	}
+
+	log.Printf("Extracting source")
+	if err := extractZip(path.Join(dir, "source.zip"), sourceDir); err != nil {
+		return fmt.Errorf("extract source: %w", err)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(c.Config.Platform.BuildTimeoutMinutes)*time.Minute)
+	defer cancel()
+
+	log.Printf("Running %s", conf.Command)
+
+	cmd := exec.CommandContext(ctx, "sh", "-c", conf.Command)
+	cmd.Dir = sourceDir
+	cmd.Env = append([]string{
+		"PATH=" + os.Getenv("PATH"),
+		"HOME=" + homeDir,
+		"TMPDIR=" + tmpDir,
+		"LANG=C.UTF-8",
+		"CI=true",
+		"PALMATUM_SITE=" + b.Site,
+		"PALMATUM_BUILD_ID=" + strconv.Itoa(b.ID),
+		"PALMATUM_COMMIT=" + b.CommitSHA,
+	}, env...)
+	cmd.Stdout = log
+	cmd.Stderr = log
+	// Run the command in its own process group so that anything it starts is killed along with it
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cmd.Cancel = func() error {
+		return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+	}
+	cmd.WaitDelay = buildKillDelay
+
+	if err := cmd.Run(); err != nil {
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			return fmt.Errorf("timed out after %d minutes", c.Config.Platform.BuildTimeoutMinutes)
+		}
+		return fmt.Errorf("run build command: %w", err)
+	}
+
+	outputDir := path.Join(sourceDir, conf.OutputDirectory)
+	if fi, err := os.Stat(outputDir); err != nil || !fi.IsDir() {
+		return fmt.Errorf("output directory %q does not exist", "/"+conf.OutputDirectory)
+	}
+
+	log.Printf("Packaging output")
+	outputPath := path.Join(dir, "output.zip")
+	if err := zipDirectory(outputDir, outputPath); err != nil {
+		return fmt.Errorf("package output: %w", err)
+	}
+
+	f, err := os.Open(outputPath)
+	if err != nil {
+		return fmt.Errorf("open output archive: %w", err)
+	}
+	defer f.Close()
+
+	contentPath, err := c.IngestSiteArchive(ctx, f)
+	if err != nil {
+		return fmt.Errorf("ingest output archive: %w", err)
+	}
+	defer c.releaseIngestedArchive(contentPath)
+
+	log.Printf("Deploying")
+	if err := c.deployIngestedArchive(ctx, b.Site, contentPath, &DeploymentInfo{Source: b.Source, CommitSHA: b.CommitSHA, BuildID: b.ID}); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// extractZip extracts the regular files and directories in a ZIP archive into dest. Entry names are cleaned as if they
+// were absolute so that nothing can be written outside of dest.
+func extractZip(archivePath, dest string) error {
+	zr, err := zip.OpenReader(archivePath)
+	if err != nil {
+		return err
+	}
+	defer zr.Close()
+
+	for _, zf := range zr.File {
+		name := path.Clean("/" + zf.Name)
+		if name == "/" {
+			continue
+		}
+		target := path.Join(dest, name)
+
+		if zf.FileInfo().IsDir() {
+			if err := os.MkdirAll(target, 0700); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if !zf.Mode().IsRegular() {
+			continue
+		}
+
+		if err := os.MkdirAll(path.Dir(target), 0700); err != nil {
+			return err
+		}
+
+		if err := extractZipFile(zf, target); err != nil {
+			return fmt.Errorf("extract %s: %w", zf.Name, err)
+		}
+	}
+
+	return nil
+}
+
+func extractZipFile(zf *zip.File, target string) error {
+	r, err := zf.Open()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	// Keep the executable bit so that scripts in the source can be run
+	f, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600|(zf.Mode().Perm()&0100))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = io.Copy(f, r)
+	return err
+}
+
+// zipDirectory writes the regular files in dir to a new ZIP archive at archivePath. Symlinks are skipped so that
+// nothing outside of dir can end up in the archive.
+func zipDirectory(dir, archivePath string) error {
+	f, err := os.Create(archivePath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	zw := zip.NewWriter(f)
+
+	err = filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+
+		src, err := os.Open(p)
+		if err != nil {
+			return err
+		}
+		defer src.Close()
+
+		w, err := zw.Create(filepath.ToSlash(rel))
+		if err != nil {
+			return err
+		}
+
+		_, err = io.Copy(w, src)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	return zw.Close()
+}
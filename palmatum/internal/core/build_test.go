@@ -0,0 +1,75 @@
+package core
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"git.tdpain.net/codemicro/palmatum/palmatum/internal/database"
+	"testing"
+)
+
+func TestSetSiteBuild(t *testing.T) {
+	c := newTestCore(t)
+
+	if err := c.SetSiteBuild(&database.SiteBuildModel{Site: "missing", Command: "make"}); !errors.Is(err, ErrInvalidSlug) {
+		t.Fatalf("expected ErrInvalidSlug, got %v", err)
+	}
+	if build, err := database.GetSiteBuild(c.Database, "missing"); err == nil {
+		t.Fatalf("build configured for a site that doesn't exist %+v", build)
+	}
+
+	if _, err := c.CreateSite("site"); err != nil {
+		t.Fatal(err)
+	}
+	for _, conf := range []*database.SiteBuildModel{
+		{Site: "site", Command: " "},
+		{Site: "site", Command: "make", OutputDirectory: "../out"},
+		{Site: "site", Command: "make", Environment: "1A=b"},
+	} {
+		if err := c.SetSiteBuild(conf); err == nil {
+			t.Errorf("expected an error for %+v", conf)
+		}
+	}
+
+	if err := c.SetSiteBuild(&database.SiteBuildModel{Site: "site", Command: " make ", OutputDirectory: "/public/", Environment: "# comment\nA=b\n"}); err != nil {
+		t.Fatal(err)
+	}
+	build, err := database.GetSiteBuild(c.Database, "site")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if build.Command != "make" || build.OutputDirectory != "public" || build.Environment != "A=b" {
+		t.Errorf("unexpected build configuration %+v", build)
+	}
+}
+
+func TestQueueBuild(t *testing.T) {
+	c := newTestCore(t)
+	ctx := context.Background()
+	source := mkzip(t, map[string]string{"index.html": "hello"})
+
+	if _, err := c.QueueBuild(ctx, "missing", bytes.NewReader(source), nil); !errors.Is(err, ErrInvalidSlug) {
+		t.Fatalf("expected ErrInvalidSlug, got %v", err)
+	}
+	var n int
+	if err := c.Database.Get(&n, `SELECT COUNT(*) FROM builds`); err != nil {
+		t.Fatal(err)
+	}
+	if n != 0 {
+		t.Fatalf("expected no builds, got %d", n)
+	}
+
+	if _, err := c.CreateSite("site"); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.SetSiteBuild(&database.SiteBuildModel{Site: "site", Command: "true"}); err != nil {
+		t.Fatal(err)
+	}
+	job, err := c.QueueBuild(ctx, "site", bytes.NewReader(source), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if job.Type != JobTypeBuild || job.Status != database.JobStatusQueued {
+		t.Errorf("unexpected job %+v", job)
+	}
+}
@@ -2,11 +2,17 @@ package core
 
 import (
 	"context"
+	"crypto/rand"
+	"fmt"
 	"git.tdpain.net/codemicro/palmatum/palmatum/internal/caddyController"
 	"git.tdpain.net/codemicro/palmatum/palmatum/internal/config"
+	"git.tdpain.net/codemicro/palmatum/palmatum/internal/logging"
 	"github.com/jmoiron/sqlx"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel/trace"
 	"go.uber.org/fx"
 	"log/slog"
+	"net/http"
 	"path"
 	"sync"
 )
@@ -16,27 +22,145 @@ type Core struct {
 	Database        *sqlx.DB
 	Logger          *slog.Logger
 	CaddyController *caddyController.Controller
+	Metrics         *prometheus.Registry
 
-	routeLock   sync.RWMutex
-	knownRoutes map[string][]*routeDestination
+	tracer trace.Tracer
+
+	routeLock      sync.RWMutex
+	knownRoutes    map[string][]*routeDestination
+	routeScheduler routeScheduler
+	// lastReconfigure is protected by routeLock
+	lastReconfigure reconfigureResult
 
 	handlerCacheLock sync.Mutex
 	handlerCache     map[string]*cachedHandler
+
+	sessionSecret []byte
+	oidcProviders oidcProviderCache
+
+	webhooks   webhookDispatcher
+	accessLogs accessLogSink
+	builds     buildRunner
+	jobs       jobRunner
+
+	gitDeployLock sync.Mutex
+	orphanLock    sync.Mutex
+	// ingesting is the set of archives that have been written by IngestSiteArchive but might not be referenced by the
+	// database yet. It's protected by orphanLock.
+	ingesting map[string]bool
+
+	archiveChecks archiveChecker
+	healthCache   healthCache
+
+	metrics *coreMetrics
+}
+
+func New(lc fx.Lifecycle, c *config.Config, db *sqlx.DB, logger *slog.Logger, cctrl *caddyController.Controller, tp trace.TracerProvider) (*Core, error) {
+	co, err := newCore(c, db, logger, cctrl, tp)
+	if err != nil {
+		return nil, err
+	}
+
+	workerCtx, stopWorkers := context.WithCancel(context.Background())
+
+	if c.Platform.AccessLogRetentionDays > 0 {
+		lc.Append(fx.Hook{
+			OnStart: func(context.Context) error {
+				return co.startAccessLogSink(workerCtx)
+			},
+			OnStop: func(context.Context) error {
+				return co.stopAccessLogSink()
+			},
+		})
+	}
+
+	lc.Append(fx.Hook{OnStart: func(ctx context.Context) error {
+		return co.BuildKnownRoutes(ctx)
+	}})
+
+	lc.Append(fx.Hook{
+		OnStart: func(context.Context) error {
+			go co.runWebhookWorker(workerCtx)
+			if c.Platform.OrphanCollectionIntervalMinutes > 0 {
+				go co.runOrphanCollector(workerCtx)
+			}
+
+			// The management server is started after this, so no backup can be running in this process yet
+			removed, err := removeStaleTemporaryDirectories(c.Platform.SitesDirectory)
+			if err != nil {
+				return fmt.Errorf("remove stale backup and restore directories: %w", err)
+			}
+			if len(removed) != 0 {
+				co.Logger.Info("removed directories left behind by interrupted backups or restores", "directories", removed)
+			}
+
+			if err := co.measureExistingContent(); err != nil {
+				return err
+			}
+
+			if err := co.recoverJobs(); err != nil {
+				return err
+			}
+			for range c.Platform.JobWorkers {
+				go co.runJobWorker(workerCtx, jobQueueDefault)
+			}
+			for range c.Platform.BuildWorkers {
+				go co.runJobWorker(workerCtx, jobQueueBuild)
+			}
+			return nil
+		},
+		OnStop: func(context.Context) error {
+			stopWorkers()
+			return nil
+		},
+	})
+
+	return co, nil
 }
 
-func New(lc fx.Lifecycle, c *config.Config, db *sqlx.DB, logger *slog.Logger, cctrl *caddyController.Controller) *Core {
+// newCore returns a Core whose background workers haven't been started.
+func newCore(c *config.Config, db *sqlx.DB, logger *slog.Logger, cctrl *caddyController.Controller, tp trace.TracerProvider) (*Core, error) {
 	co := &Core{
 		Config:          c,
 		Database:        db,
-		Logger:          logger,
+		Logger:          logger.With(logging.AreaKey, "core"),
 		CaddyController: cctrl,
+		tracer:          tp.Tracer(tracerName),
+		webhooks: webhookDispatcher{
+			wake:   make(chan struct{}, 1),
+			client: &http.Client{},
+		},
+		builds: buildRunner{
+			logs: make(map[int]*buildLog),
+		},
+		ingesting: make(map[string]bool),
 	}
+	co.jobs = newJobRunner(co)
+	co.Metrics = prometheus.NewRegistry()
+	co.metrics = newCoreMetrics(co.Metrics, cctrl)
 
-	lc.Append(fx.Hook{OnStart: func(ctx context.Context) error {
-		return co.BuildKnownRoutes()
-	}})
+	if c.Platform.JobWorkers < 1 {
+		return nil, fmt.Errorf("platform.jobWorkers must be at least 1")
+	}
+	if c.Platform.BuildWorkers < 1 {
+		return nil, fmt.Errorf("platform.buildWorkers must be at least 1")
+	}
+
+	if _, err := ParseRole(c.ManagementAuth.DefaultRole); err != nil {
+		return nil, fmt.Errorf("parse default management role %q: %w", c.ManagementAuth.DefaultRole, err)
+	}
+
+	if c.Platform.SessionSecret != "" {
+		co.sessionSecret = []byte(c.Platform.SessionSecret)
+	} else {
+		logger.Warn("no session secret set, generating a random one - anyone logged in with single sign-on will have to log in again when Palmatum restarts")
+		co.sessionSecret = make([]byte, 32)
+		if _, err := rand.Read(co.sessionSecret); err != nil {
+			return nil, fmt.Errorf("generate session secret: %w", err)
+		}
+	}
 
-	return co
+	return co, nil
 }
 
 func (c *Core) getPathOnDisk(p string) string {
@@ -0,0 +1,172 @@
+package core
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/json"
+	"git.tdpain.net/codemicro/palmatum/palmatum/internal/caddyController"
+	"git.tdpain.net/codemicro/palmatum/palmatum/internal/config"
+	"git.tdpain.net/codemicro/palmatum/palmatum/internal/database"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.uber.org/fx/fxtest"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeCaddy stands in for Caddy's admin API. A Caddyfile is "adapted" by wrapping it in JSON, which is all that
+// Palmatum needs to be able to compare the config that it loaded with the one that's live.
+type fakeCaddy struct {
+	mu          sync.Mutex
+	loads       [][]byte
+	live        []byte
+	failLoads   bool
+	rejectAdapt bool
+}
+
+func (fc *fakeCaddy) ServeHTTP(rw http.ResponseWriter, rq *http.Request) {
+	body, _ := io.ReadAll(rq.Body)
+
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+
+	adapted, _ := json.Marshal(map[string]string{"caddyfile": string(body)})
+
+	switch rq.URL.Path {
+	case "/load":
+		if fc.failLoads {
+			rw.WriteHeader(http.StatusBadRequest)
+			_, _ = rw.Write([]byte(`{"error":"load failed"}`))
+			return
+		}
+		fc.loads = append(fc.loads, body)
+		fc.live = adapted
+	case "/adapt":
+		if fc.rejectAdapt {
+			rw.WriteHeader(http.StatusBadRequest)
+			_, _ = rw.Write([]byte(`{"error":"invalid Caddyfile"}`))
+			return
+		}
+		_, _ = rw.Write([]byte(`{"result":` + string(adapted) + `}`))
+		return
+	case "/config/":
+		if fc.live == nil {
+			_, _ = rw.Write([]byte("null"))
+			return
+		}
+		_, _ = rw.Write(fc.live)
+		return
+	}
+
+	_, _ = rw.Write([]byte("{}"))
+}
+
+// testCore is a Core along with the fake Caddy that it's connected to and the spans that it's recorded.
+type testCore struct {
+	*Core
+	caddy *fakeCaddy
+	spans *tracetest.InMemoryExporter
+}
+
+// newTestCore returns a Core backed by a fresh database, sites directory and fake Caddy. Its workers aren't started.
+func newTestCore(t *testing.T) *testCore {
+	t.Helper()
+
+	caddy := new(fakeCaddy)
+	caddyServer := httptest.NewServer(caddy)
+	t.Cleanup(caddyServer.Close)
+
+	dir := t.TempDir()
+	conf := &config.Config{
+		Logging:  &config.Logging{},
+		Tracing:  &config.Tracing{},
+		HTTP:     &config.HTTP{},
+		Database: &config.Database{DSN: filepath.Join(dir, "palmatum.db")},
+		Platform: &config.Platform{
+			SitesDirectory:         dir,
+			BuildDirectory:         filepath.Join(dir, "builds"),
+			CaddyAdminAddress:      caddyServer.Listener.Addr().String(),
+			GitExecutablePath:      "git",
+			JobWorkers:             1,
+			BuildWorkers:           1,
+			BuildTimeoutMinutes:    1,
+			MaxUploadSizeMegabytes: 512,
+			SessionSecret:          "test session secret",
+		},
+		ManagementAuth: &config.ManagementAuth{},
+	}
+
+	spans := tracetest.NewInMemoryExporter()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSyncer(spans))
+
+	lc := fxtest.NewLifecycle(t)
+	db, err := database.New(lc, conf, tp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lc.RequireStart()
+	t.Cleanup(lc.RequireStop)
+
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	// The controller's lifecycle is never started, so it doesn't try to run Caddy
+	cctrl := caddyController.NewController(fxtest.NewLifecycle(t), logger, conf, tp)
+
+	c, err := newCore(conf, db, logger, cctrl, tp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCore{Core: c, caddy: caddy, spans: spans}
+}
+
+// mkzip returns a zip archive containing files, which maps file names to their content.
+func mkzip(t *testing.T, files map[string]string) []byte {
+	t.Helper()
+	buf := new(bytes.Buffer)
+	zw := zip.NewWriter(buf)
+	for name, content := range files {
+		w, err := zw.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Write([]byte(content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// waitJob waits for a job to finish and returns it.
+func waitJob(t *testing.T, c *testCore, id int) *database.JobModel {
+	t.Helper()
+	deadline := time.Now().Add(30 * time.Second)
+	for time.Now().Before(deadline) {
+		job, err := c.GetJob(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if job.Status == database.JobStatusSucceeded || job.Status == database.JobStatusFailed {
+			return job
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	t.Fatalf("job %d did not finish", id)
+	return nil
+}
+
+// runJobWorkers runs a worker for each job queue until the test ends.
+func runJobWorkers(t *testing.T, c *testCore) {
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	go c.runJobWorker(ctx, jobQueueDefault)
+	go c.runJobWorker(ctx, jobQueueBuild)
+}
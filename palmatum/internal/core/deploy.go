@@ -0,0 +1,130 @@
+package core
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"git.tdpain.net/codemicro/palmatum/palmatum/internal/database"
+	"go.opentelemetry.io/otel/trace"
+	"io"
+	"os"
+)
+
+// DeploySiteArchive queues a ZIP archive to be deployed to a site and returns the job that will deploy it. If the site
+// has a build command, the archive is treated as the site's source and the job builds it first.
+func (c *Core) DeploySiteArchive(ctx context.Context, siteSlug string, archive io.Reader, info *DeploymentInfo) (job *database.JobModel, err error) {
+	ctx, span := c.tracer.Start(ctx, "DeploySiteArchive", trace.WithAttributes(siteAttribute(siteSlug)))
+	defer func() { endSpan(span, err) }()
+
+	if info == nil {
+		info = &DeploymentInfo{Source: DeploymentSourceUpload}
+	}
+
+	archive = &countingReader{r: archive, counter: c.metrics.uploadBytes}
+
+	if _, err := database.GetSiteBuild(c.Database, siteSlug); err == nil {
+		return c.QueueBuild(ctx, siteSlug, archive, info)
+	} else if !errors.Is(err, sql.ErrNoRows) {
+		return nil, fmt.Errorf("get build configuration: %w", err)
+	}
+
+	contentPath, err := c.IngestSiteArchive(ctx, archive)
+	if err != nil {
+		return nil, fmt.Errorf("ingest site archive: %w", err)
+	}
+	defer c.releaseIngestedArchive(contentPath)
+
+	// This is checked again when the archive is deployed, but refusing the upload here means that the uploader finds
+	// out straight away. Invalid archives are left for the job to report.
+	if size, err := measureSiteArchive(c.getPathOnDisk(contentPath)); err == nil {
+		if err := c.checkStorageQuota(c.Database, siteSlug, size.compressed); err != nil {
+			_ = os.Remove(c.getPathOnDisk(contentPath))
+			if errors.Is(err, sql.ErrNoRows) {
+				return nil, ErrInvalidSlug
+			}
+			return nil, err
+		}
+	} else if !errors.Is(err, ErrInvalidArchive) {
+		_ = os.Remove(c.getPathOnDisk(contentPath))
+		return nil, fmt.Errorf("measure site archive: %w", err)
+	}
+
+	job, err = c.EnqueueJob(ctx, JobTypeDeploy, &deployJob{
+		Site:        siteSlug,
+		ContentPath: contentPath,
+		Source:      info.Source,
+		CommitSHA:   info.CommitSHA,
+	})
+	if err != nil {
+		_ = os.Remove(c.getPathOnDisk(contentPath))
+		return nil, err
+	}
+
+	return job, nil
+}
+
+type deployJob struct {
+	Site        string `json:"site"`
+	ContentPath string `json:"contentPath"`
+	Source      string `json:"source"`
+	CommitSHA   string `json:"commitSHA,omitempty"`
+}
+
+func (j *deployJob) jobSite() string { return j.Site }
+
+// runDeployJob checks that an ingested archive is a valid ZIP file and makes it the content of a site.
+func (c *Core) runDeployJob(ctx context.Context, payload []byte) (string, error) {
+	var job deployJob
+	if err := json.Unmarshal(payload, &job); err != nil {
+		return "", fmt.Errorf("decode payload: %w", err)
+	}
+
+	site, err := database.GetSite(c.Database, job.Site)
+	if err != nil {
+		_ = os.Remove(c.getPathOnDisk(job.ContentPath))
+		if errors.Is(err, sql.ErrNoRows) {
+			return "", ErrInvalidSlug
+		}
+		return "", fmt.Errorf("get site: %w", err)
+	}
+
+	// The job may have been interrupted after the site was updated
+	if site.ContentPath == job.ContentPath {
+		return job.ContentPath, nil
+	}
+
+	if err := c.deployIngestedArchive(ctx, job.Site, job.ContentPath, &DeploymentInfo{Source: job.Source, CommitSHA: job.CommitSHA}); err != nil {
+		return "", err
+	}
+
+	return job.ContentPath, nil
+}
+
+// deployIngestedArchive checks that an archive returned by IngestSiteArchive is a valid ZIP file that fits within the
+// site's storage quota and makes it the content of a site. If it can't be deployed, the archive is removed, unless it
+// became the site's content before the error happened.
+func (c *Core) deployIngestedArchive(ctx context.Context, siteSlug, contentPath string, info *DeploymentInfo) error {
+	// ctx is only used for tracing - once an archive has been ingested, deploying it is quick and stopping partway
+	// through would leave the archive behind.
+	ctx = context.WithoutCancel(ctx)
+
+	size, err := measureSiteArchive(c.getPathOnDisk(contentPath))
+	if err != nil {
+		_ = os.Remove(c.getPathOnDisk(contentPath))
+		return err
+	}
+
+	if err := c.updateContentPath(ctx, siteSlug, contentPath, size, info); err != nil {
+		var de *deployedError
+		if !errors.As(err, &de) {
+			_ = os.Remove(c.getPathOnDisk(contentPath))
+		}
+		return fmt.Errorf("update site: %w", err)
+	}
+
+	return nil
+}
+
+var ErrInvalidArchive = newError("invalid site archive (expected a ZIP file)")
@@ -0,0 +1,57 @@
+package core
+
+import (
+	"archive/zip"
+	"errors"
+	"fmt"
+	"git.tdpain.net/codemicro/palmatum/palmatum/internal/caddyController"
+	"io/fs"
+)
+
+const (
+	// NotFoundPageFilename is the name of the page in the root of a site bundle that will be served when a visitor
+	// requests a file that doesn't exist.
+	NotFoundPageFilename = "404.html"
+	// ServerErrorPageFilename is the name of the page in the root of a site bundle that will be served whenever any
+	// 5xx error occurs.
+	ServerErrorPageFilename = "50x.html"
+)
+
+// findErrorPages checks the site archive at contentPath for custom error pages. If there are none, nil is returned.
+func (c *Core) findErrorPages(contentPath string) (*caddyController.ErrorPages, error) {
+	zr, err := zip.OpenReader(c.getPathOnDisk(contentPath))
+	if err != nil {
+		return nil, fmt.Errorf("open site archive: %w", err)
+	}
+	defer zr.Close()
+
+	exists := func(name string) (bool, error) {
+		fi, err := fs.Stat(zr, name)
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return false, nil
+			}
+			return false, fmt.Errorf("stat %s: %w", name, err)
+		}
+		return !fi.IsDir(), nil
+	}
+
+	res := new(caddyController.ErrorPages)
+
+	if found, err := exists(NotFoundPageFilename); err != nil {
+		return nil, err
+	} else if found {
+		res.NotFound = "/" + NotFoundPageFilename
+	}
+
+	if found, err := exists(ServerErrorPageFilename); err != nil {
+		return nil, err
+	} else if found {
+		res.ServerError = "/" + ServerErrorPageFilename
+	}
+
+	if res.NotFound == "" && res.ServerError == "" {
+		return nil, nil
+	}
+	return res, nil
+}
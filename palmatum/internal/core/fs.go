@@ -1,14 +1,21 @@
 package core
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"github.com/google/uuid"
+	"go.opentelemetry.io/otel/attribute"
 	"io"
 	"os"
 )
 
-func (c *Core) IngestSiteArchive(archive io.Reader) (string, error) {
+// IngestSiteArchive writes archive to a new file in the sites directory and returns its name. The caller must call
+// releaseIngestedArchive once the archive is referenced by the database or has been removed.
+func (c *Core) IngestSiteArchive(ctx context.Context, archive io.Reader) (_ string, err error) {
+	_, span := c.tracer.Start(ctx, "IngestSiteArchive")
+	defer func() { endSpan(span, err) }()
+
 	var (
 		key             uuid.UUID
 		fname           string
@@ -21,8 +28,12 @@ func (c *Core) IngestSiteArchive(archive io.Reader) (string, error) {
 		key = uuid.New()
 		fname = fmt.Sprintf("%s.zip", key)
 
+		// This happens before the file is created so that orphan collection never sees it unprotected
+		c.protectIngestedArchive(fname)
+
 		f, err := os.OpenFile(c.getPathOnDisk(fname), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
 		if err != nil {
+			c.releaseIngestedArchive(fname)
 			if errors.Is(err, os.ErrExist) {
 				continue
 			}
@@ -32,9 +43,28 @@ func (c *Core) IngestSiteArchive(archive io.Reader) (string, error) {
 	}
 	defer destinationFile.Close()
 
-	if _, err := io.Copy(destinationFile, archive); err != nil {
+	n, err := io.Copy(destinationFile, archive)
+	span.SetAttributes(attribute.Int64("palmatum.archive.size", n))
+	if err != nil {
+		c.releaseIngestedArchive(fname)
 		return "", fmt.Errorf("copy archive to destination file %s: %w", fname, err)
 	}
 
 	return fname, nil
 }
+
+// protectIngestedArchive stops orphan collection from removing the archive fname until releaseIngestedArchive is
+// called, no matter how short the grace period is.
+func (c *Core) protectIngestedArchive(fname string) {
+	c.orphanLock.Lock()
+	defer c.orphanLock.Unlock()
+	c.ingesting[fname] = true
+}
+
+// releaseIngestedArchive lets orphan collection consider the archive fname again. It must be called once the archive
+// is referenced by the database or has been removed.
+func (c *Core) releaseIngestedArchive(fname string) {
+	c.orphanLock.Lock()
+	defer c.orphanLock.Unlock()
+	delete(c.ingesting, fname)
+}
@@ -0,0 +1,208 @@
+package core
+
+import (
+	"archive/zip"
+	"errors"
+	"fmt"
+	"git.tdpain.net/codemicro/palmatum/palmatum/internal/caddyController"
+	"github.com/jmoiron/sqlx"
+	"io/fs"
+	"os"
+	"path"
+	"slices"
+	"sync"
+	"time"
+)
+
+// ArchiveProblem describes a site that can't be served because its archive is missing or can't be opened.
+type ArchiveProblem struct {
+	Site        string `json:"site"`
+	ContentPath string `json:"contentPath"`
+	Problem     string `json:"problem"`
+}
+
+// checkArchive returns why the archive at fname can't be served, or an empty string if it can. Caddy opens archives
+// the same way, so anything that passes this won't stop Caddy from loading its config.
+func checkArchive(fname string) string {
+	zr, err := zip.OpenReader(fname)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return "archive is missing"
+		}
+		if errors.Is(err, zip.ErrFormat) {
+			return "archive is corrupt"
+		}
+		return err.Error()
+	}
+	_ = zr.Close()
+	return ""
+}
+
+// CheckSiteArchives checks the archive of every site in db that has content, returning the sites whose archives are
+// missing or corrupt.
+func CheckSiteArchives(db sqlx.Queryer, sitesDirectory string) ([]*ArchiveProblem, error) {
+	var sites []struct {
+		Slug        string `db:"slug"`
+		ContentPath string `db:"content_path"`
+	}
+	if err := sqlx.Select(db, &sites, `SELECT slug, content_path FROM sites WHERE content_path != '' ORDER BY slug`); err != nil {
+		return nil, fmt.Errorf("get sites: %w", err)
+	}
+
+	var res []*ArchiveProblem
+	for _, site := range sites {
+		if problem := checkArchive(path.Join(sitesDirectory, site.ContentPath)); problem != "" {
+			res = append(res, &ArchiveProblem{
+				Site:        site.Slug,
+				ContentPath: site.ContentPath,
+				Problem:     problem,
+			})
+		}
+	}
+
+	return res, nil
+}
+
+// quarantineDirectoryName is the directory within the sites directory that RepairSiteArchives moves archives into. It
+// isn't looked at by orphan collection, so archives in it are kept until they're removed by hand.
+const quarantineDirectoryName = "quarantine"
+
+// QuarantineDirectory returns the directory that RepairSiteArchives moves archives into.
+func QuarantineDirectory(sitesDirectory string) string {
+	return path.Join(sitesDirectory, quarantineDirectoryName)
+}
+
+// RepairSiteArchives removes the content of each site in problems, so that the database no longer refers to archives
+// that can't be served. Archives that are still on disk are moved into the quarantine directory rather than left to be
+// collected as orphans, so that they can be inspected or recovered. Sites are only changed if their content hasn't been
+// replaced since they were checked.
+func RepairSiteArchives(db *sqlx.DB, sitesDirectory string, problems []*ArchiveProblem) error {
+	for _, p := range problems {
+		if err := repairSiteArchive(db, sitesDirectory, p); err != nil {
+			return fmt.Errorf("repair site %s: %w", p.Site, err)
+		}
+	}
+	return nil
+}
+
+func repairSiteArchive(db *sqlx.DB, sitesDirectory string, p *ArchiveProblem) error {
+	tx, err := db.Beginx()
+	if err != nil {
+		return fmt.Errorf("begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec(`UPDATE sites SET content_path = '', content_size = 0, content_uncompressed_size = 0 WHERE slug = ? AND content_path = ?`, p.Site, p.ContentPath)
+	if err != nil {
+		return fmt.Errorf("remove content: %w", err)
+	}
+
+	if n, err := res.RowsAffected(); err != nil {
+		return fmt.Errorf("get number of affected rows: %w", err)
+	} else if n == 0 {
+		return nil
+	}
+
+	quarantine := QuarantineDirectory(sitesDirectory)
+	if err := os.MkdirAll(quarantine, 0777); err != nil {
+		return fmt.Errorf("create quarantine directory: %w", err)
+	}
+
+	if err := os.Rename(path.Join(sitesDirectory, p.ContentPath), path.Join(quarantine, p.ContentPath)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("quarantine archive: %w", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("commit transaction: %w", err)
+	}
+
+	return nil
+}
+
+// archiveChecker remembers the result of checking each archive so that it's only opened again if it changes.
+type archiveChecker struct {
+	lock    sync.Mutex
+	results map[string]*archiveCheck
+
+	// problems are the problems found by the most recent rebuild of the routing table
+	problems []*ArchiveProblem
+}
+
+type archiveCheck struct {
+	size    int64
+	modTime time.Time
+	problem string
+}
+
+// checkArchive returns why the archive at contentPath can't be served, or an empty string if it can.
+func (c *Core) checkArchive(contentPath string) string {
+	fname := c.getPathOnDisk(contentPath)
+
+	fi, err := os.Stat(fname)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return "archive is missing"
+		}
+		return err.Error()
+	}
+
+	ac := &c.archiveChecks
+	ac.lock.Lock()
+	defer ac.lock.Unlock()
+
+	if res, found := ac.results[contentPath]; found && res.size == fi.Size() && res.modTime.Equal(fi.ModTime()) {
+		return res.problem
+	}
+
+	if ac.results == nil {
+		ac.results = make(map[string]*archiveCheck)
+	}
+	res := &archiveCheck{size: fi.Size(), modTime: fi.ModTime(), problem: checkArchive(fname)}
+	ac.results[contentPath] = res
+	return res.problem
+}
+
+// setArchiveProblems records the problems found when the routing table kr was built, logging any new ones.
+func (c *Core) setArchiveProblems(kr caddyController.RouteSpec, problems []*ArchiveProblem) {
+	ac := &c.archiveChecks
+	ac.lock.Lock()
+	defer ac.lock.Unlock()
+
+	for _, p := range problems {
+		if !slices.ContainsFunc(ac.problems, func(q *ArchiveProblem) bool { return *p == *q }) {
+			c.Logger.Error("site archive can't be served, excluding site from routing", "site", p.Site, "path", c.getPathOnDisk(p.ContentPath), "problem", p.Problem)
+		}
+	}
+	for _, q := range ac.problems {
+		if !slices.ContainsFunc(problems, func(p *ArchiveProblem) bool { return p.Site == q.Site }) {
+			c.Logger.Info("site archive problem resolved", "site", q.Site)
+		}
+	}
+
+	ac.problems = problems
+
+	// Results for archives that aren't used any more would otherwise be kept forever
+	inUse := make(map[string]bool)
+	for _, destinations := range kr {
+		for _, d := range destinations {
+			inUse[d.ContentPath] = true
+		}
+	}
+	for _, p := range problems {
+		inUse[p.ContentPath] = true
+	}
+	for contentPath := range ac.results {
+		if !inUse[contentPath] {
+			delete(ac.results, contentPath)
+		}
+	}
+}
+
+// ArchiveProblems returns the sites that were excluded from routing the last time the routing table was rebuilt
+// because their archives are missing or corrupt.
+func (c *Core) ArchiveProblems() []*ArchiveProblem {
+	ac := &c.archiveChecks
+	ac.lock.Lock()
+	defer ac.lock.Unlock()
+	return slices.Clone(ac.problems)
+}
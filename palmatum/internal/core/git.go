@@ -0,0 +1,397 @@
+package core
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"git.tdpain.net/codemicro/palmatum/palmatum/internal/database"
+	"github.com/mattn/go-sqlite3"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"path"
+	"regexp"
+	"strings"
+	"time"
+)
+
+var (
+	ErrInvalidRepository    = newError("invalid repository URL")
+	ErrInvalidBranch        = newError("invalid branch name")
+	ErrInvalidDirectory     = newError("invalid directory")
+	ErrGitNotEnabled        = newError("site is not linked to a Git repository")
+	ErrInvalidSignature     = newError("invalid webhook signature")
+	ErrUnsupportedGitSource = newError("unsupported webhook source (expected GitHub, Gitea or GitLab)")
+	ErrInvalidPushPayload   = newError("invalid push payload")
+	ErrGitArchiveTooLarge   = newError("archive of commit is larger than the maximum upload size")
+
+	branchValidationRegexp = regexp.MustCompile(`^[\w\-./]+$`)
+	commitSHARegexp        = regexp.MustCompile(`^[0-9a-f]{40}([0-9a-f]{24})?$`)
+)
+
+// GitPush is a push to a repository that's been received from a webhook.
+type GitPush struct {
+	Provider  string
+	Branch    string
+	CommitSHA string
+}
+
+// SetSiteGit links a site to a branch of a Git repository, or updates an existing link. If the webhook secret is
+// empty, the existing secret is kept, or a random secret is generated if there isn't one.
+func (c *Core) SetSiteGit(conf *database.SiteGitModel) error {
+	conf.Repository = strings.TrimSpace(conf.Repository)
+	// Anything starting with a dash could be interpreted as an option, and transport helpers (eg. ext::) can run
+	// arbitrary commands.
+	if conf.Repository == "" || strings.HasPrefix(conf.Repository, "-") || strings.Contains(conf.Repository, "::") {
+		return ErrInvalidRepository
+	}
+
+	conf.Branch = strings.TrimSpace(conf.Branch)
+	if conf.Branch == "" {
+		conf.Branch = "main"
+	}
+	if !branchValidationRegexp.MatchString(conf.Branch) || strings.HasPrefix(conf.Branch, "-") || strings.Contains(conf.Branch, "..") {
+		return ErrInvalidBranch
+	}
+
+	conf.Directory = strings.Trim(strings.TrimSpace(conf.Directory), "/")
+	if conf.Directory != "" {
+		if strings.HasPrefix(conf.Directory, "-") || path.Clean(conf.Directory) != conf.Directory || strings.HasPrefix(conf.Directory, "..") {
+			return ErrInvalidDirectory
+		}
+	}
+
+	tx, err := c.Database.Beginx()
+	if err != nil {
+		return fmt.Errorf("begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	// Foreign keys aren't enforced, so the site has to be checked for explicitly
+	if _, err := database.GetSite(tx, conf.Site); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrInvalidSlug
+		}
+		return fmt.Errorf("get site from database: %w", err)
+	}
+
+	if conf.WebhookSecret == "" {
+		existing, err := database.GetSiteGit(tx, conf.Site)
+		if err == nil {
+			conf.WebhookSecret = existing.WebhookSecret
+		} else if errors.Is(err, sql.ErrNoRows) {
+			b := make([]byte, 24)
+			if _, err := rand.Read(b); err != nil {
+				return fmt.Errorf("generate webhook secret: %w", err)
+			}
+			conf.WebhookSecret = hex.EncodeToString(b)
+		} else {
+			return fmt.Errorf("get existing Git configuration: %w", err)
+		}
+	}
+
+	_, err = tx.NamedExec(`INSERT INTO site_git(site, repository, branch, directory, webhook_secret) VALUES (:site, :repository, :branch, :directory, :webhook_secret)
+		ON CONFLICT (site) DO UPDATE SET repository = excluded.repository, branch = excluded.branch, directory = excluded.directory, webhook_secret = excluded.webhook_secret`, conf)
+	if err != nil {
+		var e sqlite3.Error
+		if errors.As(err, &e) && e.ExtendedCode == sqlite3.ErrConstraintForeignKey {
+			return ErrInvalidSlug
+		}
+		return fmt.Errorf("call database: %w", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("commit transaction: %w", err)
+	}
+
+	return nil
+}
+
+func (c *Core) DisableSiteGit(siteSlug string) error {
+	if _, err := c.Database.Exec(`DELETE FROM site_git WHERE site = ?`, siteSlug); err != nil {
+		return fmt.Errorf("call database: %w", err)
+	}
+	return nil
+}
+
+// ParseGitPush verifies a push webhook from GitHub, Gitea or GitLab against the secret for the given site and returns
+// the push it describes. If the webhook is valid but isn't a push to a branch (for example, a ping or a branch being
+// deleted), nil is returned.
+func (c *Core) ParseGitPush(siteSlug string, header http.Header, body []byte) (*GitPush, error) {
+	conf, err := database.GetSiteGit(c.Database, siteSlug)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrGitNotEnabled
+		}
+		return nil, fmt.Errorf("get Git configuration: %w", err)
+	}
+
+	mac := hmac.New(sha256.New, []byte(conf.WebhookSecret))
+	mac.Write(body)
+	expectedSignature := hex.EncodeToString(mac.Sum(nil))
+
+	var (
+		provider string
+		isPush   bool
+		valid    bool
+	)
+
+	// Gitea also sends GitHub's headers, so it must be checked for first
+	switch {
+	case header.Get("X-Gitea-Event") != "":
+		provider = "gitea"
+		isPush = header.Get("X-Gitea-Event") == "push"
+		valid = hmac.Equal([]byte(header.Get("X-Gitea-Signature")), []byte(expectedSignature))
+	case header.Get("X-GitHub-Event") != "":
+		provider = "github"
+		isPush = header.Get("X-GitHub-Event") == "push"
+		valid = hmac.Equal([]byte(header.Get("X-Hub-Signature-256")), []byte("sha256="+expectedSignature))
+	case header.Get("X-Gitlab-Event") != "":
+		provider = "gitlab"
+		isPush = header.Get("X-Gitlab-Event") == "Push Hook"
+		valid = hmac.Equal([]byte(header.Get("X-Gitlab-Token")), []byte(conf.WebhookSecret))
+	default:
+		return nil, ErrUnsupportedGitSource
+	}
+
+	if !valid {
+		return nil, ErrInvalidSignature
+	}
+
+	if !isPush {
+		return nil, nil
+	}
+
+	var payload struct {
+		Ref   string `json:"ref"`
+		After string `json:"after"`
+	}
+	if err := json.Unmarshal(body, &payload); err != nil {
+		return nil, ErrInvalidPushPayload
+	}
+
+	branch, isBranch := strings.CutPrefix(payload.Ref, "refs/heads/")
+	if !isBranch || strings.Trim(payload.After, "0") == "" {
+		return nil, nil
+	}
+
+	if !commitSHARegexp.MatchString(payload.After) {
+		return nil, ErrInvalidPushPayload
+	}
+
+	return &GitPush{
+		Provider:  provider,
+		Branch:    branch,
+		CommitSHA: payload.After,
+	}, nil
+}
+
+const gitDeployTimeout = time.Minute * 10
+
+// QueueGitDeploy queues a job to deploy a commit from the repository linked to a site. If commitSHA is empty, the
+// latest commit on the linked branch is deployed.
+func (c *Core) QueueGitDeploy(ctx context.Context, siteSlug, commitSHA string) (*database.JobModel, error) {
+	if _, err := database.GetSiteGit(c.Database, siteSlug); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrGitNotEnabled
+		}
+		return nil, fmt.Errorf("get Git configuration: %w", err)
+	}
+
+	return c.EnqueueJob(ctx, JobTypeGitDeploy, &gitDeployJob{Site: siteSlug, CommitSHA: commitSHA})
+}
+
+type gitDeployJob struct {
+	Site      string `json:"site"`
+	CommitSHA string `json:"commitSHA,omitempty"`
+}
+
+func (j *gitDeployJob) jobSite() string { return j.Site }
+
+func (c *Core) runGitDeployJob(ctx context.Context, payload []byte) (string, error) {
+	var job gitDeployJob
+	if err := json.Unmarshal(payload, &job); err != nil {
+		return "", fmt.Errorf("decode payload: %w", err)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, gitDeployTimeout)
+	defer cancel()
+
+	return c.DeployFromGit(ctx, job.Site, job.CommitSHA)
+}
+
+// DeployFromGit fetches a commit from the repository linked to a site and deploys it, or queues it to be built if the
+// site has a build command. If commitSHA is empty, the latest commit on the linked branch is used. The SHA of the
+// fetched commit is returned.
+func (c *Core) DeployFromGit(ctx context.Context, siteSlug, commitSHA string) (string, error) {
+	conf, err := database.GetSiteGit(c.Database, siteSlug)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return "", ErrGitNotEnabled
+		}
+		return "", fmt.Errorf("get Git configuration: %w", err)
+	}
+
+	c.gitDeployLock.Lock()
+	defer c.gitDeployLock.Unlock()
+
+	dir, err := os.MkdirTemp("", "palmatum-git-")
+	if err != nil {
+		return "", fmt.Errorf("create temporary directory: %w", err)
+	}
+	defer os.RemoveAll(dir)
+
+	sha, err := c.fetchGitCommit(ctx, dir, conf, commitSHA)
+	if err != nil {
+		return "", err
+	}
+
+	treeish := sha
+	if conf.Directory != "" {
+		treeish += ":" + conf.Directory
+	}
+
+	archivePath := path.Join(dir, "site.zip")
+	if err := c.archiveGitCommit(ctx, dir, treeish, archivePath); err != nil {
+		return "", err
+	}
+
+	f, err := os.Open(archivePath)
+	if err != nil {
+		return "", fmt.Errorf("open archive: %w", err)
+	}
+	defer f.Close()
+
+	info := &DeploymentInfo{Source: DeploymentSourceGit, CommitSHA: sha}
+
+	if _, err := database.GetSiteBuild(c.Database, siteSlug); err == nil {
+		if _, err := c.QueueBuild(ctx, siteSlug, f, info); err != nil {
+			return "", fmt.Errorf("queue build: %w", err)
+		}
+		return sha, nil
+	} else if !errors.Is(err, sql.ErrNoRows) {
+		return "", fmt.Errorf("get build configuration: %w", err)
+	}
+
+	contentPath, err := c.IngestSiteArchive(ctx, f)
+	if err != nil {
+		return "", fmt.Errorf("ingest site archive: %w", err)
+	}
+	defer c.releaseIngestedArchive(contentPath)
+
+	if err := c.deployIngestedArchive(ctx, siteSlug, contentPath, info); err != nil {
+		return "", err
+	}
+
+	return sha, nil
+}
+
+// fetchGitCommit fetches a single commit into a new bare repository in dir and returns its SHA.
+func (c *Core) fetchGitCommit(ctx context.Context, dir string, conf *database.SiteGitModel, commitSHA string) (string, error) {
+	if _, err := c.runGit(ctx, dir, "init", "--bare", "-q"); err != nil {
+		return "", fmt.Errorf("initialise repository: %w", err)
+	}
+
+	branchRef := "refs/heads/" + conf.Branch
+
+	var err error
+	if commitSHA != "" {
+		_, err = c.runGit(ctx, dir, "fetch", "-q", "--depth", "1", "--", conf.Repository, commitSHA)
+		if err != nil {
+			// Not every server allows fetching a commit by its SHA, so fall back to fetching the whole branch
+			c.Logger.Debug("unable to fetch commit directly, falling back to branch", "site", conf.Site, "commit", commitSHA, "error", err)
+		}
+	}
+	if commitSHA == "" || err != nil {
+		if _, err := c.runGit(ctx, dir, "fetch", "-q", "--depth", "1", "--", conf.Repository, branchRef); err != nil {
+			return "", fmt.Errorf("fetch branch: %w", err)
+		}
+	}
+
+	sha, err := c.runGit(ctx, dir, "rev-parse", "FETCH_HEAD^{commit}")
+	if err != nil {
+		return "", fmt.Errorf("resolve fetched commit: %w", err)
+	}
+
+	if commitSHA != "" && sha != commitSHA {
+		c.Logger.Warn("fetched commit differs from pushed commit, deploying fetched commit", "site", conf.Site, "pushed", commitSHA, "fetched", sha)
+	}
+
+	return sha, nil
+}
+
+// archiveGitCommit writes a ZIP archive of treeish to fname. Git has no way to limit the size of an archive, so it's
+// stopped once the archive is larger than the largest one that could have been uploaded instead.
+func (c *Core) archiveGitCommit(ctx context.Context, dir, treeish, fname string) error {
+	f, err := os.Create(fname)
+	if err != nil {
+		return fmt.Errorf("create archive: %w", err)
+	}
+	defer f.Close()
+
+	w := &limitedWriter{w: f, remaining: 1000 * 1000 * int64(c.Config.Platform.MaxUploadSizeMegabytes)}
+	if err := c.runGitTo(ctx, dir, w, "archive", "--format=zip", treeish); err != nil {
+		if w.exceeded {
+			return fmt.Errorf("%w (%dMB)", ErrGitArchiveTooLarge, c.Config.Platform.MaxUploadSizeMegabytes)
+		}
+		return fmt.Errorf("archive commit: %w", err)
+	}
+
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("close archive: %w", err)
+	}
+	return nil
+}
+
+// limitedWriter writes to w until more than remaining bytes have been written to it, after which it fails.
+type limitedWriter struct {
+	w         io.Writer
+	remaining int64
+	exceeded  bool
+}
+
+func (lw *limitedWriter) Write(p []byte) (int, error) {
+	if int64(len(p)) > lw.remaining {
+		lw.exceeded = true
+		return 0, errors.New("size limit exceeded")
+	}
+	lw.remaining -= int64(len(p))
+	return lw.w.Write(p)
+}
+
+func (c *Core) runGit(ctx context.Context, dir string, args ...string) (string, error) {
+	var stdout bytes.Buffer
+	if err := c.runGitTo(ctx, dir, &stdout, args...); err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(stdout.String()), nil
+}
+
+// runGitTo runs Git in dir, writing its output to stdout.
+func (c *Core) runGitTo(ctx context.Context, dir string, stdout io.Writer, args ...string) (err error) {
+	// Only the subcommand is recorded, since the other arguments may include credentials
+	ctx, span := c.tracer.Start(ctx, "git "+args[0])
+	defer func() { endSpan(span, err) }()
+
+	cmd := exec.CommandContext(ctx, c.Config.Platform.GitExecutablePath, args...)
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(), "GIT_TERMINAL_PROMPT=0")
+
+	var stderr bytes.Buffer
+	cmd.Stdout = stdout
+	cmd.Stderr = &stderr
+
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("%w: %s", err, strings.TrimSpace(stderr.String()))
+	}
+
+	return nil
+}
@@ -0,0 +1,340 @@
+package core
+
+import (
+	"archive/zip"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"git.tdpain.net/codemicro/palmatum/palmatum/internal/database"
+	"net/http"
+	"net/http/cgi"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// testRepository is a bare Git repository with a working copy that commits are pushed from.
+type testRepository struct {
+	bare string
+	work string
+}
+
+func newTestRepository(t *testing.T) *testRepository {
+	dir := t.TempDir()
+	r := &testRepository{
+		bare: filepath.Join(dir, "site.git"),
+		work: filepath.Join(dir, "work"),
+	}
+	runTestGit(t, dir, "init", "-q", "--bare", r.bare)
+	runTestGit(t, dir, "init", "-q", r.work)
+	return r
+}
+
+// commit writes files to the working copy, commits them and pushes them to the main branch. The SHA of the commit is
+// returned.
+func (r *testRepository) commit(t *testing.T, files map[string]string) string {
+	for name, content := range files {
+		fname := filepath.Join(r.work, name)
+		if err := os.MkdirAll(filepath.Dir(fname), 0777); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(fname, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	runTestGit(t, r.work, "add", "-A")
+	runTestGit(t, r.work, "commit", "-q", "-m", "update site")
+	runTestGit(t, r.work, "push", "-q", r.bare, "HEAD:refs/heads/main")
+	return runTestGit(t, r.work, "rev-parse", "HEAD")
+}
+
+// serveHTTP serves the repository with Git's smart HTTP protocol and returns its URL.
+func (r *testRepository) serveHTTP(t *testing.T) string {
+	gitPath, err := exec.LookPath("git")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(&cgi.Handler{
+		Path: gitPath,
+		Args: []string{"http-backend"},
+		Env:  []string{"GIT_PROJECT_ROOT=" + filepath.Dir(r.bare), "GIT_HTTP_EXPORT_ALL=1"},
+	})
+	t.Cleanup(srv.Close)
+	return srv.URL + "/" + filepath.Base(r.bare)
+}
+
+func runTestGit(t *testing.T, dir string, args ...string) string {
+	t.Helper()
+	cmd := exec.Command("git", append([]string{"-c", "user.name=Palmatum", "-c", "user.email=palmatum@example.com", "-c", "init.defaultBranch=main"}, args...)...)
+	cmd.Dir = dir
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("git %s: %v: %s", strings.Join(args, " "), err, out)
+	}
+	return strings.TrimSpace(string(out))
+}
+
+// deployedFiles returns the names of the files in the archive that a site is serving.
+func deployedFiles(t *testing.T, c *testCore, siteSlug string) []string {
+	t.Helper()
+	site, err := database.GetSite(c.Database, siteSlug)
+	if err != nil {
+		t.Fatal(err)
+	}
+	zr, err := zip.OpenReader(c.getPathOnDisk(site.ContentPath))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer zr.Close()
+
+	var names []string
+	for _, f := range zr.File {
+		if !strings.HasSuffix(f.Name, "/") {
+			names = append(names, f.Name)
+		}
+	}
+	slices.Sort(names)
+	return names
+}
+
+func TestSetSiteGit(t *testing.T) {
+	c := newTestCore(t)
+	if _, err := c.CreateSite("site"); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, conf := range []*database.SiteGitModel{
+		{Site: "site", Repository: "ext::sh -c touch% /tmp/pwned"},
+		{Site: "site", Repository: "--upload-pack=touch /tmp/pwned"},
+		{Site: "site", Repository: ""},
+	} {
+		if err := c.SetSiteGit(conf); !errors.Is(err, ErrInvalidRepository) {
+			t.Errorf("%q: expected ErrInvalidRepository, got %v", conf.Repository, err)
+		}
+	}
+	for _, branch := range []string{"-main", "a..b", "a b"} {
+		if err := c.SetSiteGit(&database.SiteGitModel{Site: "site", Repository: "https://example.com/site.git", Branch: branch}); !errors.Is(err, ErrInvalidBranch) {
+			t.Errorf("%q: expected ErrInvalidBranch, got %v", branch, err)
+		}
+	}
+	for _, dir := range []string{"../public", "a/../../b", "-public"} {
+		if err := c.SetSiteGit(&database.SiteGitModel{Site: "site", Repository: "https://example.com/site.git", Directory: dir}); !errors.Is(err, ErrInvalidDirectory) {
+			t.Errorf("%q: expected ErrInvalidDirectory, got %v", dir, err)
+		}
+	}
+	if err := c.SetSiteGit(&database.SiteGitModel{Site: "missing", Repository: "https://example.com/site.git"}); !errors.Is(err, ErrInvalidSlug) {
+		t.Errorf("expected ErrInvalidSlug, got %v", err)
+	}
+
+	if err := c.SetSiteGit(&database.SiteGitModel{Site: "site", Repository: " https://example.com/site.git ", Directory: "/public/"}); err != nil {
+		t.Fatal(err)
+	}
+	conf, err := database.GetSiteGit(c.Database, "site")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if conf.Repository != "https://example.com/site.git" || conf.Branch != "main" || conf.Directory != "public" || len(conf.WebhookSecret) != 48 {
+		t.Fatalf("unexpected configuration %+v", conf)
+	}
+
+	// The webhook secret is kept when the configuration is updated
+	if err := c.SetSiteGit(&database.SiteGitModel{Site: "site", Repository: "https://example.com/site.git", Branch: "release"}); err != nil {
+		t.Fatal(err)
+	}
+	updated, err := database.GetSiteGit(c.Database, "site")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if updated.Branch != "release" || updated.WebhookSecret != conf.WebhookSecret {
+		t.Fatalf("unexpected configuration after update %+v", updated)
+	}
+}
+
+func TestParseGitPush(t *testing.T) {
+	c := newTestCore(t)
+	if _, err := c.CreateSite("site"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.ParseGitPush("site", http.Header{}, nil); !errors.Is(err, ErrGitNotEnabled) {
+		t.Fatalf("expected ErrGitNotEnabled, got %v", err)
+	}
+	if err := c.SetSiteGit(&database.SiteGitModel{Site: "site", Repository: "https://example.com/site.git", WebhookSecret: "secret"}); err != nil {
+		t.Fatal(err)
+	}
+
+	const sha = "0123456789abcdef0123456789abcdef01234567"
+	body := []byte(`{"ref":"refs/heads/main","after":"` + sha + `"}`)
+	mac := hmac.New(sha256.New, []byte("secret"))
+	mac.Write(body)
+	signature := hex.EncodeToString(mac.Sum(nil))
+
+	for provider, header := range map[string]http.Header{
+		"github": {"X-Github-Event": {"push"}, "X-Hub-Signature-256": {"sha256=" + signature}},
+		"gitea":  {"X-Gitea-Event": {"push"}, "X-Github-Event": {"push"}, "X-Gitea-Signature": {signature}},
+		"gitlab": {"X-Gitlab-Event": {"Push Hook"}, "X-Gitlab-Token": {"secret"}},
+	} {
+		push, err := c.ParseGitPush("site", header, body)
+		if err != nil {
+			t.Errorf("%s: %v", provider, err)
+			continue
+		}
+		if push == nil || push.Provider != provider || push.Branch != "main" || push.CommitSHA != sha {
+			t.Errorf("%s: unexpected push %+v", provider, push)
+		}
+	}
+
+	if _, err := c.ParseGitPush("site", http.Header{"X-Github-Event": {"push"}, "X-Hub-Signature-256": {"sha256=" + strings.Repeat("0", 64)}}, body); !errors.Is(err, ErrInvalidSignature) {
+		t.Errorf("expected ErrInvalidSignature, got %v", err)
+	}
+	if _, err := c.ParseGitPush("site", http.Header{"X-Gitlab-Event": {"Push Hook"}, "X-Gitlab-Token": {"wrong"}}, body); !errors.Is(err, ErrInvalidSignature) {
+		t.Errorf("expected ErrInvalidSignature, got %v", err)
+	}
+	if _, err := c.ParseGitPush("site", http.Header{"X-Bitbucket-Event": {"push"}}, body); !errors.Is(err, ErrUnsupportedGitSource) {
+		t.Errorf("expected ErrUnsupportedGitSource, got %v", err)
+	}
+
+	// Valid webhooks that aren't pushes to a branch are ignored
+	if push, err := c.ParseGitPush("site", http.Header{"X-Gitlab-Event": {"Tag Push Hook"}, "X-Gitlab-Token": {"secret"}}, body); err != nil || push != nil {
+		t.Errorf("expected tag push to be ignored, got %+v, %v", push, err)
+	}
+	deleted := []byte(`{"ref":"refs/heads/main","after":"` + strings.Repeat("0", 40) + `"}`)
+	if push, err := c.ParseGitPush("site", http.Header{"X-Gitlab-Event": {"Push Hook"}, "X-Gitlab-Token": {"secret"}}, deleted); err != nil || push != nil {
+		t.Errorf("expected branch deletion to be ignored, got %+v, %v", push, err)
+	}
+}
+
+func TestGitDeploy(t *testing.T) {
+	c := newTestCore(t)
+	ctx := context.Background()
+	repo := newTestRepository(t)
+
+	first := repo.commit(t, map[string]string{"public/index.html": "one", "README.md": "not deployed"})
+	second := repo.commit(t, map[string]string{"public/about.html": "two"})
+
+	if _, err := c.CreateSite("site"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.DeployFromGit(ctx, "site", ""); !errors.Is(err, ErrGitNotEnabled) {
+		t.Fatalf("expected ErrGitNotEnabled, got %v", err)
+	}
+	if err := c.SetSiteGit(&database.SiteGitModel{Site: "site", Repository: "file://" + repo.bare, Directory: "public"}); err != nil {
+		t.Fatal(err)
+	}
+
+	sha, err := c.DeployFromGit(ctx, "site", first)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sha != first {
+		t.Fatalf("expected %s to be deployed, got %s", first, sha)
+	}
+	if files := deployedFiles(t, c, "site"); !slices.Equal(files, []string{"index.html"}) {
+		t.Fatalf("unexpected files %v", files)
+	}
+
+	// With no commit, the end of the branch is deployed
+	sha, err = c.DeployFromGit(ctx, "site", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sha != second {
+		t.Fatalf("expected %s to be deployed, got %s", second, sha)
+	}
+	if files := deployedFiles(t, c, "site"); !slices.Equal(files, []string{"about.html", "index.html"}) {
+		t.Fatalf("unexpected files %v", files)
+	}
+
+	deployments, err := database.GetDeployments(c.Database, "site", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(deployments) != 2 || deployments[0].Source != DeploymentSourceGit || deployments[0].CommitSHA != second || deployments[1].CommitSHA != first {
+		t.Fatalf("unexpected deployments %+v", deployments)
+	}
+
+	t.Run("queued", func(t *testing.T) {
+		runJobWorkers(t, c)
+
+		// An earlier commit can be deployed again through the job queue
+		job, err := c.QueueGitDeploy(ctx, "site", first)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if job = waitJob(t, c, job.ID); job.Status != database.JobStatusSucceeded {
+			t.Fatalf("deploy failed: %s", job.Result)
+		}
+		if files := deployedFiles(t, c, "site"); !slices.Equal(files, []string{"index.html"}) {
+			t.Fatalf("unexpected files after deploying %s again %v", first, files)
+		}
+
+		latest, err := database.GetDeployments(c.Database, "site", 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if latest[0].Source != DeploymentSourceGit || latest[0].CommitSHA != first {
+			t.Fatalf("unexpected deployment %+v", latest[0])
+		}
+	})
+}
+
+func TestGitDeployOverHTTP(t *testing.T) {
+	c := newTestCore(t)
+	repo := newTestRepository(t)
+	sha := repo.commit(t, map[string]string{"index.html": "hello"})
+
+	if _, err := c.CreateSite("site"); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.SetSiteGit(&database.SiteGitModel{Site: "site", Repository: repo.serveHTTP(t)}); err != nil {
+		t.Fatal(err)
+	}
+
+	deployed, err := c.DeployFromGit(context.Background(), "site", sha)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if deployed != sha {
+		t.Fatalf("expected %s to be deployed, got %s", sha, deployed)
+	}
+	if files := deployedFiles(t, c, "site"); !slices.Equal(files, []string{"index.html"}) {
+		t.Fatalf("unexpected files %v", files)
+	}
+}
+
+func TestGitDeployTooLarge(t *testing.T) {
+	c := newTestCore(t)
+	repo := newTestRepository(t)
+	// Random content doesn't compress, so the archive is about as large as the file
+	content := make([]byte, 3_000_000)
+	if _, err := rand.Read(content); err != nil {
+		t.Fatal(err)
+	}
+	repo.commit(t, map[string]string{"index.html": string(content)})
+
+	if _, err := c.CreateSite("site"); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.SetSiteGit(&database.SiteGitModel{Site: "site", Repository: "file://" + repo.bare}); err != nil {
+		t.Fatal(err)
+	}
+
+	c.Config.Platform.MaxUploadSizeMegabytes = 1
+	if _, err := c.DeployFromGit(context.Background(), "site", ""); !errors.Is(err, ErrGitArchiveTooLarge) {
+		t.Fatalf("expected ErrGitArchiveTooLarge, got %v", err)
+	}
+	if site, err := database.GetSite(c.Database, "site"); err != nil || site.ContentPath != "" {
+		t.Fatalf("site was deployed to: %+v, %v", site, err)
+	}
+
+	c.Config.Platform.MaxUploadSizeMegabytes = 10
+	if _, err := c.DeployFromGit(context.Background(), "site", ""); err != nil {
+		t.Fatal(err)
+	}
+}
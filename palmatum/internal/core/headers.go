@@ -0,0 +1,139 @@
+package core
+
+import (
+	"archive/zip"
+	"bufio"
+	"database/sql"
+	"errors"
+	"fmt"
+	"git.tdpain.net/codemicro/palmatum/palmatum/internal/caddyController"
+	"git.tdpain.net/codemicro/palmatum/palmatum/internal/database"
+	"io"
+	"io/fs"
+	"regexp"
+	"strings"
+)
+
+// HeadersFilename is the name of the file in the root of a site bundle that custom response headers are read from.
+//
+// The format is the same as that used by Netlify and Cloudflare Pages - a path glob on its own line, followed by a
+// number of indented "Name: value" lines that apply to that glob. Lines starting with a # are ignored.
+//
+//	/assets/*
+//	  Cache-Control: public, max-age=31536000
+//	/*
+//	  X-Frame-Options: DENY
+const HeadersFilename = "_headers"
+
+// headerNameValidationRegexp matches the characters allowed in a header name, except that a name can't start with a -
+// or + because Caddy's header directive would treat those as deleting or appending to the header instead.
+var headerNameValidationRegexp = regexp.MustCompile("^[!#$%&'*.^_`|~0-9A-Za-z][!#$%&'*+\\-.^_`|~0-9A-Za-z]*$")
+
+// containsPlaceholder reports whether s contains a brace, which Caddy would expand as a placeholder. This would let a
+// site read environment variables or files from the server, such as {env.SECRET} or {file./etc/passwd}.
+func containsPlaceholder(s string) bool {
+	return strings.ContainsAny(s, "{}")
+}
+
+func parseHeadersFile(r io.Reader) ([]*caddyController.HeaderRule, error) {
+	var (
+		rules   []*caddyController.HeaderRule
+		current *caddyController.HeaderRule
+		lineNo  int
+	)
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		lineNo += 1
+		line := scanner.Text()
+		trimmed := strings.TrimSpace(line)
+
+		if trimmed == "" || trimmed[0] == '#' {
+			continue
+		}
+
+		if line[0] != ' ' && line[0] != '\t' {
+			if trimmed[0] != '/' {
+				return nil, fmt.Errorf("line %d: path %q must start with /", lineNo, trimmed)
+			}
+			if containsPlaceholder(trimmed) {
+				return nil, fmt.Errorf("line %d: path %q cannot contain { or }", lineNo, trimmed)
+			}
+			current = &caddyController.HeaderRule{Path: trimmed}
+			rules = append(rules, current)
+			continue
+		}
+
+		if current == nil {
+			return nil, fmt.Errorf("line %d: header defined before any path", lineNo)
+		}
+
+		name, value, found := strings.Cut(trimmed, ":")
+		if !found {
+			return nil, fmt.Errorf("line %d: header must be in the form \"Name: value\"", lineNo)
+		}
+
+		name = strings.TrimSpace(name)
+		if !headerNameValidationRegexp.MatchString(name) {
+			return nil, fmt.Errorf("line %d: invalid header name %q", lineNo, name)
+		}
+
+		value = strings.TrimSpace(value)
+		if containsPlaceholder(value) {
+			return nil, fmt.Errorf("line %d: value of header %s cannot contain { or }", lineNo, name)
+		}
+
+		current.Headers = append(current.Headers, &caddyController.HeaderField{
+			Name:  name,
+			Value: value,
+		})
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return rules, nil
+}
+
+// readHeadersFile reads the headers file from the site archive at contentPath. If there is no headers file, nil is
+// returned.
+func (c *Core) readHeadersFile(contentPath string) ([]*caddyController.HeaderRule, error) {
+	zr, err := zip.OpenReader(c.getPathOnDisk(contentPath))
+	if err != nil {
+		return nil, fmt.Errorf("open site archive: %w", err)
+	}
+	defer zr.Close()
+
+	f, err := zr.Open(HeadersFilename)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("open %s: %w", HeadersFilename, err)
+	}
+	defer f.Close()
+
+	rules, err := parseHeadersFile(f)
+	if err != nil {
+		return nil, fmt.Errorf("parse %s: %w", HeadersFilename, err)
+	}
+	return rules, nil
+}
+
+// GetSiteHeaders returns the custom header rules that are in effect for the given site.
+func (c *Core) GetSiteHeaders(siteSlug string) ([]*caddyController.HeaderRule, error) {
+	site, err := database.GetSite(c.Database, siteSlug)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrInvalidSlug
+		}
+		return nil, fmt.Errorf("get site from database: %w", err)
+	}
+
+	if site.ContentPath == "" {
+		return nil, nil
+	}
+
+	return c.readHeadersFile(site.ContentPath)
+}
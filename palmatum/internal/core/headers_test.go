@@ -0,0 +1,80 @@
+package core
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestParseHeadersFile(t *testing.T) {
+	rules, err := parseHeadersFile(strings.NewReader("# comment\n/assets/*\n  Cache-Control: public, max-age=31536000\n\n/*\n\tX-Frame-Options: DENY\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rules) != 2 || rules[0].Path != "/assets/*" || rules[1].Path != "/*" {
+		t.Fatalf("unexpected rules %+v", rules)
+	}
+	if h := rules[0].Headers; len(h) != 1 || h[0].Name != "Cache-Control" || h[0].Value != "public, max-age=31536000" {
+		t.Errorf("unexpected headers %+v", h)
+	}
+
+	for name, file := range map[string]string{
+		"no path":              "  X-Frame-Options: DENY\n",
+		"relative path":        "assets/*\n  X-Frame-Options: DENY\n",
+		"no colon":             "/*\n  X-Frame-Options DENY\n",
+		"delete header":        "/*\n  -Server: x\n",
+		"placeholder in value": "/*\n  X-Secret: {env.SECRET}\n",
+		"file placeholder":     "/*\n  X-Passwd: {file./etc/passwd}\n",
+		"placeholder in path":  "/{http.request.host}/*\n  X-Frame-Options: DENY\n",
+		"placeholder in name":  "/*\n  {env.SECRET}: x\n",
+		"unbalanced brace":     "/*\n  X-Thing: a}b\n",
+	} {
+		t.Run(name, func(t *testing.T) {
+			if rules, err := parseHeadersFile(strings.NewReader(file)); err == nil {
+				t.Errorf("expected an error, got %+v", rules)
+			}
+		})
+	}
+}
+
+func TestHeadersPlaceholdersNotLoaded(t *testing.T) {
+	c := newTestCore(t)
+	ctx := context.Background()
+
+	if _, err := c.CreateSite("site"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.CreateRoute("site", "example.com", "/"); err != nil {
+		t.Fatal(err)
+	}
+
+	archive := mkzip(t, map[string]string{
+		"index.html":    "hello",
+		HeadersFilename: "/*\n  X-Secret: {env.SECRET}\n",
+	})
+	contentPath, err := c.IngestSiteArchive(ctx, bytes.NewReader(archive))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.releaseIngestedArchive(contentPath)
+	if err := c.UpdateContentPath(ctx, "site", contentPath, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.WaitForRoutes(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := c.GetSiteHeaders("site"); err == nil {
+		t.Error("expected headers file with a placeholder to be rejected")
+	}
+
+	c.caddy.mu.Lock()
+	defer c.caddy.mu.Unlock()
+	if len(c.caddy.loads) == 0 {
+		t.Fatal("no config was loaded")
+	}
+	if last := string(c.caddy.loads[len(c.caddy.loads)-1]); strings.Contains(last, "env.SECRET") {
+		t.Errorf("placeholder was loaded into Caddy:\n%s", last)
+	}
+}
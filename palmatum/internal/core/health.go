@@ -0,0 +1,258 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path/filepath"
+	"runtime/debug"
+	"sync"
+	"time"
+)
+
+// reconfigureResult records the outcome of the most recent attempt to load the routing table into Caddy.
+type reconfigureResult struct {
+	at  time.Time
+	err error
+}
+
+// RouteHealth describes whether the routes that Caddy is serving match the database.
+type RouteHealth struct {
+	// Drift is set if Caddy's live config differs from the config built from the database.
+	Drift bool `json:"drift"`
+	// Pending is set if there are changes that haven't been applied yet, in which case some drift is expected.
+	Pending bool `json:"pending"`
+	// LastError is the error from the most recent attempt to apply changes, if it failed.
+	LastError   string `json:"lastError,omitempty"`
+	LastRebuild int64  `json:"lastRebuild,omitempty"`
+}
+
+// Healthy reports whether Caddy is serving what's in the database, or is about to be.
+func (h *RouteHealth) Healthy() bool {
+	return h.LastError == "" && (!h.Drift || h.Pending)
+}
+
+// CheckRouteHealth compares the config Caddy is running with the config built from the database.
+func (c *Core) CheckRouteHealth(ctx context.Context) (*RouteHealth, error) {
+	res := new(RouteHealth)
+
+	c.routeScheduler.lock.Lock()
+	res.Pending = c.routeScheduler.requested > c.routeScheduler.attempted
+	c.routeScheduler.lock.Unlock()
+
+	// Hold the route lock so a rebuild can't happen between reading the database and reading Caddy's config. Rebuilds
+	// take the lock exclusively, so checks can still run alongside each other.
+	c.routeLock.RLock()
+	defer c.routeLock.RUnlock()
+
+	if c.lastReconfigure.err != nil {
+		res.LastError = c.lastReconfigure.err.Error()
+	}
+	if !c.lastReconfigure.at.IsZero() {
+		res.LastRebuild = c.lastReconfigure.at.Unix()
+	}
+
+	kr, _, err := c.buildRouteSpec(c.Database)
+	if err != nil {
+		return nil, err
+	}
+
+	if res.Drift, err = c.CaddyController.Drift(ctx, kr); err != nil {
+		return nil, fmt.Errorf("check Caddy config: %w", err)
+	}
+
+	if res.Drift && !res.Pending {
+		c.Logger.Warn("live Caddy config differs from database")
+	}
+
+	return res, nil
+}
+
+const (
+	routeHealthCacheTTL = time.Second * 10
+	diskUsageCacheTTL   = time.Minute
+)
+
+// healthCache holds the results of the checks that are too expensive to run every time one of the unauthenticated
+// monitoring endpoints is requested.
+type healthCache struct {
+	lock sync.Mutex
+
+	routes    *RouteHealth
+	routesErr error
+	routesAt  time.Time
+
+	diskUsage   int64
+	diskUsageAt time.Time
+}
+
+// cachedRouteHealth is CheckRouteHealth, but reuses a recent result. Concurrent callers wait for a single check rather
+// than each running their own.
+func (c *Core) cachedRouteHealth(ctx context.Context) (*RouteHealth, error) {
+	hc := &c.healthCache
+	hc.lock.Lock()
+	defer hc.lock.Unlock()
+
+	if !hc.routesAt.IsZero() && time.Since(hc.routesAt) < routeHealthCacheTTL {
+		return hc.routes, hc.routesErr
+	}
+
+	routes, err := c.CheckRouteHealth(ctx)
+	// A check that was cut short by the caller says nothing about the routes, so it shouldn't be reused
+	if ctx.Err() == nil {
+		hc.routes, hc.routesErr, hc.routesAt = routes, err, time.Now()
+	}
+	return routes, err
+}
+
+// HealthCheck is the result of checking each of the things Palmatum depends on. Each check is empty if it passed, or
+// describes why it failed.
+type HealthCheck struct {
+	Database    string `json:"database"`
+	Caddy       string `json:"caddy"`
+	Reconfigure string `json:"reconfigure"`
+	// Routes is only checked when checking readiness.
+	Routes string `json:"routes,omitempty"`
+}
+
+func (h *HealthCheck) Healthy() bool {
+	return h.Database == "" && h.Caddy == "" && h.Reconfigure == "" && h.Routes == ""
+}
+
+// CheckHealth checks that the database and Caddy's admin API can be reached, and that the routing table was last
+// loaded into Caddy successfully. If ready is set, it also checks that Caddy is serving the routes in the database.
+//
+// The result is shown to unauthenticated callers, so it only describes what failed. The errors themselves are logged.
+func (c *Core) CheckHealth(ctx context.Context, ready bool) *HealthCheck {
+	res := new(HealthCheck)
+
+	if err := c.Database.PingContext(ctx); err != nil {
+		c.Logger.Warn("health check: database unreachable", "error", err)
+		res.Database = "database unreachable"
+	}
+
+	if err := c.CaddyController.Ping(ctx); err != nil {
+		c.Logger.Warn("health check: Caddy admin API unreachable", "error", err)
+		res.Caddy = "Caddy admin API unreachable"
+	}
+
+	c.routeLock.RLock()
+	last := c.lastReconfigure
+	c.routeLock.RUnlock()
+
+	if last.at.IsZero() {
+		res.Reconfigure = "routes have not been loaded yet"
+	} else if last.err != nil {
+		res.Reconfigure = "last attempt to load routes failed"
+	}
+
+	if ready {
+		if routes, err := c.cachedRouteHealth(ctx); err != nil {
+			c.Logger.Warn("health check: unable to check routes", "error", err)
+			res.Routes = "unable to check routes"
+		} else if !routes.Healthy() {
+			res.Routes = "live Caddy config differs from database"
+		}
+	}
+
+	return res
+}
+
+// Status is a summary of the state of a Palmatum instance.
+type Status struct {
+	Version   string            `json:"version"`
+	GoVersion string            `json:"goVersion"`
+	Build     map[string]string `json:"build,omitempty"`
+
+	CaddyPID    int   `json:"caddyPID"`
+	CaddyUptime int64 `json:"caddyUptimeSeconds"`
+
+	Sites  int `json:"sites"`
+	Routes int `json:"routes"`
+	// DiskUsage is the total size in bytes of the files in the sites directory.
+	DiskUsage int64 `json:"diskUsageBytes"`
+	// BrokenSites are the slugs of the sites that aren't being served because their archives are missing or corrupt.
+	BrokenSites []string `json:"brokenSites"`
+}
+
+// GetStatus summarises the state of the instance. The disk usage is only recalculated once every diskUsageCacheTTL.
+func (c *Core) GetStatus(ctx context.Context) (*Status, error) {
+	res := &Status{
+		Version:     "unknown",
+		CaddyPID:    c.CaddyController.PID(),
+		BrokenSites: []string{},
+	}
+
+	for _, p := range c.ArchiveProblems() {
+		res.BrokenSites = append(res.BrokenSites, p.Site)
+	}
+
+	if info, ok := debug.ReadBuildInfo(); ok {
+		res.Version = info.Main.Version
+		res.GoVersion = info.GoVersion
+		res.Build = make(map[string]string)
+		for _, setting := range info.Settings {
+			switch setting.Key {
+			case "vcs.revision", "vcs.time", "vcs.modified", "GOOS", "GOARCH":
+				res.Build[setting.Key] = setting.Value
+			}
+		}
+	}
+
+	if startedAt := c.CaddyController.StartedAt(); !startedAt.IsZero() {
+		res.CaddyUptime = int64(time.Since(startedAt).Seconds())
+	}
+
+	if err := c.Database.QueryRowxContext(ctx, `SELECT (SELECT COUNT(*) FROM sites), (SELECT COUNT(*) FROM routes)`).Scan(&res.Sites, &res.Routes); err != nil {
+		return nil, fmt.Errorf("count sites and routes: %w", err)
+	}
+
+	diskUsage, err := c.cachedDiskUsage()
+	if err != nil {
+		return nil, err
+	}
+	res.DiskUsage = diskUsage
+
+	return res, nil
+}
+
+// cachedDiskUsage returns the total size of the files in the sites directory, reusing a recent result.
+func (c *Core) cachedDiskUsage() (int64, error) {
+	hc := &c.healthCache
+	hc.lock.Lock()
+	defer hc.lock.Unlock()
+
+	if !hc.diskUsageAt.IsZero() && time.Since(hc.diskUsageAt) < diskUsageCacheTTL {
+		return hc.diskUsage, nil
+	}
+
+	var total int64
+	err := filepath.WalkDir(c.Config.Platform.SitesDirectory, func(_ string, d fs.DirEntry, err error) error {
+		if err != nil {
+			// Files can be removed while walking the directory
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		total += info.Size()
+		return nil
+	})
+	if err != nil {
+		return 0, fmt.Errorf("get disk usage: %w", err)
+	}
+
+	hc.diskUsage, hc.diskUsageAt = total, time.Now()
+	return total, nil
+}
@@ -0,0 +1,251 @@
+package core
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"git.tdpain.net/codemicro/palmatum/palmatum/internal/database"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+	"time"
+)
+
+var ErrJobNotFound = newError("job not found")
+
+const (
+	JobTypeDeploy      = "deploy"
+	JobTypeGitDeploy   = "git-deploy"
+	JobTypeBuild       = "build"
+	JobTypeReconfigure = "reconfigure"
+	// JobTypeCollectOrphans removes archives that aren't used by any site.
+	JobTypeCollectOrphans = "collect-orphans"
+)
+
+const (
+	jobQueueDefault = "default"
+	// Builds have their own queue so that a long build can't hold up deployments.
+	jobQueueBuild = "build"
+
+	jobPollInterval = time.Second * 30
+	// jobMaxAttempts is the number of times a job is started before it's given up on. Jobs are only retried if they
+	// were interrupted by Palmatum stopping.
+	jobMaxAttempts = 3
+)
+
+// jobHandler runs a job with the given payload, returning a short description of the result.
+type jobHandler func(ctx context.Context, payload []byte) (string, error)
+
+// sitePayload is implemented by the payloads of jobs that change a site. Jobs for the same site are run one at a time
+// in the order that they were queued, even if they're in different queues, so that an older deployment can never
+// replace a newer one.
+type sitePayload interface {
+	jobSite() string
+}
+
+// jobRunner holds the state shared between job workers.
+type jobRunner struct {
+	wake     map[string]chan struct{}
+	handlers map[string]jobHandler
+}
+
+func newJobRunner(c *Core) jobRunner {
+	return jobRunner{
+		wake: map[string]chan struct{}{
+			jobQueueDefault: make(chan struct{}, max(c.Config.Platform.JobWorkers, 1)),
+			jobQueueBuild:   make(chan struct{}, max(c.Config.Platform.BuildWorkers, 1)),
+		},
+		handlers: map[string]jobHandler{
+			JobTypeDeploy:         c.runDeployJob,
+			JobTypeGitDeploy:      c.runGitDeployJob,
+			JobTypeBuild:          c.runBuildJob,
+			JobTypeReconfigure:    c.runReconfigureJob,
+			JobTypeCollectOrphans: c.runCollectOrphansJob,
+		},
+	}
+}
+
+func jobQueue(jobType string) string {
+	if jobType == JobTypeBuild {
+		return jobQueueBuild
+	}
+	return jobQueueDefault
+}
+
+// EnqueueJob queues a job to be run in the background. payload is encoded as JSON and passed to the job's handler. If
+// ctx is part of a trace, the job is added to it.
+func (c *Core) EnqueueJob(ctx context.Context, jobType string, payload any) (*database.JobModel, error) {
+	if _, ok := c.jobs.handlers[jobType]; !ok {
+		return nil, fmt.Errorf("unknown job type %q", jobType)
+	}
+
+	encodedPayload, err := json.Marshal(payload)
+	if err != nil {
+		return nil, fmt.Errorf("encode payload: %w", err)
+	}
+
+	job := &database.JobModel{
+		Type:      jobType,
+		Queue:     jobQueue(jobType),
+		Payload:   string(encodedPayload),
+		Status:    database.JobStatusQueued,
+		CreatedAt: time.Now().Unix(),
+	}
+
+	if sp, ok := payload.(sitePayload); ok {
+		job.Site = sp.jobSite()
+	}
+
+	carrier := propagation.MapCarrier{}
+	propagation.TraceContext{}.Inject(ctx, carrier)
+	job.TraceParent = carrier.Get("traceparent")
+
+	if err := c.Database.QueryRowxContext(ctx, `INSERT INTO jobs(type, queue, site, payload, status, created_at, trace_parent) VALUES (?, ?, ?, ?, ?, ?, ?) RETURNING id`, job.Type, job.Queue, job.Site, job.Payload, job.Status, job.CreatedAt, job.TraceParent).Scan(&job.ID); err != nil {
+		return nil, fmt.Errorf("call database: %w", err)
+	}
+
+	select {
+	case c.jobs.wake[job.Queue] <- struct{}{}:
+	default:
+	}
+
+	return job, nil
+}
+
+func (c *Core) GetJob(id int) (*database.JobModel, error) {
+	job, err := database.GetJob(c.Database, id)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrJobNotFound
+		}
+		return nil, fmt.Errorf("get job: %w", err)
+	}
+	return job, nil
+}
+
+// recoverJobs requeues jobs that were running when Palmatum last stopped, unless they've already been tried too many
+// times.
+func (c *Core) recoverJobs() error {
+	if _, err := c.Database.Exec(`UPDATE jobs SET status = ?, error = ?, finished_at = ? WHERE status = ? AND attempts >= ?`, database.JobStatusFailed, "interrupted by Palmatum stopping too many times", time.Now().Unix(), database.JobStatusRunning, jobMaxAttempts); err != nil {
+		return fmt.Errorf("fail interrupted jobs: %w", err)
+	}
+
+	res, err := c.Database.Exec(`UPDATE jobs SET status = ? WHERE status = ?`, database.JobStatusQueued, database.JobStatusRunning)
+	if err != nil {
+		return fmt.Errorf("requeue interrupted jobs: %w", err)
+	}
+
+	if n, err := res.RowsAffected(); err == nil && n != 0 {
+		c.Logger.Info("requeued interrupted jobs", "count", n)
+	}
+
+	return nil
+}
+
+// runJobWorker runs jobs from the given queue one at a time until ctx is cancelled.
+func (c *Core) runJobWorker(ctx context.Context, queue string) {
+	ticker := time.NewTicker(jobPollInterval)
+	defer ticker.Stop()
+
+	for {
+		for ctx.Err() == nil {
+			job, err := c.claimJob(queue)
+			if err != nil {
+				c.Logger.Error("unable to get queued job", "error", err, "queue", queue)
+				break
+			}
+			if job == nil {
+				break
+			}
+			c.runJob(ctx, job)
+
+			if job.Site != "" {
+				// The next job for the site might be waiting in another queue
+				c.wakeJobWorkers()
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-c.jobs.wake[queue]:
+		}
+	}
+}
+
+// wakeJobWorkers makes every idle job worker check its queue.
+func (c *Core) wakeJobWorkers() {
+	for _, wake := range c.jobs.wake {
+		select {
+		case wake <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// claimJob marks the oldest queued job in a queue as running and returns it, or returns nil if there's nothing that can
+// be run. Jobs for a site are skipped while an earlier job for the same site is running or waiting to run.
+func (c *Core) claimJob(queue string) (*database.JobModel, error) {
+	job := new(database.JobModel)
+	err := c.Database.QueryRowx(`UPDATE jobs SET status = ?, attempts = attempts + 1, started_at = ? WHERE id = (SELECT id FROM jobs j WHERE status = ? AND queue = ? AND (site = '' OR NOT EXISTS (SELECT 1 FROM jobs e WHERE e.site = j.site AND e.id < j.id AND e.status IN (?, ?))) ORDER BY id LIMIT 1) RETURNING *`, database.JobStatusRunning, time.Now().Unix(), database.JobStatusQueued, queue, database.JobStatusQueued, database.JobStatusRunning).StructScan(job)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return job, nil
+}
+
+func (c *Core) runJob(ctx context.Context, job *database.JobModel) {
+	c.Logger.Debug("starting job", "job", job.ID, "type", job.Type)
+
+	ctx = propagation.TraceContext{}.Extract(ctx, propagation.MapCarrier{"traceparent": job.TraceParent})
+	ctx, span := c.tracer.Start(ctx, "job "+job.Type, trace.WithAttributes(
+		attribute.Int("palmatum.job.id", job.ID),
+		attribute.Int("palmatum.job.attempt", job.Attempts),
+	))
+
+	start := time.Now()
+	result, err := c.jobs.handlers[job.Type](ctx, []byte(job.Payload))
+	endSpan(span, err)
+	if ctx.Err() != nil {
+		// Palmatum is stopping - leave the job as running so that it's requeued on the next start
+		return
+	}
+
+	job.Status = database.JobStatusSucceeded
+	job.Result = result
+	job.Error = ""
+	if err != nil {
+		job.Status = database.JobStatusFailed
+		job.Error = err.Error()
+		c.Logger.Warn("job failed", "job", job.ID, "type", job.Type, "error", err)
+	}
+	job.FinishedAt = time.Now().Unix()
+
+	c.metrics.jobs.WithLabelValues(job.Type, job.Status).Inc()
+	c.metrics.jobDuration.WithLabelValues(job.Type).Observe(time.Since(start).Seconds())
+
+	if _, err := c.Database.NamedExec(`UPDATE jobs SET status = :status, result = :result, error = :error, finished_at = :finished_at WHERE id = :id`, job); err != nil {
+		c.Logger.Error("unable to record job result", "job", job.ID, "error", err)
+	}
+}
+
+type reconfigureJob struct{}
+
+// runReconfigureJob rebuilds the routing table and reloads Caddy's configuration.
+func (c *Core) runReconfigureJob(ctx context.Context, _ []byte) (string, error) {
+	if err := c.BuildKnownRoutes(ctx); err != nil {
+		return "", fmt.Errorf("rebuild known routes: %w", err)
+	}
+	return "", nil
+}
+
+// QueueReconfigure queues a job to reload Caddy's configuration from the database.
+func (c *Core) QueueReconfigure(ctx context.Context) (*database.JobModel, error) {
+	return c.EnqueueJob(ctx, JobTypeReconfigure, reconfigureJob{})
+}
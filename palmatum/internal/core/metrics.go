@@ -0,0 +1,94 @@
+package core
+
+import (
+	"git.tdpain.net/codemicro/palmatum/palmatum/internal/caddyController"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"io"
+)
+
+type coreMetrics struct {
+	jobs                *prometheus.CounterVec
+	jobDuration         *prometheus.HistogramVec
+	deployments         *prometheus.CounterVec
+	reconfigureDuration prometheus.Histogram
+	reconfigureFailures prometheus.Counter
+	uploadBytes         prometheus.Counter
+}
+
+func newCoreMetrics(reg prometheus.Registerer, cctrl *caddyController.Controller) *coreMetrics {
+	m := &coreMetrics{
+		jobs: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "palmatum",
+			Name:      "jobs_total",
+			Help:      "Number of background jobs that have finished, by type (eg. deploy, build) and status.",
+		}, []string{"type", "status"}),
+		jobDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: "palmatum",
+			Name:      "job_duration_seconds",
+			Help:      "Time taken to run background jobs.",
+			Buckets:   []float64{0.1, 0.5, 1, 5, 15, 30, 60, 120, 300, 600, 900},
+		}, []string{"type"}),
+		deployments: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "palmatum",
+			Name:      "deployments_total",
+			Help:      "Number of successful deployments, by source.",
+		}, []string{"source"}),
+		reconfigureDuration: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: "palmatum",
+			Name:      "caddy_reconfigure_duration_seconds",
+			Help:      "Time taken to rebuild the routing table and load it into Caddy.",
+			Buckets:   prometheus.DefBuckets,
+		}),
+		reconfigureFailures: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: "palmatum",
+			Name:      "caddy_reconfigure_failures_total",
+			Help:      "Number of times the routing table couldn't be loaded into Caddy.",
+		}),
+		uploadBytes: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: "palmatum",
+			Name:      "upload_bytes_total",
+			Help:      "Number of bytes of site archives uploaded.",
+		}),
+	}
+
+	reg.MustRegister(
+		m.jobs,
+		m.jobDuration,
+		m.deployments,
+		m.reconfigureDuration,
+		m.reconfigureFailures,
+		m.uploadBytes,
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: "palmatum",
+			Name:      "caddy_start_time_seconds",
+			Help:      "Time that the Caddy server was last started, in seconds since the Unix epoch.",
+		}, func() float64 {
+			if t := cctrl.StartedAt(); !t.IsZero() {
+				return float64(t.Unix())
+			}
+			return 0
+		}),
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+
+	return m
+}
+
+// MetricsGatherer returns a gatherer that collects Palmatum's own metrics and the per-site metrics from Caddy.
+func (c *Core) MetricsGatherer() prometheus.Gatherer {
+	return prometheus.Gatherers{c.Metrics, c.CaddyController}
+}
+
+// countingReader counts the bytes read through it into a metric.
+type countingReader struct {
+	r       io.Reader
+	counter prometheus.Counter
+}
+
+func (cr *countingReader) Read(p []byte) (int, error) {
+	n, err := cr.r.Read(p)
+	cr.counter.Add(float64(n))
+	return n, err
+}
@@ -0,0 +1,173 @@
+package core
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"git.tdpain.net/codemicro/palmatum/palmatum/internal/database"
+	"github.com/jmoiron/sqlx"
+	"go.opentelemetry.io/otel/attribute"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// maxOrphansListed is the number of removed archives that are named in the result of a collection job.
+const maxOrphansListed = 20
+
+// OrphanedArchive is an archive in the sites directory that wasn't used by any site.
+type OrphanedArchive struct {
+	Name       string `json:"name"`
+	Size       int64  `json:"size"`
+	ModifiedAt int64  `json:"modifiedAt"`
+}
+
+// referencedArchives returns the names of every archive in the sites directory that's in use according to db, either
+// as the content of a site or by a deployment that's waiting to happen.
+//
+// The archives of earlier deployments are removed when they're replaced, so deployment history doesn't count as a
+// reference - if one of those is still on disk, it's because removing it failed.
+func referencedArchives(ctx context.Context, db sqlx.QueryerContext) (map[string]bool, error) {
+	var contentPaths []string
+	if err := sqlx.SelectContext(ctx, db, &contentPaths, `SELECT content_path FROM sites WHERE content_path != ''`); err != nil {
+		return nil, fmt.Errorf("get site content paths: %w", err)
+	}
+
+	var payloads []string
+	if err := sqlx.SelectContext(ctx, db, &payloads, `SELECT payload FROM jobs WHERE type = ? AND status IN (?, ?)`, JobTypeDeploy, database.JobStatusQueued, database.JobStatusRunning); err != nil {
+		return nil, fmt.Errorf("get pending deployments: %w", err)
+	}
+
+	for _, payload := range payloads {
+		var job deployJob
+		if err := json.Unmarshal([]byte(payload), &job); err != nil {
+			return nil, fmt.Errorf("decode deployment job payload: %w", err)
+		}
+		contentPaths = append(contentPaths, job.ContentPath)
+	}
+
+	res := make(map[string]bool, len(contentPaths))
+	for _, p := range contentPaths {
+		res[p] = true
+	}
+	return res, nil
+}
+
+// CollectOrphanedArchives removes archives from the sites directory that aren't used by any site and haven't been
+// modified for the grace period. Archives are written before they're referenced by the database, so ones that are
+// still being ingested are skipped regardless of the grace period.
+func (c *Core) CollectOrphanedArchives(ctx context.Context) (removed []*OrphanedArchive, err error) {
+	ctx, span := c.tracer.Start(ctx, "CollectOrphanedArchives")
+	defer func() {
+		span.SetAttributes(attribute.Int("palmatum.orphans.removed", len(removed)))
+		endSpan(span, err)
+	}()
+
+	// Only one collection runs at a time so that two can't try to remove the same archive
+	c.orphanLock.Lock()
+	defer c.orphanLock.Unlock()
+
+	referenced, err := referencedArchives(ctx, c.Database)
+	if err != nil {
+		return nil, err
+	}
+
+	entries, err := os.ReadDir(c.Config.Platform.SitesDirectory)
+	if err != nil {
+		return nil, fmt.Errorf("read sites directory: %w", err)
+	}
+
+	cutoff := time.Now().Add(-time.Duration(c.Config.Platform.OrphanGracePeriodMinutes) * time.Minute)
+
+	for _, entry := range entries {
+		if !entry.Type().IsRegular() || filepath.Ext(entry.Name()) != ".zip" || referenced[entry.Name()] || c.ingesting[entry.Name()] {
+			continue
+		}
+
+		info, err := entry.Info()
+		if err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				continue
+			}
+			return removed, fmt.Errorf("stat %s: %w", entry.Name(), err)
+		}
+
+		if info.ModTime().After(cutoff) {
+			continue
+		}
+
+		if err := os.Remove(c.getPathOnDisk(entry.Name())); err != nil {
+			c.Logger.Warn("unable to remove orphaned archive", "error", err, "path", c.getPathOnDisk(entry.Name()))
+			continue
+		}
+
+		c.Logger.Info("removed orphaned archive", "name", entry.Name(), "size", info.Size(), "modifiedAt", info.ModTime())
+		removed = append(removed, &OrphanedArchive{
+			Name:       entry.Name(),
+			Size:       info.Size(),
+			ModifiedAt: info.ModTime().Unix(),
+		})
+	}
+
+	return removed, nil
+}
+
+// describeOrphans summarises the archives removed by CollectOrphanedArchives.
+func describeOrphans(removed []*OrphanedArchive) string {
+	if len(removed) == 0 {
+		return "no orphaned archives found"
+	}
+
+	var (
+		size  int64
+		names []string
+	)
+	for i, o := range removed {
+		size += o.Size
+		if i < maxOrphansListed {
+			names = append(names, o.Name)
+		}
+	}
+	if n := len(removed) - maxOrphansListed; n > 0 {
+		names = append(names, fmt.Sprintf("and %d more", n))
+	}
+
+	return fmt.Sprintf("removed %d orphaned archives (%d bytes): %s", len(removed), size, strings.Join(names, ", "))
+}
+
+type collectOrphansJob struct{}
+
+func (c *Core) runCollectOrphansJob(ctx context.Context, _ []byte) (string, error) {
+	removed, err := c.CollectOrphanedArchives(ctx)
+	if err != nil {
+		return "", err
+	}
+	return describeOrphans(removed), nil
+}
+
+// QueueOrphanCollection queues a job to remove orphaned archives from the sites directory. The job's result lists the
+// archives that were removed.
+func (c *Core) QueueOrphanCollection(ctx context.Context) (*database.JobModel, error) {
+	return c.EnqueueJob(ctx, JobTypeCollectOrphans, collectOrphansJob{})
+}
+
+// runOrphanCollector removes orphaned archives every collection interval until ctx is cancelled.
+func (c *Core) runOrphanCollector(ctx context.Context) {
+	ticker := time.NewTicker(time.Duration(c.Config.Platform.OrphanCollectionIntervalMinutes) * time.Minute)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		// Each archive that's removed is logged as it goes
+		if _, err := c.CollectOrphanedArchives(ctx); err != nil {
+			c.Logger.Error("unable to collect orphaned archives", "error", err)
+		}
+	}
+}
@@ -0,0 +1,146 @@
+package core
+
+import (
+	"context"
+	"go.opentelemetry.io/otel/trace"
+	"sync"
+	"time"
+)
+
+// routeRebuildInterval is the shortest time between two rebuilds of the routing table. Changes made within this
+// window of the last rebuild are applied together once it has passed.
+const routeRebuildInterval = time.Millisecond * 250
+
+// routeScheduler coalesces requests to rebuild the routing table. Every change to the database that affects routing
+// marks the table as dirty by incrementing requested, and a single goroutine applies the latest state until it has
+// caught up. Because only one rebuild runs at a time and each reads the database afresh, a config can never be
+// replaced by an older one.
+type routeScheduler struct {
+	lock sync.Mutex
+
+	requested   uint64 // generation of the most recent change
+	attempted   uint64 // generation of the most recent change included in a completed rebuild
+	lastErr     error  // result of the most recent completed rebuild
+	lastRebuild time.Time
+	running     bool
+	// links are the spans that made the changes waiting to be applied, so that the rebuild can be found from them
+	links []trace.Link
+
+	// done is closed and replaced whenever a rebuild completes
+	done chan struct{}
+}
+
+// scheduleRouteRebuild marks the routing table as dirty and returns the generation of the change. The change will be
+// applied in the background - use waitForRoutes to wait for it.
+func (c *Core) scheduleRouteRebuild() uint64 {
+	return c.scheduleRouteRebuildContext(context.Background())
+}
+
+func (c *Core) scheduleRouteRebuildContext(ctx context.Context) uint64 {
+	s := &c.routeScheduler
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if link := trace.LinkFromContext(ctx); link.SpanContext.IsValid() {
+		s.links = append(s.links, link)
+	}
+
+	s.requested += 1
+	if !s.running {
+		s.running = true
+		go c.runRouteScheduler()
+	}
+
+	return s.requested
+}
+
+func (c *Core) runRouteScheduler() {
+	s := &c.routeScheduler
+
+	for {
+		s.lock.Lock()
+		if s.attempted >= s.requested {
+			s.running = false
+			s.lock.Unlock()
+			return
+		}
+		wait := time.Until(s.lastRebuild.Add(routeRebuildInterval))
+		s.lock.Unlock()
+
+		if wait > 0 {
+			time.Sleep(wait)
+		}
+
+		// Every change up to this generation has been committed to the database before being scheduled, so the
+		// rebuild is guaranteed to include them.
+		s.lock.Lock()
+		generation := s.requested
+		links := s.links
+		s.links = nil
+		s.lock.Unlock()
+
+		// Several changes can be applied by one rebuild, so it's linked to them rather than being part of their traces
+		ctx, span := c.tracer.Start(context.Background(), "scheduled route rebuild", trace.WithLinks(links...))
+		err := c.BuildKnownRoutes(ctx)
+		endSpan(span, err)
+		if err != nil {
+			c.Logger.Error("unable to rebuild routes", "error", err)
+		}
+
+		s.lock.Lock()
+		s.attempted = generation
+		s.lastErr = err
+		s.lastRebuild = time.Now()
+		if s.done != nil {
+			close(s.done)
+			s.done = nil
+		}
+		s.lock.Unlock()
+	}
+}
+
+// waitForRoutes blocks until the change with the given generation has been applied, and returns the error from
+// applying it, if there was one.
+func (c *Core) waitForRoutes(ctx context.Context, generation uint64) error {
+	s := &c.routeScheduler
+
+	for {
+		s.lock.Lock()
+		if s.attempted >= generation {
+			err := s.lastErr
+			s.lock.Unlock()
+			return err
+		}
+		if s.done == nil {
+			s.done = make(chan struct{})
+		}
+		done := s.done
+		s.lock.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-done:
+		}
+	}
+}
+
+// WaitForRoutes blocks until every change to routing made before it was called is live.
+func (c *Core) WaitForRoutes(ctx context.Context) error {
+	c.routeScheduler.lock.Lock()
+	generation := c.routeScheduler.requested
+	c.routeScheduler.lock.Unlock()
+
+	return c.waitForRoutes(ctx, generation)
+}
+
+// rebuildRoutes schedules a rebuild of the routing table and waits for it to be applied.
+func (c *Core) rebuildRoutes() error {
+	return c.rebuildRoutesContext(context.Background())
+}
+
+// rebuildRoutesContext is like rebuildRoutes, but links the rebuild to the span in ctx. ctx can't cancel the wait,
+// since a change that has been committed must be applied before anything that depends on it can happen.
+func (c *Core) rebuildRoutesContext(ctx context.Context) error {
+	return c.waitForRoutes(context.Background(), c.scheduleRouteRebuildContext(ctx))
+}
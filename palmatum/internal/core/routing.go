@@ -1,11 +1,18 @@
 package core
 
 import (
+	"context"
+	"database/sql"
+	"errors"
 	"fmt"
 	"git.tdpain.net/codemicro/palmatum/palmatum/internal/caddyController"
+	"git.tdpain.net/codemicro/palmatum/palmatum/internal/database"
+	"github.com/jmoiron/sqlx"
 	"net/http"
 	"os"
+	"slices"
 	"strings"
+	"time"
 )
 
 type routeDestination struct {
@@ -24,28 +31,182 @@ func (c *cachedHandler) Close() error {
 	return c.file.Close()
 }
 
-func (c *Core) BuildKnownRoutes() error {
+// archiveConfig is the configuration that's been read from within a site archive.
+type archiveConfig struct {
+	headers    []*caddyController.HeaderRule
+	errorPages *caddyController.ErrorPages
+}
+
+// loadArchiveConfig reads any configuration that's been included in the site archive at contentPath. Errors are logged
+// but otherwise ignored, since a broken site bundle shouldn't prevent every other site from being served.
+func (c *Core) loadArchiveConfig(contentPath string) *archiveConfig {
+	ac := new(archiveConfig)
+
+	var err error
+
+	ac.headers, err = c.readHeadersFile(contentPath)
+	if err != nil {
+		c.Logger.Warn("unable to load custom headers", "error", err, "path", contentPath)
+	}
+
+	ac.errorPages, err = c.findErrorPages(contentPath)
+	if err != nil {
+		c.Logger.Warn("unable to find custom error pages", "error", err, "path", contentPath)
+	}
+
+	return ac
+}
+
+func (c *Core) BuildKnownRoutes(ctx context.Context) (err error) {
 	// TODO: tidy up this function, adapt the logging to make sense with the new Caddy setup and rename it
 
+	ctx, span := c.tracer.Start(ctx, "BuildKnownRoutes")
+	defer func() { endSpan(span, err) }()
+
 	c.Logger.Debug("loading known routes into memory")
 	c.routeLock.Lock()
 	defer c.routeLock.Unlock()
 
+	start := time.Now()
+
+	kr, problems, err := c.buildRouteSpec(c.Database)
+	if err == nil {
+		c.setArchiveProblems(kr, problems)
+		if err = c.CaddyController.Reconfigure(ctx, kr); err != nil {
+			err = fmt.Errorf("reconfigure Caddy controller: %w", err)
+		}
+	}
+
+	c.metrics.reconfigureDuration.Observe(time.Since(start).Seconds())
+	if err != nil {
+		c.metrics.reconfigureFailures.Inc()
+	}
+
+	c.lastReconfigure = reconfigureResult{at: time.Now(), err: err}
+	return err
+}
+
+// buildRouteSpec reads every route from the database. db may be a transaction, so that changes can be checked before
+// they're committed.
+//
+// Sites whose archives are missing or corrupt are left out of the routing table, since Caddy would refuse to load a
+// config that refers to them and that would stop every other site from being served. They're returned as problems.
+func (c *Core) buildRouteSpec(db sqlx.Queryer) (caddyController.RouteSpec, []*ArchiveProblem, error) {
 	var destinations []*caddyController.RouteDestination
-	if err := c.Database.Select(&destinations, `SELECT routes.id, routes.domain, routes.path, sites.content_path FROM routes JOIN sites ON routes.site = sites.slug;`); err != nil {
-		return fmt.Errorf("read from database: %w", err)
+	if err := sqlx.Select(db, &destinations, `SELECT routes.id, routes.site, routes.domain, routes.path, sites.content_path, sites.spa_fallback, sites.allowed_ips, sites.rate_limit_requests, sites.rate_limit_bandwidth_kilobytes, site_oidc.site IS NOT NULL AS oidc FROM routes JOIN sites ON routes.site = sites.slug LEFT JOIN site_oidc ON site_oidc.site = sites.slug;`); err != nil {
+		return nil, nil, fmt.Errorf("read from database: %w", err)
+	}
+
+	credentialModels, err := database.GetAllSiteCredentials(db)
+	if err != nil {
+		return nil, nil, fmt.Errorf("read credentials from database: %w", err)
+	}
+
+	credentials := make(map[string][]*caddyController.Credential)
+	for _, cm := range credentialModels {
+		credentials[cm.Site] = append(credentials[cm.Site], &caddyController.Credential{
+			Username:     cm.Username,
+			PasswordHash: cm.PasswordHash,
+		})
 	}
 
 	kr := make(caddyController.RouteSpec)
+	archives := make(map[string]*archiveConfig)
+	broken := make(map[string]*ArchiveProblem)
+
+	applyArchiveConfig := func(d *caddyController.RouteDestination) {
+		if d.ContentPath == "" {
+			return
+		}
+		if _, found := broken[d.Site]; !found {
+			if problem := c.checkArchive(d.ContentPath); problem != "" {
+				broken[d.Site] = &ArchiveProblem{Site: d.Site, ContentPath: d.ContentPath, Problem: problem}
+			}
+		}
+		if _, found := broken[d.Site]; found {
+			// The Caddy controller skips routes without any content
+			d.ContentPath = ""
+			return
+		}
+		ac, found := archives[d.ContentPath]
+		if !found {
+			ac = c.loadArchiveConfig(d.ContentPath)
+			archives[d.ContentPath] = ac
+		}
+		d.Headers = ac.headers
+		d.ErrorPages = ac.errorPages
+	}
 
 	for _, d := range destinations {
 		c.Logger.Debug("registering route", "domain", d.Domain, "path", d.Path, "id", d.ID)
 		d.Domain = strings.ToLower(d.Domain)
+		applyArchiveConfig(d)
+		d.Credentials = credentials[d.Site]
 		kr[d.Domain] = append(kr[d.Domain], d)
 	}
 
-	if err := c.CaddyController.Reconfigure(kr); err != nil {
-		return fmt.Errorf("reconfigure Caddy controller: %w", err)
+	if slug := c.Config.Platform.UnknownHostSite; slug != "" {
+		site, err := database.GetSite(db, slug)
+		if err != nil {
+			if !errors.Is(err, sql.ErrNoRows) {
+				return nil, nil, fmt.Errorf("get unknown host site: %w", err)
+			}
+			c.Logger.Warn("site to serve for unknown hosts does not exist", "slug", slug)
+		} else {
+			// The empty domain is used by the Caddy controller as a catch-all for any domain without its own routes.
+			var oidcEnabled bool
+			if err := db.QueryRowx(`SELECT EXISTS(SELECT 1 FROM site_oidc WHERE site = ?)`, site.Slug).Scan(&oidcEnabled); err != nil {
+				return nil, nil, fmt.Errorf("check if unknown host site uses OIDC: %w", err)
+			}
+
+			d := &caddyController.RouteDestination{
+				Site:        site.Slug,
+				Path:        "/",
+				ContentPath: site.ContentPath,
+				SPAFallback: site.SPAFallback,
+				AllowedIPs:  site.AllowedIPs,
+				Credentials: credentials[site.Slug],
+				OIDC:        oidcEnabled,
+
+				RateLimitRequests:           site.RateLimitRequests,
+				RateLimitBandwidthKilobytes: site.RateLimitBandwidthKilobytes,
+			}
+			applyArchiveConfig(d)
+			kr[""] = []*caddyController.RouteDestination{d}
+		}
 	}
+
+	problems := make([]*ArchiveProblem, 0, len(broken))
+	for _, p := range broken {
+		problems = append(problems, p)
+	}
+	slices.SortFunc(problems, func(a, b *ArchiveProblem) int { return strings.Compare(a.Site, b.Site) })
+
+	return kr, problems, nil
+}
+
+// validateRoutes checks that Caddy would accept the routes in db, which should be a transaction containing changes that
+// are yet to be committed.
+func (c *Core) validateRoutes(db sqlx.Queryer) error {
+	return c.validateRoutesContext(context.Background(), db)
+}
+
+func (c *Core) validateRoutesContext(ctx context.Context, db sqlx.Queryer) (err error) {
+	ctx, span := c.tracer.Start(ctx, "validateRoutes")
+	defer func() { endSpan(span, err) }()
+
+	kr, _, err := c.buildRouteSpec(db)
+	if err != nil {
+		return err
+	}
+
+	if err := c.CaddyController.Validate(ctx, kr); err != nil {
+		var ce *caddyController.ConfigError
+		if errors.As(err, &ce) {
+			return newError("change rejected by Caddy: " + ce.Message)
+		}
+		return fmt.Errorf("validate Caddy config: %w", err)
+	}
+
 	return nil
 }
@@ -0,0 +1,433 @@
+package core
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"git.tdpain.net/codemicro/palmatum/palmatum/internal/database"
+	"github.com/coreos/go-oidc/v3/oidc"
+	"github.com/mattn/go-sqlite3"
+	"golang.org/x/oauth2"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	ErrInvalidIssuer       = newError("invalid issuer URL")
+	ErrMissingClientID     = newError("missing client ID")
+	ErrMissingClientSecret = newError("missing client secret")
+	ErrOIDCNotEnabled      = newError("single sign-on is not enabled for this site")
+	ErrInvalidSession      = newError("invalid or expired session")
+	ErrAccessDenied        = newError("you are not allowed to access this site")
+)
+
+const (
+	siteSessionDuration = time.Hour * 12
+	siteLoginDuration   = time.Minute * 10
+)
+
+// Each signed value has a purpose that's included in its signature, so that a value issued for one purpose can't be
+// used for another - for example, the state of a login being presented as a session cookie.
+const (
+	signedSiteSession          = "site-session"
+	signedSiteLoginState       = "site-login-state"
+	signedManagementSession    = "management-session"
+	signedManagementLoginState = "management-login-state"
+)
+
+// SiteSessionCookieName returns the name of the cookie that stores a visitor's session for the given site.
+func SiteSessionCookieName(siteSlug string) string {
+	return "palmatum_session_" + siteSlug
+}
+
+// SiteLoginNonceCookieName is the name of the cookie used to tie an in-progress login to the browser that started it.
+const SiteLoginNonceCookieName = "palmatum_login_nonce"
+
+// SiteSession is the content of a session cookie issued to a visitor that has logged in to a site.
+type SiteSession struct {
+	Site    string `json:"site"`
+	Subject string `json:"sub"`
+	Email   string `json:"email,omitempty"`
+	Expires int64  `json:"exp"`
+}
+
+type siteLoginState struct {
+	Site     string `json:"site"`
+	ReturnTo string `json:"ret"`
+	Nonce    string `json:"nonce"`
+	Expires  int64  `json:"exp"`
+}
+
+// oidcProviderCache stores OIDC providers by their issuer URL so that discovery isn't performed on every login.
+type oidcProviderCache struct {
+	lock      sync.Mutex
+	providers map[string]*oidc.Provider
+}
+
+func (c *Core) getOIDCProvider(ctx context.Context, issuer string) (*oidc.Provider, error) {
+	c.oidcProviders.lock.Lock()
+	defer c.oidcProviders.lock.Unlock()
+
+	if p, found := c.oidcProviders.providers[issuer]; found {
+		return p, nil
+	}
+
+	p, err := oidc.NewProvider(ctx, issuer)
+	if err != nil {
+		return nil, err
+	}
+
+	if c.oidcProviders.providers == nil {
+		c.oidcProviders.providers = make(map[string]*oidc.Provider)
+	}
+	c.oidcProviders.providers[issuer] = p
+
+	return p, nil
+}
+
+// SetSiteOIDC enables single sign-on for a site, or updates the existing configuration. If the client secret is
+// empty, the previously set secret is kept.
+func (c *Core) SetSiteOIDC(conf *database.SiteOIDCModel) error {
+	conf.Issuer = strings.TrimSpace(conf.Issuer)
+	if u, err := url.Parse(conf.Issuer); err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+		return ErrInvalidIssuer
+	}
+
+	conf.ClientID = strings.TrimSpace(conf.ClientID)
+	if conf.ClientID == "" {
+		return ErrMissingClientID
+	}
+
+	conf.AllowedEmails = strings.Join(splitList(conf.AllowedEmails), " ")
+	conf.AllowedGroups = strings.Join(splitList(conf.AllowedGroups), " ")
+
+	tx, err := c.Database.Beginx()
+	if err != nil {
+		return fmt.Errorf("begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	// Foreign keys aren't enforced, so the site has to be checked for explicitly
+	if _, err := database.GetSite(tx, conf.Site); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrInvalidSlug
+		}
+		return fmt.Errorf("get site from database: %w", err)
+	}
+
+	if conf.ClientSecret == "" {
+		existing, err := database.GetSiteOIDC(tx, conf.Site)
+		if err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				return ErrMissingClientSecret
+			}
+			return fmt.Errorf("get existing OIDC configuration: %w", err)
+		}
+		conf.ClientSecret = existing.ClientSecret
+	}
+
+	_, err = tx.NamedExec(`INSERT INTO site_oidc(site, issuer, client_id, client_secret, allowed_emails, allowed_groups) VALUES (:site, :issuer, :client_id, :client_secret, :allowed_emails, :allowed_groups)
+		ON CONFLICT (site) DO UPDATE SET issuer = excluded.issuer, client_id = excluded.client_id, client_secret = excluded.client_secret, allowed_emails = excluded.allowed_emails, allowed_groups = excluded.allowed_groups`, conf)
+	if err != nil {
+		var e sqlite3.Error
+		if errors.As(err, &e) && e.ExtendedCode == sqlite3.ErrConstraintForeignKey {
+			return ErrInvalidSlug
+		}
+		return fmt.Errorf("call database: %w", err)
+	}
+
+	if err := c.validateRoutes(tx); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("commit transaction: %w", err)
+	}
+
+	c.scheduleRouteRebuild()
+
+	return nil
+}
+
+func (c *Core) DisableSiteOIDC(siteSlug string) error {
+	tx, err := c.Database.Beginx()
+	if err != nil {
+		return fmt.Errorf("begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`DELETE FROM site_oidc WHERE site = ?`, siteSlug); err != nil {
+		return fmt.Errorf("call database: %w", err)
+	}
+
+	if err := c.validateRoutes(tx); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("commit transaction: %w", err)
+	}
+
+	c.scheduleRouteRebuild()
+
+	return nil
+}
+
+// CheckSiteSession validates a session cookie for the given site.
+func (c *Core) CheckSiteSession(siteSlug, cookieValue string) (*SiteSession, error) {
+	sess := new(SiteSession)
+	if err := c.verifySignedValue(signedSiteSession, cookieValue, sess); err != nil {
+		return nil, ErrInvalidSession
+	}
+
+	if sess.Site != siteSlug || sess.Subject == "" || time.Now().Unix() > sess.Expires {
+		return nil, ErrInvalidSession
+	}
+
+	return sess, nil
+}
+
+// BeginSiteLogin starts the login process for a visitor to a site protected with single sign-on. redirectURL is the
+// callback URL that the identity provider should send the visitor back to and returnTo is the path the visitor should
+// end up at once they've logged in.
+//
+// The returned nonce should be stored in the SiteLoginNonceCookieName cookie, and the visitor should be redirected to
+// the returned URL.
+func (c *Core) BeginSiteLogin(ctx context.Context, siteSlug, redirectURL, returnTo string) (authURL string, nonce string, err error) {
+	conf, err := database.GetSiteOIDC(c.Database, siteSlug)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return "", "", ErrOIDCNotEnabled
+		}
+		return "", "", fmt.Errorf("get OIDC configuration: %w", err)
+	}
+
+	provider, err := c.getOIDCProvider(ctx, conf.Issuer)
+	if err != nil {
+		return "", "", fmt.Errorf("get OIDC provider: %w", err)
+	}
+
+	nonce, err = generateNonce()
+	if err != nil {
+		return "", "", fmt.Errorf("generate nonce: %w", err)
+	}
+
+	state, err := c.signValue(signedSiteLoginState, &siteLoginState{
+		Site:     siteSlug,
+		ReturnTo: localPath(returnTo),
+		Nonce:    nonce,
+		Expires:  time.Now().Add(siteLoginDuration).Unix(),
+	})
+	if err != nil {
+		return "", "", fmt.Errorf("sign state: %w", err)
+	}
+
+	return oauth2Config(conf.ClientID, conf.ClientSecret, provider, redirectURL).AuthCodeURL(state, oidc.Nonce(nonce)), nonce, nil
+}
+
+// CompleteSiteLogin finishes the login process started by BeginSiteLogin and returns a signed session that should be
+// stored in the SiteSessionCookieName cookie, as well as the path to send the visitor back to.
+func (c *Core) CompleteSiteLogin(ctx context.Context, state, code, nonce, redirectURL string) (token string, session *SiteSession, returnTo string, err error) {
+	loginState := new(siteLoginState)
+	if err := c.verifySignedValue(signedSiteLoginState, state, loginState); err != nil {
+		return "", nil, "", ErrInvalidSession
+	}
+
+	if time.Now().Unix() > loginState.Expires || nonce == "" || !hmac.Equal([]byte(nonce), []byte(loginState.Nonce)) {
+		return "", nil, "", ErrInvalidSession
+	}
+
+	conf, err := database.GetSiteOIDC(c.Database, loginState.Site)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return "", nil, "", ErrOIDCNotEnabled
+		}
+		return "", nil, "", fmt.Errorf("get OIDC configuration: %w", err)
+	}
+
+	provider, err := c.getOIDCProvider(ctx, conf.Issuer)
+	if err != nil {
+		return "", nil, "", fmt.Errorf("get OIDC provider: %w", err)
+	}
+
+	idToken, claims, err := exchangeOIDCCode(ctx, provider, oauth2Config(conf.ClientID, conf.ClientSecret, provider, redirectURL), code, loginState.Nonce)
+	if err != nil {
+		return "", nil, "", err
+	}
+
+	if !isOIDCUserAllowed(conf, claims.Email, claims.Groups) {
+		return "", nil, "", ErrAccessDenied
+	}
+
+	session = &SiteSession{
+		Site:    loginState.Site,
+		Subject: idToken.Subject,
+		Email:   claims.Email,
+		Expires: time.Now().Add(siteSessionDuration).Unix(),
+	}
+
+	token, err = c.signValue(signedSiteSession, session)
+	if err != nil {
+		return "", nil, "", fmt.Errorf("sign session: %w", err)
+	}
+
+	return token, session, loginState.ReturnTo, nil
+}
+
+// isOIDCUserAllowed checks a user's email address and groups against the allowlists for a site. If neither allowlist
+// is set, any user that can log in with the identity provider is allowed.
+func isOIDCUserAllowed(conf *database.SiteOIDCModel, email string, groups []string) bool {
+	allowedEmails := splitList(conf.AllowedEmails)
+	allowedGroups := splitList(conf.AllowedGroups)
+
+	if len(allowedEmails) == 0 && len(allowedGroups) == 0 {
+		return true
+	}
+
+	if email != "" && slices.ContainsFunc(allowedEmails, func(s string) bool { return strings.EqualFold(s, email) }) {
+		return true
+	}
+
+	for _, g := range groups {
+		if slices.Contains(allowedGroups, g) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// oidcClaims are the claims that Palmatum uses from an ID token.
+type oidcClaims struct {
+	Email         string   `json:"email"`
+	EmailVerified *bool    `json:"email_verified"`
+	Name          string   `json:"name"`
+	Groups        []string `json:"groups"`
+}
+
+// exchangeOIDCCode exchanges an authorisation code for an ID token, verifies it and checks that it contains the
+// expected nonce. If the email address in the returned claims hasn't been verified by the identity provider, it's
+// removed.
+func exchangeOIDCCode(ctx context.Context, provider *oidc.Provider, conf *oauth2.Config, code, nonce string) (*oidc.IDToken, *oidcClaims, error) {
+	oauthToken, err := conf.Exchange(ctx, code)
+	if err != nil {
+		return nil, nil, fmt.Errorf("exchange authorisation code: %w", err)
+	}
+
+	rawIDToken, ok := oauthToken.Extra("id_token").(string)
+	if !ok {
+		return nil, nil, errors.New("token response did not contain an ID token")
+	}
+
+	idToken, err := provider.Verifier(&oidc.Config{ClientID: conf.ClientID}).Verify(ctx, rawIDToken)
+	if err != nil {
+		return nil, nil, fmt.Errorf("verify ID token: %w", err)
+	}
+
+	if !hmac.Equal([]byte(idToken.Nonce), []byte(nonce)) {
+		return nil, nil, ErrInvalidSession
+	}
+
+	claims := new(oidcClaims)
+	if err := idToken.Claims(claims); err != nil {
+		return nil, nil, fmt.Errorf("parse ID token claims: %w", err)
+	}
+
+	if claims.EmailVerified != nil && !*claims.EmailVerified {
+		claims.Email = ""
+	}
+
+	return idToken, claims, nil
+}
+
+func generateNonce() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+func oauth2Config(clientID, clientSecret string, provider *oidc.Provider, redirectURL string) *oauth2.Config {
+	return &oauth2.Config{
+		ClientID:     clientID,
+		ClientSecret: clientSecret,
+		Endpoint:     provider.Endpoint(),
+		RedirectURL:  redirectURL,
+		Scopes:       []string{oidc.ScopeOpenID, "email", "profile"},
+	}
+}
+
+// localPath returns p if it's a path on the same host, or / if it isn't. Browsers treat backslashes like forward
+// slashes, so /\example.com would otherwise lead to another host.
+func localPath(p string) string {
+	if !strings.HasPrefix(p, "/") || strings.HasPrefix(p, "//") || strings.Contains(p, "\\") {
+		return "/"
+	}
+	if u, err := url.Parse(p); err != nil || u.Scheme != "" || u.Host != "" {
+		return "/"
+	}
+	return p
+}
+
+// splitList splits a list of items separated by commas or whitespace.
+func splitList(s string) []string {
+	return strings.FieldsFunc(s, func(r rune) bool {
+		return r == ',' || r == ' ' || r == '\t' || r == '\n' || r == '\r'
+	})
+}
+
+// signValue encodes v as JSON and signs it with the session secret. The value can only be verified for the same
+// purpose.
+func (c *Core) signValue(purpose string, v any) (string, error) {
+	j, err := json.Marshal(v)
+	if err != nil {
+		return "", err
+	}
+
+	payload := base64.RawURLEncoding.EncodeToString(j)
+
+	return payload + "." + base64.RawURLEncoding.EncodeToString(c.signPayload(purpose, payload)), nil
+}
+
+func (c *Core) signPayload(purpose, payload string) []byte {
+	mac := hmac.New(sha256.New, c.sessionSecret)
+	mac.Write([]byte(purpose))
+	// The purpose can't contain a full stop, so this separates it from the payload unambiguously
+	mac.Write([]byte{'.'})
+	mac.Write([]byte(payload))
+	return mac.Sum(nil)
+}
+
+// verifySignedValue checks the signature on a value produced by signValue for purpose and decodes it into v.
+func (c *Core) verifySignedValue(purpose, s string, v any) error {
+	payload, sig, found := strings.Cut(s, ".")
+	if !found {
+		return errors.New("malformed value")
+	}
+
+	sigBytes, err := base64.RawURLEncoding.DecodeString(sig)
+	if err != nil {
+		return fmt.Errorf("decode signature: %w", err)
+	}
+
+	if !hmac.Equal(c.signPayload(purpose, payload), sigBytes) {
+		return errors.New("invalid signature")
+	}
+
+	j, err := base64.RawURLEncoding.DecodeString(payload)
+	if err != nil {
+		return fmt.Errorf("decode payload: %w", err)
+	}
+
+	return json.Unmarshal(j, v)
+}
@@ -0,0 +1,311 @@
+package core
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"git.tdpain.net/codemicro/palmatum/palmatum/internal/database"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const (
+	testOIDCClientID     = "palmatum"
+	testOIDCClientSecret = "client secret"
+	testOIDCRedirectURL  = "https://palmatum.example.com/auth/callback"
+)
+
+// mockOIDCProvider is a minimal OpenID Connect provider. Rather than having a login page, the test decides who logs in
+// by calling authorise, which returns the authorisation code that the provider would have sent back to Palmatum.
+type mockOIDCProvider struct {
+	*httptest.Server
+	key *rsa.PrivateKey
+
+	mu    sync.Mutex
+	codes map[string]map[string]any
+}
+
+func newMockOIDCProvider(t *testing.T) *mockOIDCProvider {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := &mockOIDCProvider{key: key, codes: make(map[string]map[string]any)}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /.well-known/openid-configuration", func(rw http.ResponseWriter, rq *http.Request) {
+		writeTestJSON(rw, map[string]any{
+			"issuer":                                p.URL,
+			"authorization_endpoint":                p.URL + "/authorize",
+			"token_endpoint":                        p.URL + "/token",
+			"jwks_uri":                              p.URL + "/keys",
+			"response_types_supported":              []string{"code"},
+			"subject_types_supported":               []string{"public"},
+			"id_token_signing_alg_values_supported": []string{"RS256"},
+		})
+	})
+	mux.HandleFunc("GET /keys", func(rw http.ResponseWriter, rq *http.Request) {
+		writeTestJSON(rw, map[string]any{
+			"keys": []map[string]string{{
+				"kty": "RSA",
+				"alg": "RS256",
+				"use": "sig",
+				"kid": "test",
+				"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+				"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+			}},
+		})
+	})
+	mux.HandleFunc("POST /token", func(rw http.ResponseWriter, rq *http.Request) {
+		clientID, clientSecret, ok := rq.BasicAuth()
+		if !ok {
+			clientID, clientSecret = rq.PostFormValue("client_id"), rq.PostFormValue("client_secret")
+		}
+		if clientID != testOIDCClientID || clientSecret != testOIDCClientSecret {
+			rw.WriteHeader(http.StatusUnauthorized)
+			writeTestJSON(rw, map[string]string{"error": "invalid_client"})
+			return
+		}
+
+		p.mu.Lock()
+		claims, found := p.codes[rq.PostFormValue("code")]
+		delete(p.codes, rq.PostFormValue("code"))
+		p.mu.Unlock()
+
+		if !found || rq.PostFormValue("redirect_uri") != testOIDCRedirectURL {
+			rw.WriteHeader(http.StatusBadRequest)
+			writeTestJSON(rw, map[string]string{"error": "invalid_grant"})
+			return
+		}
+
+		writeTestJSON(rw, map[string]any{
+			"access_token": "access token",
+			"token_type":   "Bearer",
+			"expires_in":   3600,
+			"id_token":     p.sign(t, claims),
+		})
+	})
+
+	p.Server = httptest.NewServer(mux)
+	t.Cleanup(p.Close)
+
+	return p
+}
+
+// authorise returns an authorisation code for a user with the given claims, which are added to the standard ones.
+func (p *mockOIDCProvider) authorise(nonce string, claims map[string]any) string {
+	now := time.Now()
+	idClaims := map[string]any{
+		"iss":   p.URL,
+		"aud":   testOIDCClientID,
+		"iat":   now.Unix(),
+		"exp":   now.Add(time.Hour).Unix(),
+		"nonce": nonce,
+	}
+	for k, v := range claims {
+		idClaims[k] = v
+	}
+
+	code, _ := generateNonce()
+
+	p.mu.Lock()
+	p.codes[code] = idClaims
+	p.mu.Unlock()
+
+	return code
+}
+
+func (p *mockOIDCProvider) sign(t *testing.T, claims map[string]any) string {
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT", "kid": "test"})
+	payload, _ := json.Marshal(claims)
+	signingInput := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+
+	digest := sha256.Sum256([]byte(signingInput))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, p.key, crypto.SHA256, digest[:])
+	if err != nil {
+		t.Error(err)
+	}
+
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+func writeTestJSON(rw http.ResponseWriter, v any) {
+	rw.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(rw).Encode(v)
+}
+
+func TestSiteOIDCLogin(t *testing.T) {
+	c := newTestCore(t)
+	provider := newMockOIDCProvider(t)
+	ctx := context.Background()
+
+	if _, err := c.CreateSite("docs"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := c.SetSiteOIDC(&database.SiteOIDCModel{Site: "docs", Issuer: "ftp://example.com", ClientID: testOIDCClientID, ClientSecret: testOIDCClientSecret}); !errors.Is(err, ErrInvalidIssuer) {
+		t.Fatalf("expected ErrInvalidIssuer, got %v", err)
+	}
+	if err := c.SetSiteOIDC(&database.SiteOIDCModel{Site: "docs", Issuer: provider.URL, ClientID: testOIDCClientID}); !errors.Is(err, ErrMissingClientSecret) {
+		t.Fatalf("expected ErrMissingClientSecret, got %v", err)
+	}
+	if err := c.SetSiteOIDC(&database.SiteOIDCModel{Site: "missing", Issuer: provider.URL, ClientID: testOIDCClientID, ClientSecret: testOIDCClientSecret}); !errors.Is(err, ErrInvalidSlug) {
+		t.Fatalf("expected ErrInvalidSlug, got %v", err)
+	}
+	if err := c.SetSiteOIDC(&database.SiteOIDCModel{
+		Site:          "docs",
+		Issuer:        provider.URL,
+		ClientID:      testOIDCClientID,
+		ClientSecret:  testOIDCClientSecret,
+		AllowedEmails: "alice@example.com",
+		AllowedGroups: "staff, contractors",
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	// login begins a login, has the provider authorise a user with the given claims and completes the login
+	login := func(returnTo string, claims map[string]any) (string, *SiteSession, string, error) {
+		t.Helper()
+
+		authURL, nonce, err := c.BeginSiteLogin(ctx, "docs", testOIDCRedirectURL, returnTo)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		u, err := url.Parse(authURL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		q := u.Query()
+		if !strings.HasPrefix(authURL, provider.URL+"/authorize?") || q.Get("client_id") != testOIDCClientID || q.Get("redirect_uri") != testOIDCRedirectURL || q.Get("nonce") != nonce {
+			t.Fatalf("unexpected authorisation URL %s", authURL)
+		}
+
+		return c.CompleteSiteLogin(ctx, q.Get("state"), provider.authorise(nonce, claims), nonce, testOIDCRedirectURL)
+	}
+
+	t.Run("allowed by group", func(t *testing.T) {
+		token, session, returnTo, err := login("/guide?page=2", map[string]any{"sub": "bob", "email": "bob@example.com", "groups": []string{"staff"}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if session.Site != "docs" || session.Subject != "bob" || session.Email != "bob@example.com" {
+			t.Errorf("unexpected session %+v", session)
+		}
+		if returnTo != "/guide?page=2" {
+			t.Errorf("expected to return to /guide?page=2, got %q", returnTo)
+		}
+
+		if _, err := c.CheckSiteSession("docs", token); err != nil {
+			t.Errorf("session rejected: %v", err)
+		}
+		if _, err := c.CheckSiteSession("other", token); !errors.Is(err, ErrInvalidSession) {
+			t.Errorf("session accepted for another site: %v", err)
+		}
+	})
+
+	t.Run("allowed by email", func(t *testing.T) {
+		if _, _, _, err := login("/", map[string]any{"sub": "alice", "email": "Alice@example.com"}); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("unverified email", func(t *testing.T) {
+		if _, _, _, err := login("/", map[string]any{"sub": "mallory", "email": "alice@example.com", "email_verified": false}); !errors.Is(err, ErrAccessDenied) {
+			t.Fatalf("expected ErrAccessDenied, got %v", err)
+		}
+	})
+
+	t.Run("not allowed", func(t *testing.T) {
+		if _, _, _, err := login("/", map[string]any{"sub": "eve", "email": "eve@example.com", "groups": []string{"visitors"}}); !errors.Is(err, ErrAccessDenied) {
+			t.Fatalf("expected ErrAccessDenied, got %v", err)
+		}
+	})
+
+	t.Run("off-site return path", func(t *testing.T) {
+		_, _, returnTo, err := login(`/\evil.example.com`, map[string]any{"sub": "bob", "groups": []string{"staff"}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if returnTo != "/" {
+			t.Fatalf("expected to return to /, got %q", returnTo)
+		}
+	})
+
+	t.Run("wrong nonce", func(t *testing.T) {
+		authURL, nonce, err := c.BeginSiteLogin(ctx, "docs", testOIDCRedirectURL, "/")
+		if err != nil {
+			t.Fatal(err)
+		}
+		u, _ := url.Parse(authURL)
+		state := u.Query().Get("state")
+
+		// The login was started in a different browser
+		code := provider.authorise(nonce, map[string]any{"sub": "bob", "groups": []string{"staff"}})
+		if _, _, _, err := c.CompleteSiteLogin(ctx, state, code, "another nonce", testOIDCRedirectURL); !errors.Is(err, ErrInvalidSession) {
+			t.Fatalf("expected ErrInvalidSession, got %v", err)
+		}
+
+		// The ID token was issued for a different login
+		code = provider.authorise("another nonce", map[string]any{"sub": "bob", "groups": []string{"staff"}})
+		if _, _, _, err := c.CompleteSiteLogin(ctx, state, code, nonce, testOIDCRedirectURL); !errors.Is(err, ErrInvalidSession) {
+			t.Fatalf("expected ErrInvalidSession, got %v", err)
+		}
+
+		// The login state isn't a session
+		if _, err := c.CheckSiteSession("docs", state); !errors.Is(err, ErrInvalidSession) {
+			t.Fatalf("login state accepted as a session: %v", err)
+		}
+	})
+
+	// A rejected change is reported as a Palmatum error, so that it can be shown to the user, and nothing is changed
+	c.caddy.mu.Lock()
+	c.caddy.rejectAdapt = true
+	c.caddy.mu.Unlock()
+	var e *Error
+	if err := c.DisableSiteOIDC("docs"); !errors.As(err, &e) {
+		t.Fatalf("expected a rejection, got %v", err)
+	}
+	if _, err := database.GetSiteOIDC(c.Database, "docs"); err != nil {
+		t.Fatalf("OIDC disabled by a rejected change: %v", err)
+	}
+	c.caddy.mu.Lock()
+	c.caddy.rejectAdapt = false
+	c.caddy.mu.Unlock()
+
+	if err := c.DisableSiteOIDC("docs"); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := c.BeginSiteLogin(ctx, "docs", testOIDCRedirectURL, "/"); !errors.Is(err, ErrOIDCNotEnabled) {
+		t.Fatalf("expected ErrOIDCNotEnabled, got %v", err)
+	}
+}
+
+func TestLocalPath(t *testing.T) {
+	for in, want := range map[string]string{
+		"/a/b?c=d":         "/a/b?c=d",
+		"/%5Cevil.example": "/%5Cevil.example",
+		`/\evil.example`:   "/",
+		`/a\b`:             "/",
+		"//evil.example":   "/",
+		"https://evil":     "/",
+		"evil":             "/",
+		"":                 "/",
+	} {
+		if got := localPath(in); got != want {
+			t.Errorf("localPath(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
@@ -1,11 +1,13 @@
 package core
 
 import (
+	"context"
 	"database/sql"
 	"errors"
 	"fmt"
 	"git.tdpain.net/codemicro/palmatum/palmatum/internal/database"
 	"github.com/mattn/go-sqlite3"
+	"go.opentelemetry.io/otel/trace"
 	"os"
 	"regexp"
 	"strings"
@@ -29,6 +31,7 @@ func (e *Error) Error() string {
 var (
 	ErrDuplicateSlug = newError("slug in use")
 	ErrInvalidSlug   = newError("invalid slug")
+	ErrInvalidLimit  = newError("invalid limit (must be zero or a positive whole number)")
 
 	SiteSlugValidationRegexp = regexp.MustCompile(`^([\w\-._]{2,})$`)
 )
@@ -54,6 +57,8 @@ func (c *Core) CreateSite(siteSlug string) (*database.SiteModel, error) {
 		return nil, fmt.Errorf("call database: %w", err)
 	}
 
+	c.emitEvent(&Event{Type: EventSiteCreated, Site: siteSlug})
+
 	return &database.SiteModel{
 		Slug: siteSlug,
 	}, nil
@@ -70,52 +75,151 @@ func (c *Core) DeleteSite(siteSlug string) error {
 		return fmt.Errorf("delete routes: %w", err)
 	}
 
+	if _, err := tx.Exec(`DELETE FROM site_credentials WHERE site = ?`, siteSlug); err != nil {
+		return fmt.Errorf("delete site credentials: %w", err)
+	}
+
+	if _, err := tx.Exec(`DELETE FROM site_oidc WHERE site = ?`, siteSlug); err != nil {
+		return fmt.Errorf("delete site OIDC configuration: %w", err)
+	}
+
+	if _, err := tx.Exec(`DELETE FROM site_git WHERE site = ?`, siteSlug); err != nil {
+		return fmt.Errorf("delete site Git configuration: %w", err)
+	}
+
+	if _, err := tx.Exec(`DELETE FROM deployments WHERE site = ?`, siteSlug); err != nil {
+		return fmt.Errorf("delete deployments: %w", err)
+	}
+
+	if _, err := tx.Exec(`DELETE FROM site_build WHERE site = ?`, siteSlug); err != nil {
+		return fmt.Errorf("delete site build configuration: %w", err)
+	}
+
+	if _, err := tx.Exec(`DELETE FROM builds WHERE site = ?`, siteSlug); err != nil {
+		return fmt.Errorf("delete builds: %w", err)
+	}
+
+	if _, err := tx.Exec(`DELETE FROM access_log WHERE site = ?`, siteSlug); err != nil {
+		return fmt.Errorf("delete access logs: %w", err)
+	}
+
+	for _, table := range []string{"analytics_daily", "analytics_top", "analytics_visitors"} {
+		if _, err := tx.Exec(`DELETE FROM `+table+` WHERE site = ?`, siteSlug); err != nil {
+			return fmt.Errorf("delete analytics from %s: %w", table, err)
+		}
+	}
+
 	var contentPath string
 
 	if err := tx.QueryRow(`DELETE FROM sites WHERE slug = ? RETURNING content_path`, siteSlug).Scan(&contentPath); err != nil {
 		return fmt.Errorf("delete sites: %w", err)
 	}
 
+	if err := c.validateRoutes(tx); err != nil {
+		return err
+	}
+
 	if err := tx.Commit(); err != nil {
 		return fmt.Errorf("commit transaction: %w", err)
 	}
 
+	if err := c.rebuildRoutes(); err != nil {
+		return fmt.Errorf("rebuild known routes: %w", err)
+	}
+
 	if contentPath != "" {
 		if err := os.Remove(c.getPathOnDisk(contentPath)); err != nil {
 			return fmt.Errorf("remove path: %w", err)
 		}
 	}
 
-	if err := c.BuildKnownRoutes(); err != nil {
-		return fmt.Errorf("rebuild known routes: %w", err)
-	}
+	c.emitEvent(&Event{Type: EventSiteDeleted, Site: siteSlug})
 
 	return nil
 }
 
-func (c *Core) UpdateContentPath(siteSlug string, contentPath string) error {
-	tx, err := c.Database.Beginx()
+const (
+	DeploymentSourceUpload = "upload"
+	DeploymentSourceGit    = "git"
+)
+
+// DeploymentInfo describes where the content of a deployment came from.
+type DeploymentInfo struct {
+	Source    string
+	CommitSHA string
+	BuildID   int
+}
+
+// deployedError is returned by updateContentPath if something goes wrong after the new content has been recorded as
+// the site's content, in which case it's in use and mustn't be removed.
+type deployedError struct {
+	err error
+}
+
+func (e *deployedError) Error() string {
+	return e.err.Error()
+}
+
+func (e *deployedError) Unwrap() error {
+	return e.err
+}
+
+// UpdateContentPath deploys new content to a site and records the deployment. If info is nil, the content is assumed
+// to have been uploaded.
+func (c *Core) UpdateContentPath(ctx context.Context, siteSlug string, contentPath string, info *DeploymentInfo) error {
+	size, err := measureSiteArchive(c.getPathOnDisk(contentPath))
+	if err != nil {
+		return err
+	}
+	return c.updateContentPath(ctx, siteSlug, contentPath, size, info)
+}
+
+func (c *Core) updateContentPath(ctx context.Context, siteSlug string, contentPath string, size *archiveSize, info *DeploymentInfo) (err error) {
+	ctx, span := c.tracer.Start(ctx, "UpdateContentPath", trace.WithAttributes(siteAttribute(siteSlug)))
+	defer func() { endSpan(span, err) }()
+
+	if info == nil {
+		info = &DeploymentInfo{Source: DeploymentSourceUpload}
+	}
+
+	tx, err := c.Database.BeginTxx(ctx, nil)
 	if err != nil {
 		return fmt.Errorf("begin transaction: %w", err)
 	}
 	defer tx.Rollback()
 
 	var oldContentPath string
-	if err := tx.QueryRow("select content_path from sites where slug=?", siteSlug).Scan(&oldContentPath); err != nil && !errors.Is(err, sql.ErrNoRows) {
+	if err := tx.QueryRowContext(ctx, "select content_path from sites where slug=?", siteSlug).Scan(&oldContentPath); err != nil && !errors.Is(err, sql.ErrNoRows) {
 		return fmt.Errorf("get old content path: %w", err)
 	}
 
-	_, err = tx.Exec(`UPDATE sites SET content_path=?, last_updated_at=? WHERE slug = ?`, contentPath, time.Now().Unix(), siteSlug)
+	_, err = tx.ExecContext(ctx, `UPDATE sites SET content_path=?, last_updated_at=?, content_size=?, content_uncompressed_size=? WHERE slug = ?`, contentPath, time.Now().Unix(), size.compressed, size.uncompressed, siteSlug)
 	if err != nil {
 		return fmt.Errorf("update content path: %w", err)
 	}
 
+	// This is done after the site has been updated so that the transaction has a write lock, which stops another
+	// deployment from using the same space at the same time.
+	if err := c.checkStorageQuota(tx, siteSlug, size.compressed); err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, `INSERT INTO deployments(site, content_path, source, commit_sha, created_at, build, size, uncompressed_size) VALUES (?, ?, ?, ?, ?, ?, ?, ?)`, siteSlug, contentPath, info.Source, info.CommitSHA, time.Now().Unix(), info.BuildID, size.compressed, size.uncompressed)
+	if err != nil {
+		return fmt.Errorf("record deployment: %w", err)
+	}
+
+	if err := c.validateRoutesContext(ctx, tx); err != nil {
+		return err
+	}
+
 	if err := tx.Commit(); err != nil {
 		return fmt.Errorf("commit transaction: %w", err)
 	}
 
-	if err := c.BuildKnownRoutes(); err != nil {
-		return fmt.Errorf("rebuild known routes: %w", err)
+	// The old content can't be removed until Caddy has stopped serving it
+	if err := c.rebuildRoutesContext(ctx); err != nil {
+		return &deployedError{err: fmt.Errorf("rebuild known routes: %w", err)}
 	}
 
 	if oldContentPath != "" {
@@ -124,6 +228,9 @@ func (c *Core) UpdateContentPath(siteSlug string, contentPath string) error {
 		}
 	}
 
+	c.metrics.deployments.WithLabelValues(info.Source).Inc()
+	c.emitEvent(&Event{Type: EventSiteDeployed, Site: siteSlug, Commit: info.CommitSHA})
+
 	return nil
 }
 
@@ -176,31 +283,133 @@ func (c *Core) CreateRoute(siteSlug, domain, path string) (*database.RouteModel,
 		return nil, fmt.Errorf("call database: %w", err)
 	}
 
+	if err := c.validateRoutes(tx); err != nil {
+		return nil, err
+	}
+
 	if err := tx.Commit(); err != nil {
 		return nil, fmt.Errorf("commit databse transaction: %w", err)
 	}
 
-	if err := c.BuildKnownRoutes(); err != nil {
-		return nil, fmt.Errorf("rebuild known routes: %w", err)
-	}
+	c.scheduleRouteRebuild()
 
-	return &database.RouteModel{
+	route := &database.RouteModel{
 		ID:     id,
 		Site:   siteSlug,
 		Domain: domain,
 		Path:   path,
-	}, nil
+	}
+
+	c.emitEvent(&Event{Type: EventRouteCreated, Site: siteSlug, Route: route})
+
+	return route, nil
 }
 
 func (c *Core) DeleteRoute(id int) error {
-	_, err := c.Database.Exec(`DELETE FROM routes WHERE id = ?`, id)
+	tx, err := c.Database.Beginx()
 	if err != nil {
+		return fmt.Errorf("begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	route := new(database.RouteModel)
+	err = tx.QueryRowx(`DELETE FROM routes WHERE id = ? RETURNING id, site, domain, path`, id).StructScan(route)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil
+		}
 		return fmt.Errorf("call database: %w", err)
 	}
 
-	if err := c.BuildKnownRoutes(); err != nil {
-		return fmt.Errorf("rebuild known routes: %w", err)
+	if err := c.validateRoutes(tx); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("commit transaction: %w", err)
+	}
+
+	c.scheduleRouteRebuild()
+
+	c.emitEvent(&Event{Type: EventRouteDeleted, Site: route.Site, Route: route})
+
+	return nil
+}
+
+// UpdateSiteSettings sets whether a site uses an SPA fallback and, unless quotaMegabytes is nil, how many megabytes its
+// content can take up. Either every setting is changed or none are.
+//
+// If the quota is zero, the platform-wide default is used. The quota is checked the next time the site is deployed to,
+// so content that's already over quota is left alone.
+func (c *Core) UpdateSiteSettings(siteSlug string, spaFallback bool, quotaMegabytes *int) error {
+	if quotaMegabytes != nil && *quotaMegabytes < 0 {
+		return ErrInvalidLimit
+	}
+
+	tx, err := c.Database.Beginx()
+	if err != nil {
+		return fmt.Errorf("begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec(`UPDATE sites SET spa_fallback = ?, quota_megabytes = COALESCE(?, quota_megabytes) WHERE slug = ?`, spaFallback, quotaMegabytes, siteSlug)
+	if err != nil {
+		return fmt.Errorf("call database: %w", err)
+	}
+
+	if n, err := res.RowsAffected(); err != nil {
+		return fmt.Errorf("get number of affected rows: %w", err)
+	} else if n == 0 {
+		return ErrInvalidSlug
+	}
+
+	if err := c.validateRoutes(tx); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("commit transaction: %w", err)
+	}
+
+	c.scheduleRouteRebuild()
+
+	return nil
+}
+
+// SetSiteRateLimits limits how quickly a site can be accessed. requests is the number of requests that each client IP
+// address can make per second and bandwidthKilobytes is the number of kilobytes per second the site can send across
+// all clients. Requests over either limit are rejected with a 429 status. Zero means no limit.
+func (c *Core) SetSiteRateLimits(siteSlug string, requests, bandwidthKilobytes int) error {
+	if requests < 0 || bandwidthKilobytes < 0 {
+		return ErrInvalidLimit
+	}
+
+	tx, err := c.Database.Beginx()
+	if err != nil {
+		return fmt.Errorf("begin transaction: %w", err)
 	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec(`UPDATE sites SET rate_limit_requests = ?, rate_limit_bandwidth_kilobytes = ? WHERE slug = ?`, requests, bandwidthKilobytes, siteSlug)
+	if err != nil {
+		return fmt.Errorf("call database: %w", err)
+	}
+
+	if n, err := res.RowsAffected(); err != nil {
+		return fmt.Errorf("get number of affected rows: %w", err)
+	} else if n == 0 {
+		return ErrInvalidSlug
+	}
+
+	if err := c.validateRoutes(tx); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("commit transaction: %w", err)
+	}
+
+	c.scheduleRouteRebuild()
 
 	return nil
 }
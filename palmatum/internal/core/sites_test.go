@@ -0,0 +1,101 @@
+package core
+
+import (
+	"errors"
+	"git.tdpain.net/codemicro/palmatum/palmatum/internal/database"
+	"testing"
+)
+
+func TestUpdateSiteSettings(t *testing.T) {
+	c := newTestCore(t)
+
+	if _, err := c.CreateSite("site"); err != nil {
+		t.Fatal(err)
+	}
+
+	settings := func() (bool, int) {
+		t.Helper()
+		site, err := database.GetSite(c.Database, "site")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return site.SPAFallback, site.QuotaMegabytes
+	}
+
+	quota := 5
+	if err := c.UpdateSiteSettings("missing", true, &quota); !errors.Is(err, ErrInvalidSlug) {
+		t.Fatalf("expected ErrInvalidSlug, got %v", err)
+	}
+
+	negative := -1
+	if err := c.UpdateSiteSettings("site", true, &negative); !errors.Is(err, ErrInvalidLimit) {
+		t.Fatalf("expected ErrInvalidLimit, got %v", err)
+	}
+	if spa, q := settings(); spa || q != 0 {
+		t.Fatalf("settings changed by an invalid quota: SPA fallback %v, quota %d", spa, q)
+	}
+
+	if err := c.UpdateSiteSettings("site", true, &quota); err != nil {
+		t.Fatal(err)
+	}
+	if spa, q := settings(); !spa || q != 5 {
+		t.Fatalf("unexpected settings: SPA fallback %v, quota %d", spa, q)
+	}
+
+	// Leaving the quota out doesn't reset it
+	if err := c.UpdateSiteSettings("site", false, nil); err != nil {
+		t.Fatal(err)
+	}
+	if spa, q := settings(); spa || q != 5 {
+		t.Fatalf("unexpected settings: SPA fallback %v, quota %d", spa, q)
+	}
+
+	// Nothing is changed if Caddy rejects the new config
+	c.caddy.mu.Lock()
+	c.caddy.rejectAdapt = true
+	c.caddy.mu.Unlock()
+	quota = 10
+	var e *Error
+	if err := c.UpdateSiteSettings("site", true, &quota); !errors.As(err, &e) {
+		t.Fatalf("expected a rejection, got %v", err)
+	}
+	if spa, q := settings(); spa || q != 5 {
+		t.Fatalf("settings changed by a rejected update: SPA fallback %v, quota %d", spa, q)
+	}
+}
+
+func TestRejectedDeletesChangeNothing(t *testing.T) {
+	c := newTestCore(t)
+
+	if _, err := c.CreateSite("site"); err != nil {
+		t.Fatal(err)
+	}
+	route, err := c.CreateRoute("site", "example.com", "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c.caddy.mu.Lock()
+	c.caddy.rejectAdapt = true
+	c.caddy.mu.Unlock()
+
+	// Rejections are Palmatum errors, so that they're shown to the user instead of being treated as server errors
+	var e *Error
+	if err := c.DeleteRoute(route.ID); !errors.As(err, &e) {
+		t.Fatalf("expected a rejection, got %v", err)
+	}
+	if err := c.DeleteSite("site"); !errors.As(err, &e) {
+		t.Fatalf("expected a rejection, got %v", err)
+	}
+
+	if _, err := database.GetSite(c.Database, "site"); err != nil {
+		t.Errorf("site deleted by a rejected change: %v", err)
+	}
+	var routes int
+	if err := c.Database.Get(&routes, `SELECT COUNT(*) FROM routes WHERE id = ?`, route.ID); err != nil {
+		t.Fatal(err)
+	}
+	if routes != 1 {
+		t.Error("route deleted by a rejected change")
+	}
+}
@@ -0,0 +1,142 @@
+package core
+
+import (
+	"archive/zip"
+	"errors"
+	"fmt"
+	"git.tdpain.net/codemicro/palmatum/palmatum/internal/database"
+	"github.com/jmoiron/sqlx"
+	"os"
+)
+
+var (
+	ErrSiteQuotaExceeded  = newError("site storage quota exceeded")
+	ErrTotalQuotaExceeded = newError("total storage quota exceeded")
+)
+
+// megabyte is the unit that quotas are set in, which matches how the maximum upload size is set.
+const megabyte = 1000 * 1000
+
+// archiveSize is the amount of space taken up by a site archive, in bytes.
+type archiveSize struct {
+	compressed   int64
+	uncompressed int64
+}
+
+// measureSiteArchive checks that fname is a valid ZIP file and returns how big it is.
+func measureSiteArchive(fname string) (*archiveSize, error) {
+	zr, err := zip.OpenReader(fname)
+	if err != nil {
+		if errors.Is(err, zip.ErrFormat) {
+			return nil, ErrInvalidArchive
+		}
+		return nil, fmt.Errorf("open archive: %w", err)
+	}
+	defer zr.Close()
+
+	fi, err := os.Stat(fname)
+	if err != nil {
+		return nil, fmt.Errorf("stat archive: %w", err)
+	}
+
+	size := &archiveSize{compressed: fi.Size()}
+	for _, f := range zr.File {
+		size.uncompressed += int64(f.UncompressedSize64)
+	}
+
+	return size, nil
+}
+
+// siteQuota returns the number of bytes that the content of site can take up, or zero if there's no limit.
+func (c *Core) siteQuota(site *database.SiteModel) int64 {
+	if site.QuotaMegabytes != 0 {
+		return int64(site.QuotaMegabytes) * megabyte
+	}
+	return int64(c.Config.Platform.SiteQuotaMegabytes) * megabyte
+}
+
+// checkStorageQuota returns an error if replacing the content of a site with size bytes would take it, or every site
+// together, over quota. db may be a transaction.
+func (c *Core) checkStorageQuota(db sqlx.Queryer, siteSlug string, size int64) error {
+	site, err := database.GetSite(db, siteSlug)
+	if err != nil {
+		return fmt.Errorf("get site: %w", err)
+	}
+
+	if quota := c.siteQuota(site); quota != 0 && size > quota {
+		return ErrSiteQuotaExceeded
+	}
+
+	if c.Config.Platform.TotalQuotaMegabytes != 0 {
+		var others int64
+		if err := db.QueryRowx(`SELECT coalesce(sum(content_size), 0) FROM sites WHERE slug != ?`, siteSlug).Scan(&others); err != nil {
+			return fmt.Errorf("get total storage usage: %w", err)
+		}
+		if others+size > int64(c.Config.Platform.TotalQuotaMegabytes)*megabyte {
+			return ErrTotalQuotaExceeded
+		}
+	}
+
+	return nil
+}
+
+// SiteStorageUsage is the amount of space taken up by the content of a site, in bytes.
+type SiteStorageUsage struct {
+	Size             int64 `json:"size"`
+	UncompressedSize int64 `json:"uncompressedSize"`
+	Quota            int64 `json:"quota"` // zero if there's no limit
+}
+
+// StorageUsage is the amount of space taken up by the content of every site, in bytes.
+type StorageUsage struct {
+	Size             int64                        `json:"size"`
+	UncompressedSize int64                        `json:"uncompressedSize"`
+	Quota            int64                        `json:"quota"` // zero if there's no limit
+	Sites            map[string]*SiteStorageUsage `json:"sites"`
+}
+
+func (c *Core) GetStorageUsage() (*StorageUsage, error) {
+	sites, err := database.GetSites(c.Database)
+	if err != nil {
+		return nil, fmt.Errorf("get sites: %w", err)
+	}
+
+	usage := &StorageUsage{
+		Quota: int64(c.Config.Platform.TotalQuotaMegabytes) * megabyte,
+		Sites: make(map[string]*SiteStorageUsage),
+	}
+
+	for _, site := range sites {
+		usage.Size += site.ContentSize
+		usage.UncompressedSize += site.ContentUncompressedSize
+		usage.Sites[site.Slug] = &SiteStorageUsage{
+			Size:             site.ContentSize,
+			UncompressedSize: site.ContentUncompressedSize,
+			Quota:            c.siteQuota(site),
+		}
+	}
+
+	return usage, nil
+}
+
+// measureExistingContent records the size of any site content that was deployed before sizes were recorded.
+func (c *Core) measureExistingContent() error {
+	var sites []*database.SiteModel
+	if err := c.Database.Select(&sites, `SELECT * FROM sites WHERE content_path != '' AND content_size = 0`); err != nil {
+		return fmt.Errorf("get sites: %w", err)
+	}
+
+	for _, site := range sites {
+		size, err := measureSiteArchive(c.getPathOnDisk(site.ContentPath))
+		if err != nil {
+			c.Logger.Warn("unable to measure site content", "error", err, "site", site.Slug, "path", site.ContentPath)
+			continue
+		}
+
+		if _, err := c.Database.Exec(`UPDATE sites SET content_size = ?, content_uncompressed_size = ? WHERE slug = ?`, size.compressed, size.uncompressed, site.Slug); err != nil {
+			return fmt.Errorf("record size of site content: %w", err)
+		}
+	}
+
+	return nil
+}
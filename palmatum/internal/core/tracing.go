@@ -0,0 +1,22 @@
+package core
+
+import (
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const tracerName = "git.tdpain.net/codemicro/palmatum/palmatum/internal/core"
+
+func siteAttribute(siteSlug string) attribute.KeyValue {
+	return attribute.String("palmatum.site", siteSlug)
+}
+
+// endSpan records err against span, if it's not nil, and ends span.
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
@@ -0,0 +1,79 @@
+package core
+
+import (
+	"bytes"
+	"context"
+	"git.tdpain.net/codemicro/palmatum/palmatum/internal/database"
+	"go.opentelemetry.io/otel/codes"
+	"slices"
+	"testing"
+)
+
+func TestDeployTracing(t *testing.T) {
+	c := newTestCore(t)
+	runJobWorkers(t, c)
+
+	if _, err := c.CreateSite("site"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.CreateRoute("site", "example.com", "/"); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.WaitForRoutes(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	c.spans.Reset()
+
+	// This stands in for the span of the management request that uploaded the archive
+	ctx, request := c.tracer.Start(context.Background(), "management request")
+	job, err := c.DeploySiteArchive(ctx, "site", bytes.NewReader(mkzip(t, map[string]string{"index.html": "hello"})), nil)
+	request.End()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if job = waitJob(t, c, job.ID); job.Status != database.JobStatusSucceeded {
+		t.Fatalf("deploy failed: %s", job.Result)
+	}
+	if err := c.WaitForRoutes(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	traceID := request.SpanContext().TraceID()
+	var (
+		inTrace       []string
+		rebuildLinked bool
+		loadTraced    bool
+	)
+	for _, span := range c.spans.GetSpans() {
+		if span.SpanContext.TraceID() == traceID {
+			inTrace = append(inTrace, span.Name)
+		}
+		if span.Status.Code == codes.Error {
+			t.Errorf("span %s failed: %s", span.Name, span.Status.Description)
+		}
+
+		switch span.Name {
+		case "scheduled route rebuild":
+			for _, link := range span.Links {
+				if link.SpanContext.TraceID() == traceID {
+					rebuildLinked = true
+				}
+			}
+		case "Caddy admin API POST /load":
+			loadTraced = span.Parent.IsValid()
+		}
+	}
+
+	// The job runs in the background, but is still part of the trace of the request that queued it
+	for _, name := range []string{"DeploySiteArchive", "IngestSiteArchive", "job deploy", "UpdateContentPath", "validateRoutes", "Caddy admin API POST /adapt", "sql.conn.exec"} {
+		if !slices.Contains(inTrace, name) {
+			t.Errorf("span %q missing from trace, which has %v", name, inTrace)
+		}
+	}
+	if !rebuildLinked {
+		t.Error("route rebuild isn't linked to the deploy")
+	}
+	if !loadTraced {
+		t.Error("request to load the Caddy config wasn't traced")
+	}
+}
@@ -0,0 +1,323 @@
+package core
+
+import (
+	"context"
+	"crypto/hmac"
+	"database/sql"
+	"errors"
+	"fmt"
+	"git.tdpain.net/codemicro/palmatum/palmatum/internal/database"
+	"github.com/coreos/go-oidc/v3/oidc"
+	"golang.org/x/oauth2"
+	"slices"
+	"strings"
+	"time"
+)
+
+var (
+	ErrInvalidRole            = newError("invalid role")
+	ErrUserNotFound           = newError("user not found")
+	ErrManagementAuthDisabled = newError("login is not enabled for the management UI")
+	ErrNoRole                 = newError("you have not been assigned a role")
+)
+
+// Role is the level of access that a user has to the management UI. Each role includes the permissions of the roles
+// below it.
+type Role string
+
+const (
+	RoleNone     Role = ""
+	RoleReadOnly Role = "read-only"
+	RoleDeployer Role = "deployer"
+	RoleAdmin    Role = "admin"
+)
+
+// Roles is every assignable role, from least to most privileged.
+var Roles = []Role{RoleReadOnly, RoleDeployer, RoleAdmin}
+
+func ParseRole(s string) (Role, error) {
+	r := Role(strings.TrimSpace(s))
+	if r == RoleNone || slices.Contains(Roles, r) {
+		return r, nil
+	}
+	return RoleNone, ErrInvalidRole
+}
+
+func (r Role) rank() int {
+	return slices.Index(Roles, r) + 1
+}
+
+// Includes returns true if r grants at least the permissions of other.
+func (r Role) Includes(other Role) bool {
+	return r.rank() >= other.rank()
+}
+
+func maxRole(roles ...Role) Role {
+	var res Role
+	for _, r := range roles {
+		if r.rank() > res.rank() {
+			res = r
+		}
+	}
+	return res
+}
+
+const (
+	ManagementSessionCookieName    = "palmatum_management_session"
+	ManagementLoginNonceCookieName = "palmatum_management_login_nonce"
+
+	ManagementSessionDuration = time.Hour * 12
+)
+
+// ManagementSession is the content of a session cookie issued to a user that has logged in to the management UI.
+// GroupRole is the role granted by the user's OIDC groups when they logged in, which is kept in the session because the
+// groups can't be checked again without the user logging in again.
+type ManagementSession struct {
+	UserID    int   `json:"uid"`
+	GroupRole Role  `json:"grp,omitempty"`
+	Expires   int64 `json:"exp"`
+}
+
+type managementLoginState struct {
+	Management bool   `json:"mgmt"`
+	ReturnTo   string `json:"ret"`
+	Nonce      string `json:"nonce"`
+	Expires    int64  `json:"exp"`
+}
+
+// User is a logged in user of the management UI along with the role that's currently in effect for them.
+type User struct {
+	*database.UserModel
+	EffectiveRole Role
+}
+
+// Identifier returns the user's email address if they have one, or their OIDC subject if they don't.
+func (u *User) Identifier() string {
+	if u.Email != "" {
+		return u.Email
+	}
+	return u.Subject
+}
+
+func (c *Core) managementOIDCConfig(ctx context.Context, redirectURL string) (*oidc.Provider, *oauth2.Config, error) {
+	ma := c.Config.ManagementAuth
+	if !ma.Enabled() {
+		return nil, nil, ErrManagementAuthDisabled
+	}
+
+	provider, err := c.getOIDCProvider(ctx, ma.OIDCIssuer)
+	if err != nil {
+		return nil, nil, fmt.Errorf("get OIDC provider: %w", err)
+	}
+
+	return provider, oauth2Config(ma.OIDCClientID, ma.OIDCClientSecret, provider, redirectURL), nil
+}
+
+// groupRole returns the most privileged role granted by any of the given OIDC groups.
+func (c *Core) groupRole(groups []string) Role {
+	ma := c.Config.ManagementAuth
+	var res Role
+	for role, roleGroups := range map[Role]string{
+		RoleAdmin:    ma.AdminGroups,
+		RoleDeployer: ma.DeployerGroups,
+		RoleReadOnly: ma.ReadOnlyGroups,
+	} {
+		for _, g := range splitList(roleGroups) {
+			if slices.Contains(groups, g) {
+				res = maxRole(res, role)
+			}
+		}
+	}
+	return res
+}
+
+// effectiveRole works out the role that's in effect for a user. Roles granted by groups and by admins are combined,
+// and the configured default role is used as a floor.
+func (c *Core) effectiveRole(user *database.UserModel, groupRole Role) Role {
+	defaultRole, _ := ParseRole(c.Config.ManagementAuth.DefaultRole)
+	return maxRole(groupRole, Role(user.Role), defaultRole)
+}
+
+// BeginManagementLogin starts the login process for a user of the management UI. redirectURL is the callback URL that
+// the identity provider should send the user back to and returnTo is the path the user should end up at once they've
+// logged in.
+//
+// The returned nonce should be stored in the ManagementLoginNonceCookieName cookie, and the user should be redirected
+// to the returned URL.
+func (c *Core) BeginManagementLogin(ctx context.Context, redirectURL, returnTo string) (authURL string, nonce string, err error) {
+	_, conf, err := c.managementOIDCConfig(ctx, redirectURL)
+	if err != nil {
+		return "", "", err
+	}
+
+	nonce, err = generateNonce()
+	if err != nil {
+		return "", "", fmt.Errorf("generate nonce: %w", err)
+	}
+
+	state, err := c.signValue(signedManagementLoginState, &managementLoginState{
+		Management: true,
+		ReturnTo:   localPath(returnTo),
+		Nonce:      nonce,
+		Expires:    time.Now().Add(siteLoginDuration).Unix(),
+	})
+	if err != nil {
+		return "", "", fmt.Errorf("sign state: %w", err)
+	}
+
+	return conf.AuthCodeURL(state, oidc.Nonce(nonce)), nonce, nil
+}
+
+// CompleteManagementLogin finishes the login process started by BeginManagementLogin. The user is created if this is
+// the first time they've logged in. A signed session is returned that should be stored in the
+// ManagementSessionCookieName cookie, as well as the path to send the user back to.
+func (c *Core) CompleteManagementLogin(ctx context.Context, state, code, nonce, redirectURL string) (token string, user *User, returnTo string, err error) {
+	loginState := new(managementLoginState)
+	if err := c.verifySignedValue(signedManagementLoginState, state, loginState); err != nil {
+		return "", nil, "", ErrInvalidSession
+	}
+
+	if !loginState.Management || time.Now().Unix() > loginState.Expires || nonce == "" || !hmac.Equal([]byte(nonce), []byte(loginState.Nonce)) {
+		return "", nil, "", ErrInvalidSession
+	}
+
+	provider, conf, err := c.managementOIDCConfig(ctx, redirectURL)
+	if err != nil {
+		return "", nil, "", err
+	}
+
+	idToken, claims, err := exchangeOIDCCode(ctx, provider, conf, code, loginState.Nonce)
+	if err != nil {
+		return "", nil, "", err
+	}
+
+	now := time.Now().Unix()
+
+	tx, err := c.Database.Beginx()
+	if err != nil {
+		return "", nil, "", fmt.Errorf("begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	userModel, err := database.GetUserBySubject(tx, idToken.Subject)
+	if err != nil {
+		if !errors.Is(err, sql.ErrNoRows) {
+			return "", nil, "", fmt.Errorf("get user: %w", err)
+		}
+		userModel = &database.UserModel{
+			Subject:   idToken.Subject,
+			CreatedAt: now,
+		}
+	}
+
+	groupRole := c.groupRole(claims.Groups)
+	role := c.effectiveRole(userModel, groupRole)
+
+	userModel.Email = claims.Email
+	userModel.Name = claims.Name
+	userModel.LoginRole = string(role)
+	userModel.LastLoginAt = now
+
+	if userModel.ID == 0 {
+		res, err := tx.NamedExec(`INSERT INTO users(subject, email, name, role, login_role, created_at, last_login_at) VALUES (:subject, :email, :name, :role, :login_role, :created_at, :last_login_at)`, userModel)
+		if err != nil {
+			return "", nil, "", fmt.Errorf("create user: %w", err)
+		}
+		id, err := res.LastInsertId()
+		if err != nil {
+			return "", nil, "", fmt.Errorf("get new user ID: %w", err)
+		}
+		userModel.ID = int(id)
+	} else {
+		if _, err := tx.NamedExec(`UPDATE users SET email = :email, name = :name, login_role = :login_role, last_login_at = :last_login_at WHERE id = :id`, userModel); err != nil {
+			return "", nil, "", fmt.Errorf("update user: %w", err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return "", nil, "", fmt.Errorf("commit transaction: %w", err)
+	}
+
+	// Users without a role are still recorded so that an admin can assign them one.
+	if role == RoleNone {
+		return "", nil, "", ErrNoRole
+	}
+
+	token, err = c.signValue(signedManagementSession, &ManagementSession{
+		UserID:    userModel.ID,
+		GroupRole: groupRole,
+		Expires:   time.Now().Add(ManagementSessionDuration).Unix(),
+	})
+	if err != nil {
+		return "", nil, "", fmt.Errorf("sign session: %w", err)
+	}
+
+	return token, &User{UserModel: userModel, EffectiveRole: role}, loginState.ReturnTo, nil
+}
+
+// CheckManagementSession validates a management UI session cookie and returns the user it belongs to. The user is
+// loaded from the database on every call so that role changes and deletions take effect immediately.
+func (c *Core) CheckManagementSession(cookieValue string) (*User, error) {
+	sess := new(ManagementSession)
+	if err := c.verifySignedValue(signedManagementSession, cookieValue, sess); err != nil {
+		return nil, ErrInvalidSession
+	}
+
+	if sess.UserID == 0 || time.Now().Unix() > sess.Expires {
+		return nil, ErrInvalidSession
+	}
+
+	userModel, err := database.GetUser(c.Database, sess.UserID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrInvalidSession
+		}
+		return nil, fmt.Errorf("get user: %w", err)
+	}
+
+	role := c.effectiveRole(userModel, sess.GroupRole)
+	if role == RoleNone {
+		return nil, ErrNoRole
+	}
+
+	return &User{UserModel: userModel, EffectiveRole: role}, nil
+}
+
+// SetUserRole assigns a role to a user. Roles granted by a user's OIDC groups or by the default role still apply,
+// so an empty role only removes the role that's been assigned by an admin.
+func (c *Core) SetUserRole(userID int, role string) error {
+	r, err := ParseRole(role)
+	if err != nil {
+		return err
+	}
+
+	res, err := c.Database.Exec(`UPDATE users SET role = ? WHERE id = ?`, string(r), userID)
+	if err != nil {
+		return fmt.Errorf("call database: %w", err)
+	}
+
+	if n, err := res.RowsAffected(); err != nil {
+		return fmt.Errorf("get number of affected rows: %w", err)
+	} else if n == 0 {
+		return ErrUserNotFound
+	}
+
+	return nil
+}
+
+// DeleteUser removes a user, which immediately invalidates any sessions they have. If they're still able to log in
+// with the identity provider, they'll be recreated the next time they do.
+func (c *Core) DeleteUser(userID int) error {
+	res, err := c.Database.Exec(`DELETE FROM users WHERE id = ?`, userID)
+	if err != nil {
+		return fmt.Errorf("call database: %w", err)
+	}
+
+	if n, err := res.RowsAffected(); err != nil {
+		return fmt.Errorf("get number of affected rows: %w", err)
+	} else if n == 0 {
+		return ErrUserNotFound
+	}
+
+	return nil
+}
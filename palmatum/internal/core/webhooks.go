@@ -0,0 +1,263 @@
+package core
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"git.tdpain.net/codemicro/palmatum/palmatum/internal/database"
+	"io"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	ErrInvalidWebhookURL = newError("invalid webhook URL")
+	ErrInvalidEvent      = newError("invalid event type")
+	ErrWebhookNotFound   = newError("webhook not found")
+)
+
+const (
+	EventSiteCreated  = "site.created"
+	EventSiteDeleted  = "site.deleted"
+	EventSiteDeployed = "site.deployed"
+	EventRouteCreated = "route.created"
+	EventRouteDeleted = "route.deleted"
+)
+
+// WebhookEvents is every event that can be subscribed to.
+var WebhookEvents = []string{EventSiteCreated, EventSiteDeleted, EventSiteDeployed, EventRouteCreated, EventRouteDeleted}
+
+const (
+	WebhookEventHeader     = "X-Palmatum-Event"
+	WebhookDeliveryHeader  = "X-Palmatum-Delivery"
+	WebhookSignatureHeader = "X-Palmatum-Signature-256"
+
+	webhookMaxAttempts      = 6
+	webhookInitialBackoff   = time.Second * 30
+	webhookPollInterval     = time.Second * 15
+	webhookTimeout          = time.Second * 10
+	webhookMaxResponseBytes = 1024
+)
+
+// Event is the body of a webhook delivery.
+type Event struct {
+	Type      string               `json:"event"`
+	Timestamp int64                `json:"timestamp"`
+	Site      string               `json:"site,omitempty"`
+	Route     *database.RouteModel `json:"route,omitempty"`
+	Commit    string               `json:"commit,omitempty"`
+}
+
+// webhookDispatcher holds the state used to deliver webhooks in the background.
+type webhookDispatcher struct {
+	wake   chan struct{}
+	client *http.Client
+}
+
+// CreateWebhook subscribes a URL to the given events. If events is empty, the webhook receives every event.
+func (c *Core) CreateWebhook(webhookURL string, events []string, secret string) (*database.WebhookModel, error) {
+	webhookURL = strings.TrimSpace(webhookURL)
+	if u, err := url.Parse(webhookURL); err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+		return nil, ErrInvalidWebhookURL
+	}
+
+	for _, e := range events {
+		if !slices.Contains(WebhookEvents, e) {
+			return nil, ErrInvalidEvent
+		}
+	}
+
+	wh := &database.WebhookModel{
+		URL:       webhookURL,
+		Events:    strings.Join(events, " "),
+		Secret:    secret,
+		CreatedAt: time.Now().Unix(),
+	}
+
+	if err := c.Database.QueryRowx(`INSERT INTO webhooks(url, events, secret, created_at) VALUES (?, ?, ?, ?) RETURNING id`, wh.URL, wh.Events, wh.Secret, wh.CreatedAt).Scan(&wh.ID); err != nil {
+		return nil, fmt.Errorf("call database: %w", err)
+	}
+
+	return wh, nil
+}
+
+func (c *Core) DeleteWebhook(id int) error {
+	tx, err := c.Database.Beginx()
+	if err != nil {
+		return fmt.Errorf("begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`DELETE FROM webhook_deliveries WHERE webhook = ?`, id); err != nil {
+		return fmt.Errorf("delete deliveries: %w", err)
+	}
+
+	res, err := tx.Exec(`DELETE FROM webhooks WHERE id = ?`, id)
+	if err != nil {
+		return fmt.Errorf("delete webhook: %w", err)
+	}
+
+	if n, err := res.RowsAffected(); err != nil {
+		return fmt.Errorf("get number of affected rows: %w", err)
+	} else if n == 0 {
+		return ErrWebhookNotFound
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("commit transaction: %w", err)
+	}
+
+	return nil
+}
+
+// emitEvent queues an event for delivery to every webhook that's subscribed to it. Errors are logged instead of being
+// returned, since the action that caused the event has already happened by the time this is called.
+func (c *Core) emitEvent(event *Event) {
+	event.Timestamp = time.Now().Unix()
+
+	payload, err := json.Marshal(event)
+	if err != nil {
+		c.Logger.Error("unable to encode webhook event", "error", err, "event", event.Type)
+		return
+	}
+
+	webhooks, err := database.GetWebhooks(c.Database)
+	if err != nil {
+		c.Logger.Error("unable to get webhooks", "error", err, "event", event.Type)
+		return
+	}
+
+	var queued bool
+	for _, wh := range webhooks {
+		if wh.Events != "" && !slices.Contains(strings.Split(wh.Events, " "), event.Type) {
+			continue
+		}
+
+		_, err := c.Database.Exec(`INSERT INTO webhook_deliveries(webhook, event, payload, status, created_at, next_attempt_at) VALUES (?, ?, ?, ?, ?, ?)`, wh.ID, event.Type, string(payload), database.WebhookDeliveryPending, event.Timestamp, event.Timestamp)
+		if err != nil {
+			c.Logger.Error("unable to queue webhook delivery", "error", err, "event", event.Type, "webhook", wh.ID)
+			continue
+		}
+		queued = true
+	}
+
+	if queued {
+		select {
+		case c.webhooks.wake <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// runWebhookWorker delivers queued webhooks until ctx is cancelled.
+func (c *Core) runWebhookWorker(ctx context.Context) {
+	ticker := time.NewTicker(webhookPollInterval)
+	defer ticker.Stop()
+
+	for {
+		if err := c.deliverPendingWebhooks(ctx); err != nil {
+			c.Logger.Error("unable to deliver webhooks", "error", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-c.webhooks.wake:
+		}
+	}
+}
+
+type pendingDelivery struct {
+	database.WebhookDeliveryModel
+	URL    string `db:"url"`
+	Secret string `db:"secret"`
+}
+
+func (c *Core) deliverPendingWebhooks(ctx context.Context) error {
+	var pending []*pendingDelivery
+	if err := c.Database.Select(&pending, `SELECT webhook_deliveries.*, webhooks.url, webhooks.secret FROM webhook_deliveries JOIN webhooks ON webhook_deliveries.webhook = webhooks.id WHERE status = ? AND next_attempt_at <= ? ORDER BY webhook_deliveries.id LIMIT 50`, database.WebhookDeliveryPending, time.Now().Unix()); err != nil {
+		return fmt.Errorf("get pending deliveries: %w", err)
+	}
+
+	for _, d := range pending {
+		if ctx.Err() != nil {
+			return nil
+		}
+
+		status, body, err := c.sendWebhook(ctx, d)
+
+		d.Attempts += 1
+		d.LastAttemptAt = time.Now().Unix()
+		d.ResponseStatus = status
+		d.ResponseBody = body
+		d.Error = ""
+
+		if err == nil && status >= 200 && status < 300 {
+			d.Status = database.WebhookDeliverySucceeded
+		} else {
+			if err != nil {
+				d.Error = err.Error()
+			} else {
+				d.Error = fmt.Sprintf("unexpected status %d", status)
+			}
+
+			if d.Attempts >= webhookMaxAttempts {
+				d.Status = database.WebhookDeliveryFailed
+			} else {
+				d.NextAttemptAt = d.LastAttemptAt + int64((webhookInitialBackoff << (d.Attempts - 1)).Seconds())
+			}
+			c.Logger.Warn("webhook delivery failed", "delivery", d.ID, "webhook", d.Webhook, "attempt", d.Attempts, "error", d.Error)
+		}
+
+		_, err = c.Database.NamedExec(`UPDATE webhook_deliveries SET status = :status, attempts = :attempts, response_status = :response_status, response_body = :response_body, error = :error, last_attempt_at = :last_attempt_at, next_attempt_at = :next_attempt_at WHERE id = :id`, &d.WebhookDeliveryModel)
+		if err != nil {
+			return fmt.Errorf("update delivery %d: %w", d.ID, err)
+		}
+	}
+
+	return nil
+}
+
+// SignWebhookPayload returns the value of the signature header for a payload. Receivers can verify a delivery by
+// computing the same value with their copy of the secret.
+func SignWebhookPayload(secret string, payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(payload)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func (c *Core) sendWebhook(ctx context.Context, d *pendingDelivery) (status int, body string, err error) {
+	ctx, cancel := context.WithTimeout(ctx, webhookTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, d.URL, bytes.NewReader([]byte(d.Payload)))
+	if err != nil {
+		return 0, "", err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "Palmatum-Webhook")
+	req.Header.Set(WebhookEventHeader, d.Event)
+	req.Header.Set(WebhookDeliveryHeader, strconv.Itoa(d.ID))
+	if d.Secret != "" {
+		req.Header.Set(WebhookSignatureHeader, SignWebhookPayload(d.Secret, []byte(d.Payload)))
+	}
+
+	resp, err := c.webhooks.client.Do(req)
+	if err != nil {
+		return 0, "", err
+	}
+	defer resp.Body.Close()
+
+	b, _ := io.ReadAll(io.LimitReader(resp.Body, webhookMaxResponseBytes))
+	return resp.StatusCode, string(b), nil
+}
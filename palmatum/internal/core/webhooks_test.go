@@ -0,0 +1,268 @@
+package core
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"git.tdpain.net/codemicro/palmatum/palmatum/internal/database"
+	"io"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"sync"
+	"testing"
+)
+
+// webhookReceiver records the deliveries that it receives. It responds with 500 Internal Server Error while failing
+// is set.
+type webhookReceiver struct {
+	*httptest.Server
+
+	mu         sync.Mutex
+	deliveries []*receivedWebhook
+	failing    bool
+}
+
+type receivedWebhook struct {
+	header http.Header
+	body   []byte
+	event  *Event
+}
+
+func newWebhookReceiver(t *testing.T) *webhookReceiver {
+	r := new(webhookReceiver)
+	r.Server = httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, rq *http.Request) {
+		body, _ := io.ReadAll(rq.Body)
+		event := new(Event)
+		if err := json.Unmarshal(body, event); err != nil {
+			t.Errorf("decode webhook payload: %v", err)
+		}
+
+		r.mu.Lock()
+		defer r.mu.Unlock()
+
+		r.deliveries = append(r.deliveries, &receivedWebhook{header: rq.Header.Clone(), body: body, event: event})
+		if r.failing {
+			rw.WriteHeader(http.StatusInternalServerError)
+			_, _ = rw.Write([]byte("receiver unavailable"))
+			return
+		}
+		_, _ = rw.Write([]byte("ok"))
+	}))
+	t.Cleanup(r.Close)
+	return r
+}
+
+func (r *webhookReceiver) received() []*receivedWebhook {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]*receivedWebhook(nil), r.deliveries...)
+}
+
+func (r *webhookReceiver) setFailing(failing bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.failing = failing
+}
+
+func TestWebhookEvents(t *testing.T) {
+	const testCommitSHA = "0123456789abcdef0123456789abcdef01234567"
+	c := newTestCore(t)
+	ctx := context.Background()
+	receiver := newWebhookReceiver(t)
+
+	if _, err := c.CreateWebhook("ftp://example.com", nil, ""); !errors.Is(err, ErrInvalidWebhookURL) {
+		t.Fatalf("expected ErrInvalidWebhookURL, got %v", err)
+	}
+	if _, err := c.CreateWebhook(receiver.URL, []string{"site.renamed"}, ""); !errors.Is(err, ErrInvalidEvent) {
+		t.Fatalf("expected ErrInvalidEvent, got %v", err)
+	}
+
+	all, err := c.CreateWebhook(receiver.URL, nil, "all secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	deploys, err := c.CreateWebhook(receiver.URL, []string{EventSiteDeployed}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	deploy := func(info *DeploymentInfo) {
+		t.Helper()
+		contentPath, err := c.IngestSiteArchive(ctx, bytes.NewReader(mkzip(t, map[string]string{"index.html": "hello"})))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.releaseIngestedArchive(contentPath)
+		if err := c.UpdateContentPath(ctx, "blog", contentPath, info); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, err := c.CreateSite("blog"); err != nil {
+		t.Fatal(err)
+	}
+	route, err := c.CreateRoute("blog", "blog.example.com", "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	deploy(nil)
+	deploy(&DeploymentInfo{Source: DeploymentSourceGit, CommitSHA: testCommitSHA})
+	if err := c.DeleteRoute(route.ID); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.DeleteSite("blog"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := c.deliverPendingWebhooks(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	var allEvents, deployEvents []string
+	deployedCommits := make(map[string]int)
+	for _, d := range receiver.received() {
+		if d.header.Get("Content-Type") != "application/json" || d.header.Get(WebhookEventHeader) != d.event.Type || d.header.Get(WebhookDeliveryHeader) == "" || d.event.Timestamp == 0 {
+			t.Errorf("unexpected delivery headers %v for %s", d.header, d.body)
+		}
+
+		if sig := d.header.Get(WebhookSignatureHeader); sig != "" {
+			if sig != SignWebhookPayload("all secret", d.body) {
+				t.Errorf("invalid signature %q for %s", sig, d.body)
+			}
+			allEvents = append(allEvents, d.event.Type)
+		} else {
+			deployEvents = append(deployEvents, d.event.Type)
+		}
+
+		if d.event.Site != "blog" {
+			t.Errorf("expected event for blog, got %s", d.body)
+		}
+		if d.event.Type == EventRouteCreated && (d.event.Route == nil || d.event.Route.Domain != "blog.example.com") {
+			t.Errorf("route missing from %s", d.body)
+		}
+		if d.event.Type == EventSiteDeployed {
+			deployedCommits[d.event.Commit] += 1
+		}
+	}
+
+	if want := []string{EventSiteCreated, EventRouteCreated, EventSiteDeployed, EventSiteDeployed, EventRouteDeleted, EventSiteDeleted}; !slices.Equal(allEvents, want) {
+		t.Errorf("expected events %v, got %v", want, allEvents)
+	}
+	if want := []string{EventSiteDeployed, EventSiteDeployed}; !slices.Equal(deployEvents, want) {
+		t.Errorf("expected events %v, got %v", want, deployEvents)
+	}
+	// Each webhook is told about the upload and the deployment from Git
+	if want := map[string]int{"": 2, testCommitSHA: 2}; !maps.Equal(deployedCommits, want) {
+		t.Errorf("expected deployed commits %v, got %v", want, deployedCommits)
+	}
+
+	for _, wh := range []*database.WebhookModel{all, deploys} {
+		deliveries, err := database.GetWebhookDeliveries(c.Database, wh.ID, 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, d := range deliveries {
+			if d.Status != database.WebhookDeliverySucceeded || d.Attempts != 1 || d.ResponseStatus != http.StatusOK || d.ResponseBody != "ok" {
+				t.Errorf("unexpected delivery %+v", d)
+			}
+		}
+	}
+
+	if err := c.DeleteWebhook(all.ID); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.DeleteWebhook(all.ID); !errors.Is(err, ErrWebhookNotFound) {
+		t.Fatalf("expected ErrWebhookNotFound, got %v", err)
+	}
+}
+
+func TestWebhookRetries(t *testing.T) {
+	c := newTestCore(t)
+	ctx := context.Background()
+	receiver := newWebhookReceiver(t)
+	receiver.setFailing(true)
+
+	wh, err := c.CreateWebhook(receiver.URL, []string{EventSiteCreated}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.CreateSite("blog"); err != nil {
+		t.Fatal(err)
+	}
+
+	delivery := func() *database.WebhookDeliveryModel {
+		t.Helper()
+		deliveries, err := database.GetWebhookDeliveries(c.Database, wh.ID, 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(deliveries) != 1 {
+			t.Fatalf("expected one delivery, got %d", len(deliveries))
+		}
+		return deliveries[0]
+	}
+
+	// retry makes the delivery due and tries to send it
+	retry := func() *database.WebhookDeliveryModel {
+		t.Helper()
+		if _, err := c.Database.Exec(`UPDATE webhook_deliveries SET next_attempt_at = 0`); err != nil {
+			t.Fatal(err)
+		}
+		if err := c.deliverPendingWebhooks(ctx); err != nil {
+			t.Fatal(err)
+		}
+		return delivery()
+	}
+
+	if err := c.deliverPendingWebhooks(ctx); err != nil {
+		t.Fatal(err)
+	}
+	d := delivery()
+	if d.Status != database.WebhookDeliveryPending || d.Attempts != 1 || d.ResponseStatus != http.StatusInternalServerError || d.ResponseBody != "receiver unavailable" || d.Error == "" {
+		t.Fatalf("unexpected delivery after first attempt %+v", d)
+	}
+	if backoff := d.NextAttemptAt - d.LastAttemptAt; backoff != int64(webhookInitialBackoff.Seconds()) {
+		t.Errorf("expected a backoff of %s, got %ds", webhookInitialBackoff, backoff)
+	}
+
+	// Deliveries aren't retried before they're due
+	if err := c.deliverPendingWebhooks(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(receiver.received()); n != 1 {
+		t.Fatalf("expected one attempt, got %d", n)
+	}
+
+	d = retry()
+	if backoff := d.NextAttemptAt - d.LastAttemptAt; d.Attempts != 2 || backoff != int64((webhookInitialBackoff*2).Seconds()) {
+		t.Errorf("expected a backoff of %s after the second attempt, got %ds", webhookInitialBackoff*2, backoff)
+	}
+
+	receiver.setFailing(false)
+	d = retry()
+	if d.Status != database.WebhookDeliverySucceeded || d.Attempts != 3 || d.ResponseStatus != http.StatusOK || d.Error != "" {
+		t.Fatalf("unexpected delivery after success %+v", d)
+	}
+
+	// Deliveries that keep failing are eventually given up on
+	receiver.setFailing(true)
+	if _, err := c.CreateSite("docs"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Database.Exec(`DELETE FROM webhook_deliveries WHERE status = ?`, database.WebhookDeliverySucceeded); err != nil {
+		t.Fatal(err)
+	}
+	for range webhookMaxAttempts {
+		d = retry()
+	}
+	if d.Status != database.WebhookDeliveryFailed || d.Attempts != webhookMaxAttempts {
+		t.Fatalf("unexpected delivery after %d attempts %+v", webhookMaxAttempts, d)
+	}
+	d = retry()
+	if d.Attempts != webhookMaxAttempts {
+		t.Fatalf("failed delivery was retried %+v", d)
+	}
+}
@@ -0,0 +1,117 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"github.com/jmoiron/sqlx"
+	"github.com/mattn/go-sqlite3"
+)
+
+// withSQLiteConn calls fn with the SQLite connection underneath conn, which may be wrapped for tracing.
+func withSQLiteConn(conn *sql.Conn, fn func(*sqlite3.SQLiteConn) error) error {
+	return conn.Raw(func(dc any) error {
+		for {
+			switch c := dc.(type) {
+			case *sqlite3.SQLiteConn:
+				return fn(c)
+			case interface{ Raw() driver.Conn }:
+				dc = c.Raw()
+			default:
+				return fmt.Errorf("unsupported database connection type %T", dc)
+			}
+		}
+	})
+}
+
+// copyDatabase copies the whole of src into dest using SQLite's online backup API. The copy is made in a single step,
+// so it's consistent even if src is being written to at the same time.
+func copyDatabase(ctx context.Context, dest, src *sql.DB) error {
+	destConn, err := dest.Conn(ctx)
+	if err != nil {
+		return fmt.Errorf("get destination connection: %w", err)
+	}
+	defer destConn.Close()
+
+	srcConn, err := src.Conn(ctx)
+	if err != nil {
+		return fmt.Errorf("get source connection: %w", err)
+	}
+	defer srcConn.Close()
+
+	return withSQLiteConn(destConn, func(destSQLite *sqlite3.SQLiteConn) error {
+		return withSQLiteConn(srcConn, func(srcSQLite *sqlite3.SQLiteConn) error {
+			bk, err := destSQLite.Backup("main", srcSQLite, "main")
+			if err != nil {
+				return fmt.Errorf("start backup: %w", err)
+			}
+
+			if _, err := bk.Step(-1); err != nil {
+				_ = bk.Close()
+				return fmt.Errorf("copy pages: %w", err)
+			}
+
+			if err := bk.Finish(); err != nil {
+				return fmt.Errorf("finish backup: %w", err)
+			}
+			return nil
+		})
+	})
+}
+
+// OpenSnapshot opens a snapshot made by Snapshot without changing it.
+func OpenSnapshot(fname string) (*sqlx.DB, error) {
+	db, err := sqlx.Open("sqlite3", "file:"+fname+"?mode=ro")
+	if err != nil {
+		return nil, fmt.Errorf("open snapshot: %w", err)
+	}
+	return db, nil
+}
+
+// Snapshot writes a consistent copy of db to a new SQLite database at fname while db stays in use.
+func Snapshot(ctx context.Context, db *sqlx.DB, fname string) error {
+	dest, err := sql.Open("sqlite3", fname)
+	if err != nil {
+		return fmt.Errorf("create snapshot: %w", err)
+	}
+	defer dest.Close()
+
+	if err := copyDatabase(ctx, dest, db.DB); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// Restore replaces the contents of db with the snapshot at fname, after checking that the snapshot isn't damaged and
+// that it can be migrated to the current schema. Any migrations are run the next time Palmatum is started.
+func Restore(ctx context.Context, db *sqlx.DB, fname string) error {
+	snapshot, err := OpenSnapshot(fname)
+	if err != nil {
+		return err
+	}
+	defer snapshot.Close()
+
+	var result string
+	if err := snapshot.QueryRowContext(ctx, `PRAGMA integrity_check`).Scan(&result); err != nil {
+		return fmt.Errorf("check snapshot integrity: %w", err)
+	}
+	if result != "ok" {
+		return fmt.Errorf("snapshot is damaged: %s", result)
+	}
+
+	var version int
+	if err := snapshot.QueryRowContext(ctx, `SELECT n FROM schema_version`).Scan(&version); err != nil {
+		return fmt.Errorf("get snapshot schema version: %w", err)
+	}
+	if version > programSchemaVersion {
+		return fmt.Errorf("snapshot has schema version %d, which is newer than this version of Palmatum supports (%d)", version, programSchemaVersion)
+	}
+
+	if err := copyDatabase(ctx, db.DB, snapshot.DB); err != nil {
+		return err
+	}
+
+	return nil
+}
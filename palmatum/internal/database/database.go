@@ -3,22 +3,81 @@ package database
 import (
 	"context"
 	"database/sql"
+	"database/sql/driver"
 	"errors"
 	"fmt"
 	"git.tdpain.net/codemicro/palmatum/palmatum/internal/config"
+	"git.tdpain.net/codemicro/palmatum/palmatum/internal/tracing"
+	"github.com/XSAM/otelsql"
 	"github.com/jmoiron/sqlx"
 	_ "github.com/mattn/go-sqlite3"
+	semconv "go.opentelemetry.io/otel/semconv/v1.24.0"
+	"go.opentelemetry.io/otel/trace"
 	"go.uber.org/fx"
 )
 
-const programSchemaVersion = 1
+const programSchemaVersion = 17
 
-func New(lc fx.Lifecycle, conf *config.Config) (*sqlx.DB, error) {
-	db, err := sqlx.Connect("sqlite3", conf.Database.DSN)
+func open(conf *config.Config, tp trace.TracerProvider) (*sqlx.DB, error) {
+	sqlDB, err := otelsql.Open("sqlite3", conf.Database.DSN,
+		otelsql.WithTracerProvider(tp),
+		otelsql.WithAttributes(semconv.DBSystemSqlite),
+		otelsql.WithSpanOptions(otelsql.SpanOptions{
+			OmitConnResetSession: true,
+			OmitRows:             true,
+			// Queries are only traced as part of something else, otherwise every background poll would start a trace
+			SpanFilter: func(ctx context.Context, _ otelsql.Method, _ string, _ []driver.NamedValue) bool {
+				return tracing.HasSpan(ctx)
+			},
+		}),
+	)
 	if err != nil {
 		return nil, fmt.Errorf("open database: %w", err)
 	}
 
+	db := sqlx.NewDb(sqlDB, "sqlite3")
+	if err := db.Ping(); err != nil {
+		_ = db.Close()
+		return nil, fmt.Errorf("open database: %w", err)
+	}
+
+	return db, nil
+}
+
+// NewExisting opens a database that's already been migrated, without changing it, so that it can be used alongside a
+// running instance that might be using a different schema version. It fails to start if the schema isn't the one this
+// version of Palmatum expects.
+func NewExisting(lc fx.Lifecycle, conf *config.Config, tp trace.TracerProvider) (*sqlx.DB, error) {
+	db, err := open(conf, tp)
+	if err != nil {
+		return nil, err
+	}
+
+	lc.Append(fx.Hook{
+		OnStart: func(ctx context.Context) error {
+			var currentSchemaVersion int
+			if err := db.QueryRowxContext(ctx, "SELECT n FROM schema_version").Scan(&currentSchemaVersion); err != nil {
+				return fmt.Errorf("unable to read schema version from database (has Palmatum been started with it?): %w", err)
+			}
+			if currentSchemaVersion != programSchemaVersion {
+				return fmt.Errorf("database schema version is %d but this version of Palmatum uses %d", currentSchemaVersion, programSchemaVersion)
+			}
+			return nil
+		},
+		OnStop: func(ctx context.Context) error {
+			return db.Close()
+		},
+	})
+
+	return db, nil
+}
+
+func New(lc fx.Lifecycle, conf *config.Config, tp trace.TracerProvider) (*sqlx.DB, error) {
+	db, err := open(conf, tp)
+	if err != nil {
+		return nil, err
+	}
+
 	lc.Append(fx.Hook{
 		OnStart: func(ctx context.Context) error {
 			_, err = db.Exec(`CREATE TABLE IF NOT EXISTS schema_version(
@@ -60,6 +119,351 @@ func New(lc fx.Lifecycle, conf *config.Config) (*sqlx.DB, error) {
 						return fmt.Errorf("create routes table: %w", err)
 					}
 					currentSchemaVersion = 1
+				case 1:
+					_, err = db.Exec(`ALTER TABLE sites ADD COLUMN "spa_fallback" integer default 0`)
+					if err != nil {
+						return fmt.Errorf("add spa_fallback column to sites table: %w", err)
+					}
+					currentSchemaVersion = 2
+				case 2:
+					_, err = db.Exec(`ALTER TABLE sites ADD COLUMN "allowed_ips" varchar default ''`)
+					if err != nil {
+						return fmt.Errorf("add allowed_ips column to sites table: %w", err)
+					}
+
+					_, err = db.Exec(`CREATE TABLE site_credentials(
+						"id" integer primary key autoincrement,
+						"site" varchar not null,
+						"username" varchar not null,
+						"password_hash" varchar not null,
+
+						foreign key (site) references sites(slug),
+						unique (site, username)
+					)`)
+					if err != nil {
+						return fmt.Errorf("create site_credentials table: %w", err)
+					}
+					currentSchemaVersion = 3
+				case 3:
+					_, err = db.Exec(`CREATE TABLE site_oidc(
+						"site" varchar primary key,
+						"issuer" varchar not null,
+						"client_id" varchar not null,
+						"client_secret" varchar not null,
+						"allowed_emails" varchar default '',
+						"allowed_groups" varchar default '',
+
+						foreign key (site) references sites(slug)
+					)`)
+					if err != nil {
+						return fmt.Errorf("create site_oidc table: %w", err)
+					}
+					currentSchemaVersion = 4
+				case 4:
+					_, err = db.Exec(`CREATE TABLE users(
+						"id" integer primary key autoincrement,
+						"subject" varchar not null unique,
+						"email" varchar default '',
+						"name" varchar default '',
+						"role" varchar default '',
+						"login_role" varchar default '',
+						"created_at" integer default 0,
+						"last_login_at" integer default 0
+					)`)
+					if err != nil {
+						return fmt.Errorf("create users table: %w", err)
+					}
+					currentSchemaVersion = 5
+				case 5:
+					_, err = db.Exec(`CREATE TABLE audit_log(
+						"id" integer primary key autoincrement,
+						"timestamp" integer not null,
+						"actor" varchar default '',
+						"action" varchar not null,
+						"target" varchar default '',
+						"source_ip" varchar default '',
+						"result" varchar not null,
+						"detail" varchar default ''
+					)`)
+					if err != nil {
+						return fmt.Errorf("create audit_log table: %w", err)
+					}
+					_, err = db.Exec(`CREATE INDEX audit_log_timestamp ON audit_log(timestamp)`)
+					if err != nil {
+						return fmt.Errorf("create audit_log index: %w", err)
+					}
+					currentSchemaVersion = 6
+				case 6:
+					_, err = db.Exec(`CREATE TABLE webhooks(
+						"id" integer primary key autoincrement,
+						"url" varchar not null,
+						"events" varchar default '',
+						"secret" varchar default '',
+						"created_at" integer default 0
+					)`)
+					if err != nil {
+						return fmt.Errorf("create webhooks table: %w", err)
+					}
+
+					_, err = db.Exec(`CREATE TABLE webhook_deliveries(
+						"id" integer primary key autoincrement,
+						"webhook" integer not null,
+						"event" varchar not null,
+						"payload" varchar not null,
+						"status" varchar not null,
+						"attempts" integer default 0,
+						"response_status" integer default 0,
+						"response_body" varchar default '',
+						"error" varchar default '',
+						"created_at" integer default 0,
+						"last_attempt_at" integer default 0,
+						"next_attempt_at" integer default 0,
+
+						foreign key (webhook) references webhooks(id)
+					)`)
+					if err != nil {
+						return fmt.Errorf("create webhook_deliveries table: %w", err)
+					}
+					_, err = db.Exec(`CREATE INDEX webhook_deliveries_pending ON webhook_deliveries(status, next_attempt_at)`)
+					if err != nil {
+						return fmt.Errorf("create webhook_deliveries index: %w", err)
+					}
+					currentSchemaVersion = 7
+				case 7:
+					_, err = db.Exec(`CREATE TABLE site_git(
+						"site" varchar primary key,
+						"repository" varchar not null,
+						"branch" varchar not null,
+						"directory" varchar default '',
+						"webhook_secret" varchar not null,
+
+						foreign key (site) references sites(slug)
+					)`)
+					if err != nil {
+						return fmt.Errorf("create site_git table: %w", err)
+					}
+
+					_, err = db.Exec(`CREATE TABLE deployments(
+						"id" integer primary key autoincrement,
+						"site" varchar not null,
+						"content_path" varchar not null,
+						"source" varchar not null,
+						"commit_sha" varchar default '',
+						"created_at" integer default 0,
+
+						foreign key (site) references sites(slug)
+					)`)
+					if err != nil {
+						return fmt.Errorf("create deployments table: %w", err)
+					}
+					currentSchemaVersion = 8
+				case 8:
+					_, err = db.Exec(`CREATE TABLE site_build(
+						"site" varchar primary key,
+						"command" varchar not null,
+						"output_directory" varchar default '',
+						"environment" varchar default '',
+
+						foreign key (site) references sites(slug)
+					)`)
+					if err != nil {
+						return fmt.Errorf("create site_build table: %w", err)
+					}
+
+					_, err = db.Exec(`CREATE TABLE builds(
+						"id" integer primary key autoincrement,
+						"site" varchar not null,
+						"status" varchar not null,
+						"source" varchar not null,
+						"commit_sha" varchar default '',
+						"log" varchar default '',
+						"error" varchar default '',
+						"created_at" integer default 0,
+						"started_at" integer default 0,
+						"finished_at" integer default 0,
+
+						foreign key (site) references sites(slug)
+					)`)
+					if err != nil {
+						return fmt.Errorf("create builds table: %w", err)
+					}
+
+					_, err = db.Exec(`ALTER TABLE deployments ADD COLUMN build integer default 0`)
+					if err != nil {
+						return fmt.Errorf("add build column to deployments: %w", err)
+					}
+					currentSchemaVersion = 9
+				case 9:
+					_, err = db.Exec(`CREATE TABLE jobs(
+						"id" integer primary key autoincrement,
+						"type" varchar not null,
+						"queue" varchar not null,
+						"payload" varchar not null,
+						"status" varchar not null,
+						"attempts" integer default 0,
+						"result" varchar default '',
+						"error" varchar default '',
+						"created_at" integer default 0,
+						"started_at" integer default 0,
+						"finished_at" integer default 0
+					)`)
+					if err != nil {
+						return fmt.Errorf("create jobs table: %w", err)
+					}
+
+					_, err = db.Exec(`CREATE INDEX jobs_queue_status ON jobs(queue, status)`)
+					if err != nil {
+						return fmt.Errorf("create jobs index: %w", err)
+					}
+
+					// Builds used to be queued in the builds table itself, so any that were waiting need jobs
+					_, err = db.Exec(`INSERT INTO jobs(type, queue, payload, status, created_at) SELECT 'build', 'build', json_object('build', id), 'queued', created_at FROM builds WHERE status IN ('queued', 'running') ORDER BY id`)
+					if err != nil {
+						return fmt.Errorf("create jobs for queued builds: %w", err)
+					}
+					currentSchemaVersion = 10
+				case 10:
+					_, err = db.Exec(`CREATE TABLE access_log(
+						"id" integer primary key autoincrement,
+						"site" varchar not null,
+						"timestamp" integer not null,
+						"method" varchar not null,
+						"host" varchar not null,
+						"path" varchar not null,
+						"status" integer not null,
+						"size" integer default 0,
+						"duration_ms" real default 0,
+						"remote_ip" varchar default '',
+						"user_agent" varchar default '',
+						"referer" varchar default ''
+					)`)
+					if err != nil {
+						return fmt.Errorf("create access_log table: %w", err)
+					}
+
+					_, err = db.Exec(`CREATE INDEX access_log_site_timestamp ON access_log(site, timestamp)`)
+					if err != nil {
+						return fmt.Errorf("create access_log index: %w", err)
+					}
+					currentSchemaVersion = 11
+				case 11:
+					_, err = db.Exec(`CREATE TABLE analytics_daily(
+						"site" varchar not null,
+						"day" varchar not null,
+						"page_views" integer default 0,
+						"visitors" integer default 0,
+						"not_found" integer default 0,
+						primary key (site, day)
+					)`)
+					if err != nil {
+						return fmt.Errorf("create analytics_daily table: %w", err)
+					}
+
+					_, err = db.Exec(`CREATE TABLE analytics_top(
+						"site" varchar not null,
+						"day" varchar not null,
+						"kind" varchar not null,
+						"value" varchar not null,
+						"count" integer default 0,
+						primary key (site, day, kind, value)
+					)`)
+					if err != nil {
+						return fmt.Errorf("create analytics_top table: %w", err)
+					}
+
+					// Visitor hashes and the salts used to make them are only kept for the day they're for
+					_, err = db.Exec(`CREATE TABLE analytics_visitors(
+						"site" varchar not null,
+						"day" varchar not null,
+						"hash" varchar not null,
+						primary key (site, day, hash)
+					)`)
+					if err != nil {
+						return fmt.Errorf("create analytics_visitors table: %w", err)
+					}
+
+					_, err = db.Exec(`CREATE TABLE analytics_salts(
+						"day" varchar not null primary key,
+						"salt" blob not null
+					)`)
+					if err != nil {
+						return fmt.Errorf("create analytics_salts table: %w", err)
+					}
+					currentSchemaVersion = 12
+				case 12:
+					// The trace context of whatever queued a job, so that the job's spans can be added to its trace
+					_, err = db.Exec(`ALTER TABLE jobs ADD COLUMN "trace_parent" varchar default ''`)
+					if err != nil {
+						return fmt.Errorf("add trace_parent column to jobs table: %w", err)
+					}
+					currentSchemaVersion = 13
+				case 13:
+					_, err = db.Exec(`ALTER TABLE sites ADD COLUMN "rate_limit_requests" integer not null default 0`)
+					if err != nil {
+						return fmt.Errorf("add rate_limit_requests column to sites table: %w", err)
+					}
+
+					_, err = db.Exec(`ALTER TABLE sites ADD COLUMN "rate_limit_bandwidth_kilobytes" integer not null default 0`)
+					if err != nil {
+						return fmt.Errorf("add rate_limit_bandwidth_kilobytes column to sites table: %w", err)
+					}
+					currentSchemaVersion = 14
+				case 14:
+					// Sizes are in bytes. The size of content that already exists is filled in when Palmatum starts.
+					_, err = db.Exec(`ALTER TABLE sites ADD COLUMN "content_size" integer not null default 0`)
+					if err != nil {
+						return fmt.Errorf("add content_size column to sites table: %w", err)
+					}
+
+					_, err = db.Exec(`ALTER TABLE sites ADD COLUMN "content_uncompressed_size" integer not null default 0`)
+					if err != nil {
+						return fmt.Errorf("add content_uncompressed_size column to sites table: %w", err)
+					}
+
+					_, err = db.Exec(`ALTER TABLE sites ADD COLUMN "quota_megabytes" integer not null default 0`)
+					if err != nil {
+						return fmt.Errorf("add quota_megabytes column to sites table: %w", err)
+					}
+
+					_, err = db.Exec(`ALTER TABLE deployments ADD COLUMN "size" integer not null default 0`)
+					if err != nil {
+						return fmt.Errorf("add size column to deployments table: %w", err)
+					}
+
+					_, err = db.Exec(`ALTER TABLE deployments ADD COLUMN "uncompressed_size" integer not null default 0`)
+					if err != nil {
+						return fmt.Errorf("add uncompressed_size column to deployments table: %w", err)
+					}
+					currentSchemaVersion = 15
+				case 15:
+					// Jobs that change a site are run one at a time for each site
+					_, err = db.Exec(`ALTER TABLE jobs ADD COLUMN "site" varchar not null default ''`)
+					if err != nil {
+						return fmt.Errorf("add site column to jobs table: %w", err)
+					}
+
+					_, err = db.Exec(`UPDATE jobs SET site = coalesce(json_extract(payload, '$.site'), '') WHERE type IN ('deploy', 'git-deploy')`)
+					if err != nil {
+						return fmt.Errorf("set site of deployment jobs: %w", err)
+					}
+
+					_, err = db.Exec(`UPDATE jobs SET site = coalesce((SELECT site FROM builds WHERE builds.id = json_extract(jobs.payload, '$.build')), '') WHERE type = 'build'`)
+					if err != nil {
+						return fmt.Errorf("set site of build jobs: %w", err)
+					}
+
+					_, err = db.Exec(`CREATE INDEX jobs_site_status ON jobs(site, status)`)
+					if err != nil {
+						return fmt.Errorf("create jobs site index: %w", err)
+					}
+					currentSchemaVersion = 16
+				case 16:
+					// Old entries are pruned by timestamp alone, which the existing index can't be used for
+					_, err = db.Exec(`CREATE INDEX access_log_timestamp ON access_log(timestamp)`)
+					if err != nil {
+						return fmt.Errorf("create access_log timestamp index: %w", err)
+					}
+					currentSchemaVersion = 17
 				case programSchemaVersion:
 					// noop
 				}
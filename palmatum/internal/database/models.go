@@ -10,6 +10,15 @@ type SiteModel struct {
 	Slug          string `db:"slug"` // primary key
 	ContentPath   string `db:"content_path"`
 	LastUpdatedAt int64  `db:"last_updated_at"`
+	SPAFallback   bool   `db:"spa_fallback"`
+	AllowedIPs    string `db:"allowed_ips"` // space-separated list of IP addresses and CIDR ranges
+
+	RateLimitRequests           int `db:"rate_limit_requests"`            // per second per client IP, zero for no limit
+	RateLimitBandwidthKilobytes int `db:"rate_limit_bandwidth_kilobytes"` // per second across all clients, zero for no limit
+
+	ContentSize             int64 `db:"content_size"`              // bytes on disk
+	ContentUncompressedSize int64 `db:"content_uncompressed_size"` // bytes once extracted
+	QuotaMegabytes          int   `db:"quota_megabytes"`           // zero to use the platform default
 
 	Routes []*RouteModel `db:"-"`
 }
@@ -54,8 +63,313 @@ func GetSitesWithRoutes(db sqlx.Queryer) ([]*SiteModel, error) {
 }
 
 type RouteModel struct {
-	ID     int    `db:"id"`
-	Site   string `db:"site"`
-	Domain string `db:"domain"`
-	Path   string `db:"path"`
+	ID     int    `db:"id" json:"id"`
+	Site   string `db:"site" json:"site"`
+	Domain string `db:"domain" json:"domain"`
+	Path   string `db:"path" json:"path"`
+}
+
+type SiteCredentialModel struct {
+	ID           int    `db:"id"`
+	Site         string `db:"site"`
+	Username     string `db:"username"`
+	PasswordHash string `db:"password_hash"`
+}
+
+func GetSiteCredentials(db sqlx.Queryer, slug string) ([]*SiteCredentialModel, error) {
+	var res []*SiteCredentialModel
+	if err := sqlx.Select(db, &res, `SELECT * FROM site_credentials WHERE "site" = ? ORDER BY "username"`, slug); err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return nil, err
+	}
+	return res, nil
+}
+
+func GetAllSiteCredentials(db sqlx.Queryer) ([]*SiteCredentialModel, error) {
+	var res []*SiteCredentialModel
+	if err := sqlx.Select(db, &res, `SELECT * FROM site_credentials ORDER BY "username"`); err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return nil, err
+	}
+	return res, nil
+}
+
+// SiteOIDCModel is the OpenID Connect configuration used to protect a site with single sign-on.
+type SiteOIDCModel struct {
+	Site          string `db:"site"` // primary key
+	Issuer        string `db:"issuer"`
+	ClientID      string `db:"client_id"`
+	ClientSecret  string `db:"client_secret"`
+	AllowedEmails string `db:"allowed_emails"` // space-separated
+	AllowedGroups string `db:"allowed_groups"` // space-separated
+}
+
+func GetSiteOIDC(db sqlx.Queryer, slug string) (*SiteOIDCModel, error) {
+	res := new(SiteOIDCModel)
+	if err := db.QueryRowx(`SELECT * FROM site_oidc WHERE "site" = ?`, slug).StructScan(res); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// UserModel is a user that has logged in to the management UI.
+type UserModel struct {
+	ID          int    `db:"id"`
+	Subject     string `db:"subject"` // OIDC subject, unique
+	Email       string `db:"email"`
+	Name        string `db:"name"`
+	Role        string `db:"role"`       // role assigned by an admin
+	LoginRole   string `db:"login_role"` // effective role at the most recent login
+	CreatedAt   int64  `db:"created_at"`
+	LastLoginAt int64  `db:"last_login_at"`
+}
+
+func GetUser(db sqlx.Queryer, id int) (*UserModel, error) {
+	res := new(UserModel)
+	if err := db.QueryRowx(`SELECT * FROM users WHERE "id" = ?`, id).StructScan(res); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+func GetUserBySubject(db sqlx.Queryer, subject string) (*UserModel, error) {
+	res := new(UserModel)
+	if err := db.QueryRowx(`SELECT * FROM users WHERE "subject" = ?`, subject).StructScan(res); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+func GetUsers(db sqlx.Queryer) ([]*UserModel, error) {
+	var res []*UserModel
+	if err := sqlx.Select(db, &res, `SELECT * FROM users ORDER BY "last_login_at" DESC`); err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return nil, err
+	}
+	return res, nil
+}
+
+// AuditLogModel is a record of a single action taken through the management interface.
+type AuditLogModel struct {
+	ID        int    `db:"id" json:"id"`
+	Timestamp int64  `db:"timestamp" json:"timestamp"`
+	Actor     string `db:"actor" json:"actor"` // empty if login isn't enabled
+	Action    string `db:"action" json:"action"`
+	Target    string `db:"target" json:"target"`
+	SourceIP  string `db:"source_ip" json:"sourceIP"`
+	Result    string `db:"result" json:"result"`
+	Detail    string `db:"detail" json:"detail,omitempty"`
+}
+
+// AccessLogModel is a record of a single request to a site.
+type AccessLogModel struct {
+	ID         int     `db:"id" json:"id"`
+	Site       string  `db:"site" json:"site"`
+	Timestamp  int64   `db:"timestamp" json:"timestamp"`
+	Method     string  `db:"method" json:"method"`
+	Host       string  `db:"host" json:"host"`
+	Path       string  `db:"path" json:"path"`
+	Status     int     `db:"status" json:"status"`
+	Size       int64   `db:"size" json:"size"`
+	DurationMS float64 `db:"duration_ms" json:"durationMs"`
+	RemoteIP   string  `db:"remote_ip" json:"remoteIP"`
+	UserAgent  string  `db:"user_agent" json:"userAgent,omitempty"`
+	Referer    string  `db:"referer" json:"referer,omitempty"`
+}
+
+// AnalyticsDayModel is the number of page views, unique visitors and requests for missing pages that a site received
+// on one day (in UTC).
+type AnalyticsDayModel struct {
+	Site      string `db:"site" json:"-"`
+	Day       string `db:"day" json:"day"`
+	PageViews int    `db:"page_views" json:"pageViews"`
+	Visitors  int    `db:"visitors" json:"visitors"`
+	NotFound  int    `db:"not_found" json:"notFound"`
+}
+
+// WebhookModel is a subscription to events that are sent to a URL.
+type WebhookModel struct {
+	ID        int    `db:"id"`
+	URL       string `db:"url"`
+	Events    string `db:"events"` // space-separated, empty for all events
+	Secret    string `db:"secret"`
+	CreatedAt int64  `db:"created_at"`
+}
+
+func GetWebhooks(db sqlx.Queryer) ([]*WebhookModel, error) {
+	var res []*WebhookModel
+	if err := sqlx.Select(db, &res, `SELECT * FROM webhooks ORDER BY "id"`); err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return nil, err
+	}
+	return res, nil
+}
+
+func GetWebhook(db sqlx.Queryer, id int) (*WebhookModel, error) {
+	res := new(WebhookModel)
+	if err := db.QueryRowx(`SELECT * FROM webhooks WHERE "id" = ?`, id).StructScan(res); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+const (
+	WebhookDeliveryPending   = "pending"
+	WebhookDeliverySucceeded = "succeeded"
+	WebhookDeliveryFailed    = "failed"
+)
+
+// WebhookDeliveryModel is a single event being sent to a webhook, including the result of the most recent attempt.
+type WebhookDeliveryModel struct {
+	ID             int    `db:"id"`
+	Webhook        int    `db:"webhook"`
+	Event          string `db:"event"`
+	Payload        string `db:"payload"`
+	Status         string `db:"status"`
+	Attempts       int    `db:"attempts"`
+	ResponseStatus int    `db:"response_status"`
+	ResponseBody   string `db:"response_body"`
+	Error          string `db:"error"`
+	CreatedAt      int64  `db:"created_at"`
+	LastAttemptAt  int64  `db:"last_attempt_at"`
+	NextAttemptAt  int64  `db:"next_attempt_at"`
+}
+
+func GetWebhookDeliveries(db sqlx.Queryer, webhookID int, limit int) ([]*WebhookDeliveryModel, error) {
+	var res []*WebhookDeliveryModel
+	if err := sqlx.Select(db, &res, `SELECT * FROM webhook_deliveries WHERE "webhook" = ? ORDER BY "id" DESC LIMIT ?`, webhookID, limit); err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return nil, err
+	}
+	return res, nil
+}
+
+// SiteGitModel links a site to a branch of a Git repository that it's deployed from.
+type SiteGitModel struct {
+	Site          string `db:"site"` // primary key
+	Repository    string `db:"repository"`
+	Branch        string `db:"branch"`
+	Directory     string `db:"directory"` // path within the repository to deploy, empty for the root
+	WebhookSecret string `db:"webhook_secret"`
+}
+
+func GetSiteGit(db sqlx.Queryer, slug string) (*SiteGitModel, error) {
+	res := new(SiteGitModel)
+	if err := db.QueryRowx(`SELECT * FROM site_git WHERE "site" = ?`, slug).StructScan(res); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// DeploymentModel is a record of new content being deployed to a site.
+type DeploymentModel struct {
+	ID          int    `db:"id"`
+	Site        string `db:"site"`
+	ContentPath string `db:"content_path"`
+	Source      string `db:"source"`
+	CommitSHA   string `db:"commit_sha"`
+	CreatedAt   int64  `db:"created_at"`
+	Build       int    `db:"build"` // zero if the content wasn't built by Palmatum
+
+	Size             int64 `db:"size"`              // bytes on disk
+	UncompressedSize int64 `db:"uncompressed_size"` // bytes once extracted
+}
+
+func GetDeployments(db sqlx.Queryer, slug string, limit int) ([]*DeploymentModel, error) {
+	var res []*DeploymentModel
+	if err := sqlx.Select(db, &res, `SELECT * FROM deployments WHERE "site" = ? ORDER BY "id" DESC LIMIT ?`, slug, limit); err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return nil, err
+	}
+	return res, nil
+}
+
+// SiteBuildModel is the command used to build a site from its source before it's deployed.
+type SiteBuildModel struct {
+	Site            string `db:"site"` // primary key
+	Command         string `db:"command"`
+	OutputDirectory string `db:"output_directory"`
+	Environment     string `db:"environment"` // newline-separated KEY=value pairs
+}
+
+func GetSiteBuild(db sqlx.Queryer, slug string) (*SiteBuildModel, error) {
+	res := new(SiteBuildModel)
+	if err := db.QueryRowx(`SELECT * FROM site_build WHERE "site" = ?`, slug).StructScan(res); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+const (
+	BuildStatusQueued    = "queued"
+	BuildStatusRunning   = "running"
+	BuildStatusSucceeded = "succeeded"
+	BuildStatusFailed    = "failed"
+)
+
+// BuildModel is a single run of a site's build command.
+type BuildModel struct {
+	ID         int    `db:"id"`
+	Site       string `db:"site"`
+	Status     string `db:"status"`
+	Source     string `db:"source"`
+	CommitSHA  string `db:"commit_sha"`
+	Log        string `db:"log"` // only populated once the build has finished
+	Error      string `db:"error"`
+	CreatedAt  int64  `db:"created_at"`
+	StartedAt  int64  `db:"started_at"`
+	FinishedAt int64  `db:"finished_at"`
+}
+
+func GetBuild(db sqlx.Queryer, id int) (*BuildModel, error) {
+	res := new(BuildModel)
+	if err := db.QueryRowx(`SELECT * FROM builds WHERE "id" = ?`, id).StructScan(res); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// GetBuilds returns the most recent builds for a site, without their logs.
+func GetBuilds(db sqlx.Queryer, slug string, limit int) ([]*BuildModel, error) {
+	var res []*BuildModel
+	if err := sqlx.Select(db, &res, `SELECT id, site, status, source, commit_sha, '' AS log, error, created_at, started_at, finished_at FROM builds WHERE "site" = ? ORDER BY "id" DESC LIMIT ?`, slug, limit); err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return nil, err
+	}
+	return res, nil
+}
+
+const (
+	JobStatusQueued    = "queued"
+	JobStatusRunning   = "running"
+	JobStatusSucceeded = "succeeded"
+	JobStatusFailed    = "failed"
+)
+
+// JobModel is a unit of work that's run in the background.
+type JobModel struct {
+	ID         int    `db:"id" json:"id"`
+	Type       string `db:"type" json:"type"`
+	Queue      string `db:"queue" json:"queue"`
+	Site       string `db:"site" json:"site,omitempty"`
+	Payload    string `db:"payload" json:"-"`
+	Status     string `db:"status" json:"status"`
+	Attempts   int    `db:"attempts" json:"attempts"`
+	Result     string `db:"result" json:"result,omitempty"`
+	Error      string `db:"error" json:"error,omitempty"`
+	CreatedAt  int64  `db:"created_at" json:"createdAt"`
+	StartedAt  int64  `db:"started_at" json:"startedAt,omitempty"`
+	FinishedAt int64  `db:"finished_at" json:"finishedAt,omitempty"`
+	// TraceParent is the W3C traceparent header of the span that queued the job, if it was being traced.
+	TraceParent string `db:"trace_parent" json:"-"`
+}
+
+func GetJob(db sqlx.Queryer, id int) (*JobModel, error) {
+	res := new(JobModel)
+	if err := db.QueryRowx(`SELECT * FROM jobs WHERE "id" = ?`, id).StructScan(res); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// GetJobs returns the most recent jobs, optionally only those with the given status.
+func GetJobs(db sqlx.Queryer, status string, limit int) ([]*JobModel, error) {
+	var res []*JobModel
+	if err := sqlx.Select(db, &res, `SELECT * FROM jobs WHERE ? = '' OR "status" = ? ORDER BY "id" DESC LIMIT ?`, status, status, limit); err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return nil, err
+	}
+	return res, nil
 }
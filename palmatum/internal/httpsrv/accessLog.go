@@ -0,0 +1,111 @@
+package httpsrv
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"git.tdpain.net/codemicro/palmatum/palmatum/internal/core"
+	"git.tdpain.net/codemicro/palmatum/palmatum/internal/database"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+const maxAccessLogEntries = 1000
+
+func parseAccessLogFilter(q url.Values) (*core.AccessLogFilter, error) {
+	filter := &core.AccessLogFilter{
+		Status: strings.TrimSpace(q.Get("status")),
+		Path:   strings.TrimSpace(q.Get("path")),
+		Limit:  100,
+	}
+
+	if l := q.Get("limit"); l != "" {
+		var err error
+		if filter.Limit, err = strconv.Atoi(l); err != nil || filter.Limit < 1 || filter.Limit > maxAccessLogEntries {
+			return nil, fmt.Errorf("invalid limit (must be between 1 and %d)", maxAccessLogEntries)
+		}
+	}
+
+	return filter, nil
+}
+
+// queryAccessLog returns the access log entries requested by rq. If nil is returned with no error, a response has
+// already been written.
+func (mr *managementRoutes) queryAccessLog(rw http.ResponseWriter, rq *http.Request) ([]*database.AccessLogModel, *core.AccessLogFilter, error) {
+	query := rq.URL.Query()
+
+	siteSlug := strings.TrimSpace(query.Get("slug"))
+	if siteSlug == "" {
+		_ = badRequestResponse(rw, "Missing slug")
+		return nil, nil, nil
+	}
+
+	if _, err := database.GetSite(mr.core.Database, siteSlug); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			_ = badRequestResponse(rw, core.ErrInvalidSlug.Error())
+			return nil, nil, nil
+		}
+		return nil, nil, fmt.Errorf("get site: %w", err)
+	}
+
+	filter, err := parseAccessLogFilter(query)
+	if err != nil {
+		_ = badRequestResponse(rw, err.Error())
+		return nil, nil, nil
+	}
+
+	entries, err := mr.core.QueryAccessLog(siteSlug, filter)
+	if err != nil {
+		var e *core.Error
+		if errors.As(err, &e) {
+			_ = badRequestResponse(rw, err.Error())
+			return nil, nil, nil
+		}
+		return nil, nil, fmt.Errorf("query access log: %w", err)
+	}
+
+	if entries == nil {
+		entries = []*database.AccessLogModel{}
+	}
+
+	return entries, filter, nil
+}
+
+func (mr *managementRoutes) apiGetAccessLog(rw http.ResponseWriter, rq *http.Request) error {
+	entries, _, err := mr.queryAccessLog(rw, rq)
+	if entries == nil {
+		return err
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(rw).Encode(entries)
+}
+
+func (mr *managementRoutes) accessLogPartial(rw http.ResponseWriter, rq *http.Request) error {
+	rw.Header().Set("Hx-Trigger-After-Swap", "showModal")
+	return mr.templates.ExecuteTemplate(rw, "accessLog.html", &struct {
+		Slug          string
+		RetentionDays int
+	}{
+		Slug:          rq.URL.Query().Get("slug"),
+		RetentionDays: mr.config.Platform.AccessLogRetentionDays,
+	})
+}
+
+func (mr *managementRoutes) accessLogEntriesPartial(rw http.ResponseWriter, rq *http.Request) error {
+	entries, filter, err := mr.queryAccessLog(rw, rq)
+	if entries == nil {
+		return err
+	}
+
+	return mr.templates.ExecuteTemplate(rw, "accessLogEntries", &struct {
+		Entries []*database.AccessLogModel
+		Limit   int
+	}{
+		Entries: entries,
+		Limit:   filter.Limit,
+	})
+}
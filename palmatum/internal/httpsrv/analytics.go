@@ -0,0 +1,137 @@
+package httpsrv
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"git.tdpain.net/codemicro/palmatum/palmatum/internal/core"
+	"net/http"
+	"strconv"
+)
+
+const defaultAnalyticsDays = 30
+
+// getSiteAnalytics returns the analytics requested by rq. If nil is returned with no error, a response has already
+// been written.
+func (mr *managementRoutes) getSiteAnalytics(rw http.ResponseWriter, rq *http.Request) (*core.SiteAnalytics, error) {
+	days := defaultAnalyticsDays
+	if d := rq.URL.Query().Get("days"); d != "" {
+		var err error
+		if days, err = strconv.Atoi(d); err != nil {
+			_ = badRequestResponse(rw, core.ErrInvalidAnalyticsPeriod.Error())
+			return nil, nil
+		}
+	}
+
+	analytics, err := mr.core.GetSiteAnalytics(rq.URL.Query().Get("slug"), days)
+	if err != nil {
+		var e *core.Error
+		if errors.As(err, &e) {
+			_ = badRequestResponse(rw, err.Error())
+			return nil, nil
+		}
+		return nil, fmt.Errorf("get site analytics: %w", err)
+	}
+
+	return analytics, nil
+}
+
+func (mr *managementRoutes) apiGetSiteAnalytics(rw http.ResponseWriter, rq *http.Request) error {
+	analytics, err := mr.getSiteAnalytics(rw, rq)
+	if analytics == nil {
+		return err
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(rw).Encode(analytics)
+}
+
+type analyticsChartBar struct {
+	X, Y, Width, Height float64
+	Label               string
+}
+
+// analyticsChart is a bar chart of daily page views, drawn as an SVG by the analyticsChart template.
+type analyticsChart struct {
+	Width, Height int
+	Bars          []*analyticsChartBar
+}
+
+func newAnalyticsChart(analytics *core.SiteAnalytics, width, height int) *analyticsChart {
+	chart := &analyticsChart{Width: width, Height: height}
+
+	maxViews := 1
+	for _, day := range analytics.Days {
+		maxViews = max(maxViews, day.PageViews)
+	}
+
+	barWidth := float64(width) / float64(len(analytics.Days))
+	for i, day := range analytics.Days {
+		// Every bar is at least a pixel high so that days with no views are still visible
+		h := max(float64(day.PageViews)/float64(maxViews)*float64(height), 1)
+		chart.Bars = append(chart.Bars, &analyticsChartBar{
+			X:      float64(i) * barWidth,
+			Y:      float64(height) - h,
+			Width:  max(barWidth-1, 1),
+			Height: h,
+			Label:  fmt.Sprintf("%s: %d page views, %d visitors", day.Day, day.PageViews, day.Visitors),
+		})
+	}
+
+	return chart
+}
+
+// siteAnalyticsSummaryPartial renders a small chart of a site's page views, which is shown alongside each site on the
+// index page.
+func (mr *managementRoutes) siteAnalyticsSummaryPartial(rw http.ResponseWriter, rq *http.Request) error {
+	if mr.config.Platform.AccessLogRetentionDays == 0 {
+		// Without access logs, there's nothing to build analytics from
+		return nil
+	}
+
+	analytics, err := mr.getSiteAnalytics(rw, rq)
+	if analytics == nil {
+		return err
+	}
+
+	return mr.templates.ExecuteTemplate(rw, "siteAnalyticsSummary", &struct {
+		Slug      string
+		Analytics *core.SiteAnalytics
+		Chart     *analyticsChart
+	}{
+		Slug:      rq.URL.Query().Get("slug"),
+		Analytics: analytics,
+		Chart:     newAnalyticsChart(analytics, 120, 24),
+	})
+}
+
+func (mr *managementRoutes) siteAnalyticsPartial(rw http.ResponseWriter, rq *http.Request) error {
+	analytics, err := mr.getSiteAnalytics(rw, rq)
+	if analytics == nil {
+		return err
+	}
+
+	rw.Header().Set("Hx-Trigger-After-Swap", "showModal")
+	type topSection struct {
+		Title  string
+		Counts []*core.AnalyticsCount
+	}
+
+	return mr.templates.ExecuteTemplate(rw, "siteAnalytics.html", &struct {
+		Slug      string
+		Days      int
+		Analytics *core.SiteAnalytics
+		Chart     *analyticsChart
+		Top       []*topSection
+	}{
+		Slug:      rq.URL.Query().Get("slug"),
+		Days:      len(analytics.Days),
+		Analytics: analytics,
+		Chart:     newAnalyticsChart(analytics, 760, 160),
+		Top: []*topSection{
+			{Title: "Top pages", Counts: analytics.TopPaths},
+			{Title: "Top referrers", Counts: analytics.TopReferrers},
+			{Title: "Top missing pages", Counts: analytics.TopNotFound},
+		},
+	})
+}
@@ -0,0 +1,185 @@
+package httpsrv
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"git.tdpain.net/codemicro/palmatum/palmatum/internal/core"
+	"git.tdpain.net/codemicro/palmatum/palmatum/internal/database"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// auditResponseWriter records the status code of a response, and the start of the body if it's an error, so that the
+// result of an action can be written to the audit log.
+type auditResponseWriter struct {
+	http.ResponseWriter
+	status int
+	body   []byte
+}
+
+func (w *auditResponseWriter) WriteHeader(code int) {
+	if w.status == 0 {
+		w.status = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *auditResponseWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	if w.status >= 400 && len(w.body) < 256 {
+		w.body = append(w.body, b...)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func remoteIP(rq *http.Request) string {
+	host, _, err := net.SplitHostPort(rq.RemoteAddr)
+	if err != nil {
+		return rq.RemoteAddr
+	}
+	return host
+}
+
+// recordAudit writes entry to the audit log, filling in the actor and source IP from rq. Failures are logged but
+// otherwise ignored.
+func (mr *managementRoutes) recordAudit(rq *http.Request, entry *database.AuditLogModel) {
+	if entry.Actor == "" {
+		if user := userFromContext(rq.Context()); user != nil {
+			entry.Actor = user.Identifier()
+		}
+	}
+	entry.SourceIP = remoteIP(rq)
+
+	if err := mr.core.RecordAudit(entry); err != nil {
+		mr.logger.Error("unable to record audit log entry", "error", err, "action", entry.Action, "target", entry.Target)
+	}
+}
+
+// audited records every call to he in the audit log. The target of the action is built from the form fields named in
+// targetFields. Handlers that abort the response part way through with http.ErrAbortHandler are recorded as failures
+// before the panic carries on.
+func (mr *managementRoutes) audited(action string, he handlerWithError, targetFields ...string) handlerWithError {
+	return func(rw http.ResponseWriter, rq *http.Request) (err error) {
+		arw := &auditResponseWriter{ResponseWriter: rw}
+
+		defer func() {
+			if r := recover(); r != nil {
+				if r == http.ErrAbortHandler {
+					mr.recordAudit(rq, auditEntry(action, rq, targetFields, errResponseAborted, arw))
+				}
+				panic(r)
+			}
+		}()
+
+		err = he(arw, rq)
+		mr.recordAudit(rq, auditEntry(action, rq, targetFields, err, arw))
+		return err
+	}
+}
+
+var errResponseAborted = errors.New("response aborted before it was complete")
+
+// auditEntry builds the audit log entry for a call to an audited handler that returned err.
+func auditEntry(action string, rq *http.Request, targetFields []string, err error, arw *auditResponseWriter) *database.AuditLogModel {
+	var target []string
+	for _, field := range targetFields {
+		if v := strings.TrimSpace(rq.FormValue(field)); v != "" {
+			target = append(target, field+"="+v)
+		}
+	}
+
+	entry := &database.AuditLogModel{
+		Action: action,
+		Target: strings.Join(target, " "),
+		Result: core.AuditResultSuccess,
+	}
+
+	if err != nil {
+		entry.Result = core.AuditResultFailure
+		entry.Detail = err.Error()
+	} else if arw.status >= 400 {
+		entry.Result = core.AuditResultFailure
+		entry.Detail = strings.TrimSpace(string(arw.body))
+		if entry.Detail == "" {
+			entry.Detail = http.StatusText(arw.status)
+		}
+	}
+
+	return entry
+}
+
+// parseAuditLogFilter reads an audit log filter from query parameters. since and until may be either RFC 3339
+// timestamps or dates.
+func parseAuditLogFilter(q url.Values) (*core.AuditLogFilter, error) {
+	filter := &core.AuditLogFilter{
+		Actor:  strings.TrimSpace(q.Get("actor")),
+		Action: strings.TrimSpace(q.Get("action")),
+		Target: strings.TrimSpace(q.Get("target")),
+		Result: strings.TrimSpace(q.Get("result")),
+	}
+
+	parseTime := func(s string) (time.Time, error) {
+		if s == "" {
+			return time.Time{}, nil
+		}
+		if t, err := time.Parse(time.RFC3339, s); err == nil {
+			return t, nil
+		}
+		return time.ParseInLocation(time.DateOnly, s, time.Local)
+	}
+
+	var err error
+	if filter.Since, err = parseTime(q.Get("since")); err != nil {
+		return nil, fmt.Errorf("invalid since time")
+	}
+	if filter.Until, err = parseTime(q.Get("until")); err != nil {
+		return nil, fmt.Errorf("invalid until time")
+	}
+
+	if l := q.Get("limit"); l != "" {
+		if filter.Limit, err = strconv.Atoi(l); err != nil || filter.Limit < 0 {
+			return nil, fmt.Errorf("invalid limit")
+		}
+	}
+
+	return filter, nil
+}
+
+func (mr *managementRoutes) apiGetAuditLog(rw http.ResponseWriter, rq *http.Request) error {
+	filter, err := parseAuditLogFilter(rq.URL.Query())
+	if err != nil {
+		_ = badRequestResponse(rw, err.Error())
+		return nil
+	}
+
+	entries, err := mr.core.QueryAuditLog(filter)
+	if err != nil {
+		return fmt.Errorf("query audit log: %w", err)
+	}
+
+	if rq.URL.Query().Get("format") == "jsonl" {
+		rw.Header().Set("Content-Type", "application/x-ndjson")
+		rw.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="palmatum-audit-%s.jsonl"`, time.Now().Format("20060102-150405")))
+		enc := json.NewEncoder(rw)
+		for _, entry := range entries {
+			if err := enc.Encode(entry); err != nil {
+				return fmt.Errorf("encode audit log entry: %w", err)
+			}
+		}
+		return nil
+	}
+
+	if entries == nil {
+		entries = []*database.AuditLogModel{}
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(rw).Encode(entries)
+}
@@ -0,0 +1,111 @@
+package httpsrv
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"git.tdpain.net/codemicro/palmatum/palmatum/internal/core"
+	"git.tdpain.net/codemicro/palmatum/palmatum/internal/database"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+func (mr *managementRoutes) apiUpdateSiteBuild(rw http.ResponseWriter, rq *http.Request) error {
+	siteSlug := strings.TrimSpace(rq.FormValue("slug"))
+	if siteSlug == "" {
+		_ = badRequestResponse(rw, "Missing slug")
+		return nil
+	}
+
+	err := mr.core.SetSiteBuild(&database.SiteBuildModel{
+		Site:            siteSlug,
+		Command:         rq.FormValue("command"),
+		OutputDirectory: rq.FormValue("outputDirectory"),
+		Environment:     rq.FormValue("environment"),
+	})
+	if err != nil {
+		var e *core.Error
+		if errors.As(err, &e) {
+			_ = badRequestResponse(rw, err.Error())
+			return nil
+		}
+		return fmt.Errorf("set site build configuration: %w", err)
+	}
+
+	rw.Header().Set("HX-Refresh", "true")
+	rw.WriteHeader(http.StatusOK)
+	return nil
+}
+
+func (mr *managementRoutes) apiDeleteSiteBuild(rw http.ResponseWriter, rq *http.Request) error {
+	siteSlug := strings.TrimSpace(rq.FormValue("slug"))
+	if siteSlug == "" {
+		_ = badRequestResponse(rw, "Missing slug")
+		return nil
+	}
+
+	if err := mr.core.DisableSiteBuild(siteSlug); err != nil {
+		return fmt.Errorf("disable site build: %w", err)
+	}
+
+	rw.Header().Set("HX-Refresh", "true")
+	rw.WriteHeader(http.StatusOK)
+	return nil
+}
+
+func (mr *managementRoutes) siteBuildPartial(rw http.ResponseWriter, rq *http.Request) error {
+	var templateData = struct {
+		Slug   string
+		User   *core.User
+		Build  *database.SiteBuildModel
+		Builds []*database.BuildModel
+	}{
+		Slug: rq.URL.Query().Get("slug"),
+		User: userFromContext(rq.Context()),
+	}
+
+	if _, err := database.GetSite(mr.core.Database, templateData.Slug); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			_ = badRequestResponse(rw, core.ErrInvalidSlug.Error())
+			return nil
+		}
+		return fmt.Errorf("get site: %w", err)
+	}
+
+	var err error
+	templateData.Build, err = database.GetSiteBuild(mr.core.Database, templateData.Slug)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return fmt.Errorf("get site build configuration: %w", err)
+	}
+
+	templateData.Builds, err = database.GetBuilds(mr.core.Database, templateData.Slug, 10)
+	if err != nil {
+		return fmt.Errorf("get builds: %w", err)
+	}
+
+	rw.Header().Set("Hx-Trigger-After-Swap", "showModal")
+	return mr.templates.ExecuteTemplate(rw, "siteBuild.html", &templateData)
+}
+
+// buildLogPartial renders the log of a build. While the build is queued or running, the partial polls itself so that
+// the log is streamed into the page.
+func (mr *managementRoutes) buildLogPartial(rw http.ResponseWriter, rq *http.Request) error {
+	buildID, err := strconv.Atoi(rq.URL.Query().Get("id"))
+	if err != nil {
+		_ = badRequestResponse(rw, "invalid build ID")
+		return nil
+	}
+
+	build, err := mr.core.GetBuild(buildID)
+	if err != nil {
+		var e *core.Error
+		if errors.As(err, &e) {
+			_ = badRequestResponse(rw, err.Error())
+			return nil
+		}
+		return fmt.Errorf("get build: %w", err)
+	}
+
+	return mr.templates.ExecuteTemplate(rw, "buildLog.html", build)
+}
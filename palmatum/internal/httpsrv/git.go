@@ -0,0 +1,146 @@
+package httpsrv
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"git.tdpain.net/codemicro/palmatum/palmatum/internal/core"
+	"git.tdpain.net/codemicro/palmatum/palmatum/internal/database"
+	"io"
+	"net/http"
+	"strings"
+)
+
+const gitWebhookMaxBodySize = 25 * 1000 * 1000 // this is the largest payload GitHub will send
+
+func (mr *managementRoutes) apiUpdateSiteGit(rw http.ResponseWriter, rq *http.Request) error {
+	siteSlug := strings.TrimSpace(rq.FormValue("slug"))
+	if siteSlug == "" {
+		_ = badRequestResponse(rw, "Missing slug")
+		return nil
+	}
+
+	err := mr.core.SetSiteGit(&database.SiteGitModel{
+		Site:          siteSlug,
+		Repository:    rq.FormValue("repository"),
+		Branch:        rq.FormValue("branch"),
+		Directory:     rq.FormValue("directory"),
+		WebhookSecret: rq.FormValue("webhookSecret"),
+	})
+	if err != nil {
+		var e *core.Error
+		if errors.As(err, &e) {
+			_ = badRequestResponse(rw, err.Error())
+			return nil
+		}
+		return fmt.Errorf("set site Git configuration: %w", err)
+	}
+
+	rw.Header().Set("HX-Refresh", "true")
+	rw.WriteHeader(http.StatusOK)
+	return nil
+}
+
+func (mr *managementRoutes) apiDeleteSiteGit(rw http.ResponseWriter, rq *http.Request) error {
+	siteSlug := strings.TrimSpace(rq.FormValue("slug"))
+	if siteSlug == "" {
+		_ = badRequestResponse(rw, "Missing slug")
+		return nil
+	}
+
+	if err := mr.core.DisableSiteGit(siteSlug); err != nil {
+		return fmt.Errorf("disable site Git deployments: %w", err)
+	}
+
+	rw.Header().Set("HX-Refresh", "true")
+	rw.WriteHeader(http.StatusOK)
+	return nil
+}
+
+// apiDeploySiteGit deploys the latest commit on the branch a site is linked to.
+func (mr *managementRoutes) apiDeploySiteGit(rw http.ResponseWriter, rq *http.Request) error {
+	siteSlug := strings.TrimSpace(rq.FormValue("slug"))
+	if siteSlug == "" {
+		_ = badRequestResponse(rw, "Missing slug")
+		return nil
+	}
+
+	job, err := mr.core.QueueGitDeploy(rq.Context(), siteSlug, "")
+	if err != nil {
+		var e *core.Error
+		if errors.As(err, &e) {
+			_ = badRequestResponse(rw, err.Error())
+			return nil
+		}
+		return fmt.Errorf("queue Git deployment: %w", err)
+	}
+
+	return mr.jobAcceptedResponse(rw, rq, job)
+}
+
+// gitPushWebhook receives push webhooks from GitHub, Gitea and GitLab. Deploying can take longer than providers are
+// willing to wait for a response, so it's queued as a job.
+func (mr *managementRoutes) gitPushWebhook(rw http.ResponseWriter, rq *http.Request) error {
+	siteSlug := rq.PathValue("slug")
+
+	body, err := io.ReadAll(io.LimitReader(rq.Body, gitWebhookMaxBodySize))
+	if err != nil {
+		return fmt.Errorf("read webhook body: %w", err)
+	}
+
+	push, err := mr.core.ParseGitPush(siteSlug, rq.Header, body)
+	if err != nil {
+		if errors.Is(err, core.ErrInvalidSignature) {
+			rw.WriteHeader(http.StatusUnauthorized)
+			_, _ = rw.Write([]byte(err.Error()))
+			return nil
+		}
+		var e *core.Error
+		if errors.As(err, &e) {
+			_ = badRequestResponse(rw, err.Error())
+			return nil
+		}
+		return fmt.Errorf("parse push webhook: %w", err)
+	}
+
+	if push == nil {
+		_, _ = rw.Write([]byte("Ignored (not a push to a branch)"))
+		return nil
+	}
+
+	conf, err := database.GetSiteGit(mr.core.Database, siteSlug)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			_ = badRequestResponse(rw, core.ErrGitNotEnabled.Error())
+			return nil
+		}
+		return fmt.Errorf("get site Git configuration: %w", err)
+	}
+
+	if push.Branch != conf.Branch {
+		_, _ = rw.Write([]byte(fmt.Sprintf("Ignored (push to %s, not %s)", push.Branch, conf.Branch)))
+		return nil
+	}
+
+	entry := &database.AuditLogModel{
+		Actor:  "git:" + push.Provider,
+		Action: "site.deploy.git",
+		Target: fmt.Sprintf("slug=%s commit=%s", siteSlug, push.CommitSHA),
+		Result: core.AuditResultSuccess,
+	}
+
+	job, err := mr.core.QueueGitDeploy(rq.Context(), siteSlug, push.CommitSHA)
+	if err != nil {
+		entry.Result = core.AuditResultFailure
+		entry.Detail = err.Error()
+		mr.recordAudit(rq, entry)
+		return fmt.Errorf("queue Git deployment: %w", err)
+	}
+
+	entry.Detail = fmt.Sprintf("job %d", job.ID)
+	mr.recordAudit(rq, entry)
+
+	rw.WriteHeader(http.StatusAccepted)
+	_, _ = rw.Write([]byte(fmt.Sprintf("Queued job %d to deploy %s", job.ID, push.CommitSHA)))
+	return nil
+}
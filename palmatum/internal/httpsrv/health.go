@@ -0,0 +1,64 @@
+package httpsrv
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// apiRouteHealth reports whether Caddy is serving the routes in the database. It responds with 503 if it isn't and
+// there are no changes waiting to be applied that would fix it.
+func (mr *managementRoutes) apiRouteHealth(rw http.ResponseWriter, rq *http.Request) error {
+	health, err := mr.core.CheckRouteHealth(rq.Context())
+	if err != nil {
+		return fmt.Errorf("check route health: %w", err)
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	if !health.Healthy() {
+		rw.WriteHeader(http.StatusServiceUnavailable)
+	}
+	return json.NewEncoder(rw).Encode(health)
+}
+
+const healthCheckTimeout = time.Second * 5
+
+func (mr *managementRoutes) healthResponse(rw http.ResponseWriter, rq *http.Request, ready bool) error {
+	ctx, cancel := context.WithTimeout(rq.Context(), healthCheckTimeout)
+	defer cancel()
+
+	health := mr.core.CheckHealth(ctx, ready)
+
+	rw.Header().Set("Content-Type", "application/json")
+	rw.Header().Set("Cache-Control", "no-store")
+	if !health.Healthy() {
+		rw.WriteHeader(http.StatusServiceUnavailable)
+	}
+	return json.NewEncoder(rw).Encode(health)
+}
+
+// healthz reports whether the database and Caddy can be reached and the routing table was last loaded successfully.
+func (mr *managementRoutes) healthz(rw http.ResponseWriter, rq *http.Request) error {
+	return mr.healthResponse(rw, rq, false)
+}
+
+// readyz additionally reports whether Caddy is serving the routes in the database.
+func (mr *managementRoutes) readyz(rw http.ResponseWriter, rq *http.Request) error {
+	return mr.healthResponse(rw, rq, true)
+}
+
+func (mr *managementRoutes) status(rw http.ResponseWriter, rq *http.Request) error {
+	ctx, cancel := context.WithTimeout(rq.Context(), healthCheckTimeout)
+	defer cancel()
+
+	status, err := mr.core.GetStatus(ctx)
+	if err != nil {
+		return fmt.Errorf("get status: %w", err)
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	rw.Header().Set("Cache-Control", "no-store")
+	return json.NewEncoder(rw).Encode(status)
+}
@@ -4,20 +4,25 @@ import (
 	"context"
 	"git.tdpain.net/codemicro/palmatum/palmatum/internal/config"
 	"git.tdpain.net/codemicro/palmatum/palmatum/internal/core"
+	semconv "go.opentelemetry.io/otel/semconv/v1.24.0"
+	"go.opentelemetry.io/otel/trace"
 	"go.uber.org/fx"
 	"log/slog"
 	"net/http"
+	"strconv"
 	"strings"
+	"time"
 )
 
 type ServerArgs struct {
 	fx.In
 
-	Lifecycle  fx.Lifecycle
-	Shutdowner fx.Shutdowner
-	Logger     *slog.Logger
-	Config     *config.Config
-	Core       *core.Core
+	Lifecycle      fx.Lifecycle
+	Shutdowner     fx.Shutdowner
+	Logger         *slog.Logger
+	Config         *config.Config
+	Core           *core.Core
+	TracerProvider trace.TracerProvider
 }
 
 func newServer(args ServerArgs, addr string, handler http.Handler) *http.Server {
@@ -72,6 +77,109 @@ func IsBrowser(r *http.Request) bool {
 	return false
 }
 
+// parseFormBool interprets a form value as a boolean. HTML checkboxes submit "on" when checked and nothing when they're
+// not, whereas API clients are more likely to send "true" or "1".
+func parseFormBool(v string) bool {
+	switch strings.ToLower(strings.TrimSpace(v)) {
+	case "on", "true", "1", "yes":
+		return true
+	}
+	return false
+}
+
+// parseFormInt interprets a form value as an integer, treating an empty field as zero.
+func parseFormInt(v string) (int, error) {
+	v = strings.TrimSpace(v)
+	if v == "" {
+		return 0, nil
+	}
+	return strconv.Atoi(v)
+}
+
+// statusRecorder records the status code and size of a response.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	size   int64
+}
+
+func (sr *statusRecorder) WriteHeader(code int) {
+	if sr.status == 0 {
+		sr.status = code
+	}
+	sr.ResponseWriter.WriteHeader(code)
+}
+
+func (sr *statusRecorder) Write(p []byte) (int, error) {
+	if sr.status == 0 {
+		sr.status = http.StatusOK
+	}
+	n, err := sr.ResponseWriter.Write(p)
+	sr.size += int64(n)
+	return n, err
+}
+
+func (sr *statusRecorder) Unwrap() http.ResponseWriter {
+	return sr.ResponseWriter
+}
+
+// isMonitoringRequest reports whether rq was made by a load balancer or monitoring system. These requests are frequent
+// and rarely interesting, so they're not traced and are only logged at debug level.
+func isMonitoringRequest(rq *http.Request) bool {
+	switch rq.URL.Path {
+	case "/healthz", "/readyz", "/metrics":
+		return true
+	}
+	return false
+}
+
+// nameSpans names the span for each request after the pattern that it matched, once handler has routed it.
+func nameSpans(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, rq *http.Request) {
+		handler.ServeHTTP(rw, rq)
+
+		if rq.Pattern != "" {
+			span := trace.SpanFromContext(rq.Context())
+			span.SetName(rq.Pattern)
+			span.SetAttributes(semconv.HTTPRoute(rq.Pattern))
+		}
+	})
+}
+
+// logRequests logs every request made to handler once it's been responded to.
+func logRequests(logger *slog.Logger, handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, rq *http.Request) {
+		start := time.Now()
+		sr := &statusRecorder{ResponseWriter: rw}
+
+		handler.ServeHTTP(sr, rq)
+
+		if sr.status == 0 {
+			sr.status = http.StatusOK
+		}
+
+		level := slog.LevelInfo
+		if isMonitoringRequest(rq) {
+			level = slog.LevelDebug
+		}
+
+		attrs := []any{
+			"method", rq.Method,
+			"path", rq.URL.Path,
+			"status", sr.status,
+			"size", sr.size,
+			"duration", time.Since(start),
+			"remoteAddr", rq.RemoteAddr,
+			"userAgent", rq.UserAgent(),
+		}
+		if sc := trace.SpanContextFromContext(rq.Context()); sc.IsValid() {
+			attrs = append(attrs, "traceID", sc.TraceID().String())
+		}
+
+		logger.Log(rq.Context(), level, "http request", attrs...)
+	})
+}
+
 type handlerWithError func(http.ResponseWriter, *http.Request) error
 
 func handleErrors(logger *slog.Logger, he handlerWithError) http.HandlerFunc {
@@ -83,3 +191,42 @@ func handleErrors(logger *slog.Logger, he handlerWithError) http.HandlerFunc {
 		}
 	}
 }
+
+// routeWaitResponseWriter waits for routing changes to be applied before a successful response is sent. If they can't
+// be applied, the response is replaced with an error.
+type routeWaitResponseWriter struct {
+	http.ResponseWriter
+	ctx         context.Context
+	wait        func(context.Context) error
+	wroteHeader bool
+	failed      bool
+}
+
+func (w *routeWaitResponseWriter) WriteHeader(code int) {
+	if w.wroteHeader {
+		return
+	}
+	w.wroteHeader = true
+
+	if code < 400 {
+		if err := w.wait(w.ctx); err != nil {
+			w.failed = true
+			w.Header().Del("HX-Refresh")
+			w.ResponseWriter.WriteHeader(http.StatusBadGateway)
+			_, _ = w.ResponseWriter.Write([]byte("Change saved but could not be applied: " + err.Error()))
+			return
+		}
+	}
+
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *routeWaitResponseWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.failed {
+		return len(b), nil
+	}
+	return w.ResponseWriter.Write(b)
+}
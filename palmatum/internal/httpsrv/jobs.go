@@ -0,0 +1,104 @@
+package httpsrv
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"git.tdpain.net/codemicro/palmatum/palmatum/internal/core"
+	"git.tdpain.net/codemicro/palmatum/palmatum/internal/database"
+	"net/http"
+	"strconv"
+)
+
+const maxJobsListed = 100
+
+// jobAcceptedResponse responds to a request that has queued a job. Browsers are sent a partial that polls the job's
+// status, and everything else is sent the job as JSON.
+func (mr *managementRoutes) jobAcceptedResponse(rw http.ResponseWriter, rq *http.Request, job *database.JobModel) error {
+	rw.Header().Set("Location", "/api/job?id="+strconv.Itoa(job.ID))
+
+	if IsBrowser(rq) {
+		rw.WriteHeader(http.StatusAccepted)
+		return mr.templates.ExecuteTemplate(rw, "job.html", job)
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(http.StatusAccepted)
+	return json.NewEncoder(rw).Encode(job)
+}
+
+func (mr *managementRoutes) getJobFromRequest(rw http.ResponseWriter, rq *http.Request) (*database.JobModel, error) {
+	jobID, err := strconv.Atoi(rq.URL.Query().Get("id"))
+	if err != nil {
+		_ = badRequestResponse(rw, "invalid job ID")
+		return nil, nil
+	}
+
+	job, err := mr.core.GetJob(jobID)
+	if err != nil {
+		var e *core.Error
+		if errors.As(err, &e) {
+			_ = badRequestResponse(rw, err.Error())
+			return nil, nil
+		}
+		return nil, fmt.Errorf("get job: %w", err)
+	}
+
+	return job, nil
+}
+
+func (mr *managementRoutes) apiGetJob(rw http.ResponseWriter, rq *http.Request) error {
+	job, err := mr.getJobFromRequest(rw, rq)
+	if job == nil {
+		return err
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(rw).Encode(job)
+}
+
+func (mr *managementRoutes) apiGetJobs(rw http.ResponseWriter, rq *http.Request) error {
+	limit := maxJobsListed
+	if l := rq.URL.Query().Get("limit"); l != "" {
+		var err error
+		if limit, err = strconv.Atoi(l); err != nil || limit < 1 || limit > maxJobsListed {
+			_ = badRequestResponse(rw, fmt.Sprintf("invalid limit (must be between 1 and %d)", maxJobsListed))
+			return nil
+		}
+	}
+
+	jobs, err := database.GetJobs(mr.core.Database, rq.URL.Query().Get("status"), limit)
+	if err != nil {
+		return fmt.Errorf("get jobs: %w", err)
+	}
+
+	if jobs == nil {
+		jobs = []*database.JobModel{}
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(rw).Encode(jobs)
+}
+
+func (mr *managementRoutes) apiReconfigure(rw http.ResponseWriter, rq *http.Request) error {
+	job, err := mr.core.QueueReconfigure(rq.Context())
+	if err != nil {
+		return fmt.Errorf("queue reconfiguration: %w", err)
+	}
+	return mr.jobAcceptedResponse(rw, rq, job)
+}
+
+// jobPartial renders the status of a job. It polls itself until the job has finished, and then reloads the page if
+// the job succeeded.
+func (mr *managementRoutes) jobPartial(rw http.ResponseWriter, rq *http.Request) error {
+	job, err := mr.getJobFromRequest(rw, rq)
+	if job == nil {
+		return err
+	}
+
+	if job.Status == database.JobStatusSucceeded {
+		rw.Header().Set("HX-Refresh", "true")
+	}
+
+	return mr.templates.ExecuteTemplate(rw, "job.html", job)
+}
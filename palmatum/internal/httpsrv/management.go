@@ -5,8 +5,15 @@ import (
 	_ "embed"
 	"errors"
 	"fmt"
+	"git.tdpain.net/codemicro/palmatum/palmatum/internal/caddyController"
 	"git.tdpain.net/codemicro/palmatum/palmatum/internal/config"
 	"git.tdpain.net/codemicro/palmatum/palmatum/internal/core"
+	"git.tdpain.net/codemicro/palmatum/palmatum/internal/database"
+	"git.tdpain.net/codemicro/palmatum/palmatum/internal/logging"
+	"git.tdpain.net/codemicro/palmatum/palmatum/internal/tracing"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel/trace"
 	"go.uber.org/fx"
 	"html/template"
 	"io/fs"
@@ -20,6 +27,8 @@ import (
 var staticAssets embed.FS
 
 func NewManagementServer(lc fx.Lifecycle, args ServerArgs) (*http.Server, error) {
+	args.Logger = args.Logger.With(logging.AreaKey, "http")
+
 	mux := http.NewServeMux()
 	mr := managementRoutes{
 		logger: args.Logger,
@@ -31,18 +40,90 @@ func NewManagementServer(lc fx.Lifecycle, args ServerArgs) (*http.Server, error)
 		OnStart: mr.initManagementTemplates,
 	})
 
-	mux.HandleFunc("POST /api/site", handleErrors(args.Logger, mr.apiCreateSite))
-	mux.HandleFunc("POST /api/site/bundle", handleErrors(args.Logger, mr.apiUploadSiteBundle))
-	mux.HandleFunc("DELETE /api/site", handleErrors(args.Logger, mr.apiDeleteSite))
-	mux.HandleFunc("POST /api/site/route", handleErrors(args.Logger, mr.apiCreateRoute))
-	mux.HandleFunc("DELETE /api/site/route", handleErrors(args.Logger, mr.apiDeleteRoute))
+	admin := func(he handlerWithError) http.HandlerFunc {
+		return handleErrors(args.Logger, mr.requireRole(core.RoleAdmin, he))
+	}
+	deployer := func(he handlerWithError) http.HandlerFunc {
+		return handleErrors(args.Logger, mr.requireRole(core.RoleDeployer, he))
+	}
+	readOnly := func(he handlerWithError) http.HandlerFunc {
+		return handleErrors(args.Logger, mr.requireRole(core.RoleReadOnly, he))
+	}
 
-	mux.HandleFunc("GET /{$}", handleErrors(args.Logger, mr.index))
-	mux.HandleFunc("GET /createSite", handleErrors(args.Logger, mr.createSitePartial))
-	mux.HandleFunc("GET /uploadSite", handleErrors(args.Logger, mr.uploadSitePartial))
-	mux.HandleFunc("GET /deleteSite", handleErrors(args.Logger, mr.deleteSitePartial))
-	mux.HandleFunc("GET /addRoute", handleErrors(args.Logger, mr.addRoutePartial))
-	mux.HandleFunc("GET /deleteRoute", handleErrors(args.Logger, mr.deleteRoutePartial))
+	mux.HandleFunc("POST /api/site", admin(mr.audited("site.create", mr.apiCreateSite, "slug")))
+	mux.HandleFunc("POST /api/site/bundle", deployer(mr.audited("site.upload", mr.apiUploadSiteBundle, "slug")))
+	mux.HandleFunc("DELETE /api/site", admin(mr.audited("site.delete", mr.waitable(mr.apiDeleteSite), "slug")))
+	mux.HandleFunc("POST /api/site/settings", admin(mr.audited("site.settings", mr.waitable(mr.apiUpdateSiteSettings), "slug", "spaFallback", "quotaMegabytes")))
+	mux.HandleFunc("POST /api/site/access", admin(mr.audited("site.access", mr.waitable(mr.apiUpdateSiteAccess), "slug", "allowedIPs")))
+	mux.HandleFunc("POST /api/site/limits", admin(mr.audited("site.limits", mr.waitable(mr.apiUpdateSiteLimits), "slug", "requests", "bandwidthKilobytes")))
+	mux.HandleFunc("POST /api/site/credential", admin(mr.audited("site.credential.create", mr.waitable(mr.apiCreateSiteCredential), "slug", "username")))
+	mux.HandleFunc("DELETE /api/site/credential", admin(mr.audited("site.credential.delete", mr.waitable(mr.apiDeleteSiteCredential), "slug", "username")))
+	mux.HandleFunc("POST /api/site/oidc", admin(mr.audited("site.oidc.update", mr.waitable(mr.apiUpdateSiteOIDC), "slug", "issuer", "clientID")))
+	mux.HandleFunc("DELETE /api/site/oidc", admin(mr.audited("site.oidc.delete", mr.waitable(mr.apiDeleteSiteOIDC), "slug")))
+	mux.HandleFunc("POST /api/site/git", admin(mr.audited("site.git.update", mr.apiUpdateSiteGit, "slug", "branch", "directory")))
+	mux.HandleFunc("DELETE /api/site/git", admin(mr.audited("site.git.delete", mr.apiDeleteSiteGit, "slug")))
+	mux.HandleFunc("POST /api/site/git/deploy", deployer(mr.audited("site.deploy.git", mr.apiDeploySiteGit, "slug")))
+	mux.HandleFunc("POST /api/site/build", admin(mr.audited("site.build.update", mr.apiUpdateSiteBuild, "slug", "command", "outputDirectory")))
+	mux.HandleFunc("DELETE /api/site/build", admin(mr.audited("site.build.delete", mr.apiDeleteSiteBuild, "slug")))
+	mux.HandleFunc("POST /api/site/route", admin(mr.audited("route.create", mr.waitable(mr.apiCreateRoute), "slug", "domain", "path")))
+	mux.HandleFunc("DELETE /api/site/route", admin(mr.audited("route.delete", mr.waitable(mr.apiDeleteRoute), "id")))
+	mux.HandleFunc("POST /api/user/role", admin(mr.audited("user.role", mr.apiSetUserRole, "id", "role")))
+	mux.HandleFunc("DELETE /api/user", admin(mr.audited("user.delete", mr.apiDeleteUser, "id")))
+	mux.HandleFunc("GET /api/audit", admin(mr.apiGetAuditLog))
+	mux.HandleFunc("GET /api/job", readOnly(mr.apiGetJob))
+	mux.HandleFunc("GET /api/jobs", readOnly(mr.apiGetJobs))
+	mux.HandleFunc("GET /api/site/accessLog", readOnly(mr.apiGetAccessLog))
+	mux.HandleFunc("GET /api/site/analytics", readOnly(mr.apiGetSiteAnalytics))
+	mux.HandleFunc("GET /api/storage", readOnly(mr.apiGetStorageUsage))
+	mux.HandleFunc("GET /api/backup", admin(mr.audited("backup.create", mr.apiGetBackup)))
+	mux.HandleFunc("POST /api/storage/collect", admin(mr.audited("storage.collect", mr.apiCollectOrphanedArchives)))
+	mux.HandleFunc("POST /api/reconfigure", admin(mr.audited("caddy.reconfigure", mr.apiReconfigure)))
+	mux.HandleFunc("GET /api/health/routes", readOnly(mr.apiRouteHealth))
+	mux.HandleFunc("POST /api/webhook", admin(mr.audited("webhook.create", mr.apiCreateWebhook, "url", "events")))
+	mux.HandleFunc("DELETE /api/webhook", admin(mr.audited("webhook.delete", mr.apiDeleteWebhook, "id")))
+
+	mux.HandleFunc("GET /auth/forward", handleErrors(args.Logger, mr.forwardAuth))
+	mux.HandleFunc("GET "+caddyController.ManagementSiteLoginCallbackPath, handleErrors(args.Logger, mr.siteLoginCallback))
+
+	mux.HandleFunc("POST /hooks/git/{slug}", handleErrors(args.Logger, mr.gitPushWebhook))
+
+	// These are deliberately unauthenticated so that they can be used by load balancers and monitoring
+	mux.HandleFunc("GET /healthz", handleErrors(args.Logger, mr.healthz))
+	mux.HandleFunc("GET /readyz", handleErrors(args.Logger, mr.readyz))
+	mux.HandleFunc("GET /status", handleErrors(args.Logger, mr.status))
+	mux.Handle("GET /metrics", promhttp.HandlerFor(args.Core.MetricsGatherer(), promhttp.HandlerOpts{
+		// If Caddy can't be reached, Palmatum's own metrics are still useful
+		ErrorHandling: promhttp.ContinueOnError,
+		ErrorLog:      slog.NewLogLogger(args.Logger.Handler(), slog.LevelWarn),
+	}))
+
+	mux.HandleFunc("GET /login", handleErrors(args.Logger, mr.loginPage))
+	mux.HandleFunc("GET /login/start", handleErrors(args.Logger, mr.beginLogin))
+	mux.HandleFunc("GET "+managementLoginCallbackPath, handleErrors(args.Logger, mr.loginCallback))
+	mux.HandleFunc("POST /logout", handleErrors(args.Logger, mr.logout))
+
+	mux.HandleFunc("GET /{$}", readOnly(mr.index))
+	mux.HandleFunc("GET /createSite", admin(mr.createSitePartial))
+	mux.HandleFunc("GET /uploadSite", deployer(mr.uploadSitePartial))
+	mux.HandleFunc("GET /deleteSite", admin(mr.deleteSitePartial))
+	mux.HandleFunc("GET /addRoute", admin(mr.addRoutePartial))
+	mux.HandleFunc("GET /deleteRoute", admin(mr.deleteRoutePartial))
+	mux.HandleFunc("GET /siteSettings", admin(mr.siteSettingsPartial))
+	mux.HandleFunc("GET /siteAccess", admin(mr.siteAccessPartial))
+	mux.HandleFunc("GET /siteGit", admin(mr.siteGitPartial))
+	mux.HandleFunc("GET /siteBuild", readOnly(mr.siteBuildPartial))
+	mux.HandleFunc("GET /buildLog", readOnly(mr.buildLogPartial))
+	mux.HandleFunc("GET /job", readOnly(mr.jobPartial))
+	mux.HandleFunc("GET /siteHeaders", readOnly(mr.siteHeadersPartial))
+	mux.HandleFunc("GET /accessLog", readOnly(mr.accessLogPartial))
+	mux.HandleFunc("GET /accessLog/entries", readOnly(mr.accessLogEntriesPartial))
+	mux.HandleFunc("GET /siteAnalytics", readOnly(mr.siteAnalyticsPartial))
+	mux.HandleFunc("GET /siteAnalytics/summary", readOnly(mr.siteAnalyticsSummaryPartial))
+	mux.HandleFunc("GET /users", admin(mr.usersPartial))
+	mux.HandleFunc("GET /auditLog", admin(mr.auditLogPartial))
+	mux.HandleFunc("GET /auditLog/entries", admin(mr.auditLogEntriesPartial))
+	mux.HandleFunc("GET /webhooks", admin(mr.webhooksPartial))
+	mux.HandleFunc("GET /webhookDeliveries", admin(mr.webhookDeliveriesPartial))
 
 	{
 		subfs, err := fs.Sub(staticAssets, "static")
@@ -52,7 +133,19 @@ func NewManagementServer(lc fx.Lifecycle, args ServerArgs) (*http.Server, error)
 		mux.Handle("GET /", http.FileServer(http.FS(subfs)))
 	}
 
-	return newServer(args, args.Config.HTTP.ManagementAddress(), mux), nil
+	return newServer(args, args.Config.HTTP.ManagementAddress(), instrumentManagementHandler(args.Logger, args.TracerProvider, mux)), nil
+}
+
+// instrumentManagementHandler traces and logs every request made to handler, apart from those made by monitoring
+// systems, which are only logged.
+func instrumentManagementHandler(logger *slog.Logger, tp trace.TracerProvider, handler http.Handler) http.Handler {
+	return otelhttp.NewHandler(logRequests(logger, nameSpans(handler)), "management request",
+		otelhttp.WithTracerProvider(tp),
+		otelhttp.WithPropagators(tracing.Propagator),
+		otelhttp.WithFilter(func(rq *http.Request) bool {
+			return !isMonitoringRequest(rq)
+		}),
+	)
 }
 
 type managementRoutes struct {
@@ -97,6 +190,11 @@ func (mr *managementRoutes) apiDeleteSite(rw http.ResponseWriter, rq *http.Reque
 	}
 
 	if err := mr.core.DeleteSite(siteSlug); err != nil {
+		var e *core.Error
+		if errors.As(err, &e) {
+			_ = badRequestResponse(rw, err.Error())
+			return nil
+		}
 		return fmt.Errorf("delete site: %w", err)
 	}
 
@@ -136,13 +234,190 @@ func (mr *managementRoutes) apiUploadSiteBundle(rw http.ResponseWriter, rq *http
 		return nil
 	}
 
-	contentPath, err := mr.core.IngestSiteArchive(formFile)
+	job, err := mr.core.DeploySiteArchive(rq.Context(), siteSlug, formFile, nil)
+	if err != nil {
+		var e *core.Error
+		if errors.As(err, &e) {
+			_ = badRequestResponse(rw, err.Error())
+			return nil
+		}
+		return fmt.Errorf("deploy site archive: %w", err)
+	}
+
+	return mr.jobAcceptedResponse(rw, rq, job)
+}
+
+func (mr *managementRoutes) apiUpdateSiteSettings(rw http.ResponseWriter, rq *http.Request) error {
+	siteSlug := strings.TrimSpace(rq.FormValue("slug"))
+	if siteSlug == "" {
+		_ = badRequestResponse(rw, "Missing slug")
+		return nil
+	}
+
+	// The quota is optional so that API clients that only know about the SPA fallback don't reset it
+	var quota *int
+	if _, found := rq.Form["quotaMegabytes"]; found {
+		n, err := parseFormInt(rq.FormValue("quotaMegabytes"))
+		if err != nil || n < 0 {
+			_ = badRequestResponse(rw, core.ErrInvalidLimit.Error())
+			return nil
+		}
+		quota = &n
+	}
+
+	if err := mr.core.UpdateSiteSettings(siteSlug, parseFormBool(rq.FormValue("spaFallback")), quota); err != nil {
+		var e *core.Error
+		if errors.As(err, &e) {
+			_ = badRequestResponse(rw, err.Error())
+			return nil
+		}
+		return fmt.Errorf("update site settings: %w", err)
+	}
+
+	rw.Header().Set("HX-Refresh", "true")
+	rw.WriteHeader(http.StatusOK)
+	return nil
+}
+
+func (mr *managementRoutes) apiUpdateSiteAccess(rw http.ResponseWriter, rq *http.Request) error {
+	siteSlug := strings.TrimSpace(rq.FormValue("slug"))
+	if siteSlug == "" {
+		_ = badRequestResponse(rw, "Missing slug")
+		return nil
+	}
+
+	if err := mr.core.SetSiteAllowedIPs(siteSlug, rq.FormValue("allowedIPs")); err != nil {
+		var e *core.Error
+		if errors.As(err, &e) {
+			_ = badRequestResponse(rw, err.Error())
+			return nil
+		}
+		return fmt.Errorf("set allowed IPs: %w", err)
+	}
+
+	rw.Header().Set("HX-Refresh", "true")
+	rw.WriteHeader(http.StatusOK)
+	return nil
+}
+
+func (mr *managementRoutes) apiUpdateSiteLimits(rw http.ResponseWriter, rq *http.Request) error {
+	siteSlug := strings.TrimSpace(rq.FormValue("slug"))
+	if siteSlug == "" {
+		_ = badRequestResponse(rw, "Missing slug")
+		return nil
+	}
+
+	requests, err := parseFormInt(rq.FormValue("requests"))
+	if err != nil {
+		_ = badRequestResponse(rw, core.ErrInvalidLimit.Error())
+		return nil
+	}
+
+	bandwidth, err := parseFormInt(rq.FormValue("bandwidthKilobytes"))
+	if err != nil {
+		_ = badRequestResponse(rw, core.ErrInvalidLimit.Error())
+		return nil
+	}
+
+	if err := mr.core.SetSiteRateLimits(siteSlug, requests, bandwidth); err != nil {
+		var e *core.Error
+		if errors.As(err, &e) {
+			_ = badRequestResponse(rw, err.Error())
+			return nil
+		}
+		return fmt.Errorf("set rate limits: %w", err)
+	}
+
+	rw.Header().Set("HX-Refresh", "true")
+	rw.WriteHeader(http.StatusOK)
+	return nil
+}
+
+func (mr *managementRoutes) apiCreateSiteCredential(rw http.ResponseWriter, rq *http.Request) error {
+	siteSlug := strings.TrimSpace(rq.FormValue("slug"))
+	if siteSlug == "" {
+		_ = badRequestResponse(rw, "Missing slug")
+		return nil
+	}
+
+	if err := mr.core.AddSiteCredential(siteSlug, strings.TrimSpace(rq.FormValue("username")), rq.FormValue("password")); err != nil {
+		var e *core.Error
+		if errors.As(err, &e) {
+			_ = badRequestResponse(rw, err.Error())
+			return nil
+		}
+		return fmt.Errorf("add site credential: %w", err)
+	}
+
+	rw.Header().Set("HX-Refresh", "true")
+	rw.WriteHeader(http.StatusCreated)
+	return nil
+}
+
+func (mr *managementRoutes) apiDeleteSiteCredential(rw http.ResponseWriter, rq *http.Request) error {
+	siteSlug := strings.TrimSpace(rq.FormValue("slug"))
+	if siteSlug == "" {
+		_ = badRequestResponse(rw, "Missing slug")
+		return nil
+	}
+
+	if err := mr.core.DeleteSiteCredential(siteSlug, rq.FormValue("username")); err != nil {
+		var e *core.Error
+		if errors.As(err, &e) {
+			_ = badRequestResponse(rw, err.Error())
+			return nil
+		}
+		return fmt.Errorf("delete site credential: %w", err)
+	}
+
+	rw.Header().Set("HX-Refresh", "true")
+	rw.WriteHeader(http.StatusOK)
+	return nil
+}
+
+func (mr *managementRoutes) apiUpdateSiteOIDC(rw http.ResponseWriter, rq *http.Request) error {
+	siteSlug := strings.TrimSpace(rq.FormValue("slug"))
+	if siteSlug == "" {
+		_ = badRequestResponse(rw, "Missing slug")
+		return nil
+	}
+
+	err := mr.core.SetSiteOIDC(&database.SiteOIDCModel{
+		Site:          siteSlug,
+		Issuer:        rq.FormValue("issuer"),
+		ClientID:      rq.FormValue("clientID"),
+		ClientSecret:  rq.FormValue("clientSecret"),
+		AllowedEmails: rq.FormValue("allowedEmails"),
+		AllowedGroups: rq.FormValue("allowedGroups"),
+	})
 	if err != nil {
-		return fmt.Errorf("ingest site archive site archive: %w", err)
+		var e *core.Error
+		if errors.As(err, &e) {
+			_ = badRequestResponse(rw, err.Error())
+			return nil
+		}
+		return fmt.Errorf("set site OIDC configuration: %w", err)
 	}
 
-	if err := mr.core.UpdateContentPath(siteSlug, contentPath); err != nil {
-		return fmt.Errorf("update site: %w", err)
+	rw.Header().Set("HX-Refresh", "true")
+	rw.WriteHeader(http.StatusOK)
+	return nil
+}
+
+func (mr *managementRoutes) apiDeleteSiteOIDC(rw http.ResponseWriter, rq *http.Request) error {
+	siteSlug := strings.TrimSpace(rq.FormValue("slug"))
+	if siteSlug == "" {
+		_ = badRequestResponse(rw, "Missing slug")
+		return nil
+	}
+
+	if err := mr.core.DisableSiteOIDC(siteSlug); err != nil {
+		var e *core.Error
+		if errors.As(err, &e) {
+			_ = badRequestResponse(rw, err.Error())
+			return nil
+		}
+		return fmt.Errorf("disable site OIDC: %w", err)
 	}
 
 	rw.Header().Set("HX-Refresh", "true")
@@ -181,6 +456,11 @@ func (mr *managementRoutes) apiDeleteRoute(rw http.ResponseWriter, rq *http.Requ
 	}
 
 	if err := mr.core.DeleteRoute(routeID); err != nil {
+		var e *core.Error
+		if errors.As(err, &e) {
+			_ = badRequestResponse(rw, err.Error())
+			return nil
+		}
 		return fmt.Errorf("delete route: %w", err)
 	}
 
@@ -188,3 +468,22 @@ func (mr *managementRoutes) apiDeleteRoute(rw http.ResponseWriter, rq *http.Requ
 	rw.WriteHeader(http.StatusOK)
 	return nil
 }
+
+// waitable lets callers of he wait until any changes it makes to routing are live by setting the wait form value.
+// Otherwise, the response is sent as soon as the change has been saved and it's applied shortly afterwards.
+func (mr *managementRoutes) waitable(he handlerWithError) handlerWithError {
+	return func(rw http.ResponseWriter, rq *http.Request) error {
+		if !parseFormBool(rq.FormValue("wait")) {
+			return he(rw, rq)
+		}
+
+		wrw := &routeWaitResponseWriter{ResponseWriter: rw, ctx: rq.Context(), wait: mr.core.WaitForRoutes}
+		if err := he(wrw, rq); err != nil {
+			return err
+		}
+		if !wrw.wroteHeader {
+			wrw.WriteHeader(http.StatusOK)
+		}
+		return nil
+	}
+}
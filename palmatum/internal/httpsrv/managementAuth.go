@@ -0,0 +1,245 @@
+package httpsrv
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"git.tdpain.net/codemicro/palmatum/palmatum/internal/core"
+	"git.tdpain.net/codemicro/palmatum/palmatum/internal/database"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// These routes handle logging in to the management UI when managementAuth.oidcIssuer is set. requireRole wraps every
+// other management route, and is a no-op when login isn't enabled.
+
+const managementLoginCallbackPath = "/login/callback"
+
+type userContextKey struct{}
+
+// userFromContext returns the user making the current request, or nil if login isn't enabled.
+func userFromContext(ctx context.Context) *core.User {
+	u, _ := ctx.Value(userContextKey{}).(*core.User)
+	return u
+}
+
+// managementBaseURL returns the URL that the management server is accessed through, without a trailing slash.
+func (mr *managementRoutes) managementBaseURL(rq *http.Request) string {
+	if pu := mr.config.ManagementAuth.PublicURL; pu != "" {
+		return strings.TrimSuffix(pu, "/")
+	}
+
+	scheme := "http"
+	if rq.TLS != nil {
+		scheme = "https"
+	}
+	if p := rq.Header.Get("X-Forwarded-Proto"); p != "" {
+		scheme = p
+	}
+
+	return (&url.URL{
+		Scheme: scheme,
+		Host:   rq.Host,
+	}).String()
+}
+
+func (mr *managementRoutes) managementLoginRedirectURL(rq *http.Request) string {
+	return mr.managementBaseURL(rq) + managementLoginCallbackPath
+}
+
+func (mr *managementRoutes) requireRole(role core.Role, he handlerWithError) handlerWithError {
+	return func(rw http.ResponseWriter, rq *http.Request) error {
+		if !mr.config.ManagementAuth.Enabled() {
+			return he(rw, rq)
+		}
+
+		var user *core.User
+		if cookie, err := rq.Cookie(core.ManagementSessionCookieName); err == nil {
+			user, err = mr.core.CheckManagementSession(cookie.Value)
+			if err != nil {
+				var e *core.Error
+				if !errors.As(err, &e) {
+					return fmt.Errorf("check management session: %w", err)
+				}
+			}
+		}
+
+		if user == nil {
+			if !IsBrowser(rq) {
+				rw.WriteHeader(http.StatusUnauthorized)
+				_, _ = rw.Write([]byte("Unauthorized"))
+				return nil
+			}
+
+			loginURL := "/login?" + url.Values{"next": {rq.URL.RequestURI()}}.Encode()
+			if rq.Header.Get("HX-Request") != "" {
+				// The request URI of an htmx request is a partial, which isn't somewhere we want to send the user back to
+				rw.Header().Set("HX-Redirect", "/login")
+				rw.WriteHeader(http.StatusUnauthorized)
+				return nil
+			}
+			http.Redirect(rw, rq, loginURL, http.StatusFound)
+			return nil
+		}
+
+		if !user.EffectiveRole.Includes(role) {
+			rw.WriteHeader(http.StatusForbidden)
+			_, _ = rw.Write([]byte(fmt.Sprintf("Forbidden (requires the %s role)", role)))
+			return nil
+		}
+
+		return he(rw, rq.WithContext(context.WithValue(rq.Context(), userContextKey{}, user)))
+	}
+}
+
+func (mr *managementRoutes) loginPage(rw http.ResponseWriter, rq *http.Request) error {
+	if !mr.config.ManagementAuth.Enabled() {
+		http.Redirect(rw, rq, "/", http.StatusFound)
+		return nil
+	}
+
+	return mr.templates.ExecuteTemplate(rw, "login.html", &struct {
+		Next      string
+		LoggedOut bool
+		Error     string
+	}{
+		Next:      rq.URL.Query().Get("next"),
+		LoggedOut: rq.URL.Query().Has("loggedOut"),
+		Error:     rq.URL.Query().Get("error"),
+	})
+}
+
+func (mr *managementRoutes) beginLogin(rw http.ResponseWriter, rq *http.Request) error {
+	authURL, nonce, err := mr.core.BeginManagementLogin(rq.Context(), mr.managementLoginRedirectURL(rq), rq.URL.Query().Get("next"))
+	if err != nil {
+		var e *core.Error
+		if errors.As(err, &e) {
+			_ = badRequestResponse(rw, err.Error())
+			return nil
+		}
+		return fmt.Errorf("begin management login: %w", err)
+	}
+
+	http.SetCookie(rw, &http.Cookie{
+		Name:     core.ManagementLoginNonceCookieName,
+		Value:    nonce,
+		Path:     managementLoginCallbackPath,
+		MaxAge:   int((time.Minute * 10).Seconds()),
+		HttpOnly: true,
+		Secure:   strings.HasPrefix(mr.managementLoginRedirectURL(rq), "https:"),
+		SameSite: http.SameSiteLaxMode,
+	})
+	http.Redirect(rw, rq, authURL, http.StatusFound)
+	return nil
+}
+
+func (mr *managementRoutes) loginCallback(rw http.ResponseWriter, rq *http.Request) error {
+	if errMsg := rq.URL.Query().Get("error"); errMsg != "" {
+		http.Redirect(rw, rq, "/login?"+url.Values{"error": {"Login failed: " + errMsg}}.Encode(), http.StatusFound)
+		return nil
+	}
+
+	var nonce string
+	if cookie, err := rq.Cookie(core.ManagementLoginNonceCookieName); err == nil {
+		nonce = cookie.Value
+	}
+
+	http.SetCookie(rw, &http.Cookie{
+		Name:   core.ManagementLoginNonceCookieName,
+		Path:   managementLoginCallbackPath,
+		MaxAge: -1,
+	})
+
+	token, user, returnTo, err := mr.core.CompleteManagementLogin(rq.Context(), rq.URL.Query().Get("state"), rq.URL.Query().Get("code"), nonce, mr.managementLoginRedirectURL(rq))
+	if err != nil {
+		mr.recordAudit(rq, &database.AuditLogModel{
+			Action: "user.login",
+			Result: core.AuditResultFailure,
+			Detail: err.Error(),
+		})
+
+		var e *core.Error
+		if errors.As(err, &e) {
+			http.Redirect(rw, rq, "/login?"+url.Values{"error": {err.Error()}}.Encode(), http.StatusFound)
+			return nil
+		}
+		return fmt.Errorf("complete management login: %w", err)
+	}
+
+	mr.recordAudit(rq, &database.AuditLogModel{
+		Actor:  user.Identifier(),
+		Action: "user.login",
+		Target: "role=" + string(user.EffectiveRole),
+		Result: core.AuditResultSuccess,
+	})
+
+	mr.logger.Info("user logged in to management UI", "id", user.ID, "subject", user.Subject, "email", user.Email, "role", user.EffectiveRole)
+
+	http.SetCookie(rw, &http.Cookie{
+		Name:     core.ManagementSessionCookieName,
+		Value:    token,
+		Path:     "/",
+		Expires:  time.Now().Add(core.ManagementSessionDuration),
+		HttpOnly: true,
+		Secure:   strings.HasPrefix(mr.managementLoginRedirectURL(rq), "https:"),
+		SameSite: http.SameSiteLaxMode,
+	})
+	http.Redirect(rw, rq, returnTo, http.StatusFound)
+	return nil
+}
+
+func (mr *managementRoutes) logout(rw http.ResponseWriter, _ *http.Request) error {
+	http.SetCookie(rw, &http.Cookie{
+		Name:   core.ManagementSessionCookieName,
+		Path:   "/",
+		MaxAge: -1,
+	})
+	rw.Header().Set("HX-Redirect", "/login?loggedOut")
+	rw.WriteHeader(http.StatusOK)
+	return nil
+}
+
+func (mr *managementRoutes) apiSetUserRole(rw http.ResponseWriter, rq *http.Request) error {
+	userID, err := strconv.Atoi(rq.FormValue("id"))
+	if err != nil {
+		_ = badRequestResponse(rw, "invalid user ID")
+		return nil
+	}
+
+	if err := mr.core.SetUserRole(userID, rq.FormValue("role")); err != nil {
+		var e *core.Error
+		if errors.As(err, &e) {
+			_ = badRequestResponse(rw, err.Error())
+			return nil
+		}
+		return fmt.Errorf("set user role: %w", err)
+	}
+
+	rw.Header().Set("HX-Refresh", "true")
+	rw.WriteHeader(http.StatusOK)
+	return nil
+}
+
+func (mr *managementRoutes) apiDeleteUser(rw http.ResponseWriter, rq *http.Request) error {
+	userID, err := strconv.Atoi(rq.FormValue("id"))
+	if err != nil {
+		_ = badRequestResponse(rw, "invalid user ID")
+		return nil
+	}
+
+	if err := mr.core.DeleteUser(userID); err != nil {
+		var e *core.Error
+		if errors.As(err, &e) {
+			_ = badRequestResponse(rw, err.Error())
+			return nil
+		}
+		return fmt.Errorf("delete user: %w", err)
+	}
+
+	rw.Header().Set("HX-Refresh", "true")
+	rw.WriteHeader(http.StatusOK)
+	return nil
+}
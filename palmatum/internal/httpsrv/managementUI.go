@@ -2,7 +2,9 @@ package httpsrv
 
 import (
 	"context"
+	"database/sql"
 	"embed"
+	"errors"
 	"fmt"
 	"html/template"
 	"io/fs"
@@ -10,6 +12,8 @@ import (
 	"slices"
 	"time"
 
+	"git.tdpain.net/codemicro/palmatum/palmatum/internal/caddyController"
+	"git.tdpain.net/codemicro/palmatum/palmatum/internal/core"
 	"git.tdpain.net/codemicro/palmatum/palmatum/internal/database"
 )
 
@@ -22,6 +26,15 @@ func (mr *managementRoutes) initManagementTemplates(_ context.Context) error {
 		"fmtTime": func(ti int64) string {
 			return time.Unix(ti, 0).Format("2006-01-02 15:04")
 		},
+		// can reports whether user has at least the given role. If login isn't enabled, user is nil and everything is
+		// allowed.
+		"can": func(user *core.User, role string) bool {
+			return user == nil || user.EffectiveRole.Includes(core.Role(role))
+		},
+		"roles": func() []core.Role {
+			return core.Roles
+		},
+		"fmtBytes": formatBytes,
 	})
 
 	f, err := fs.Sub(fs.FS(managementTemplateSource), "templates")
@@ -39,8 +52,15 @@ func (mr *managementRoutes) initManagementTemplates(_ context.Context) error {
 
 func (mr *managementRoutes) index(rw http.ResponseWriter, rq *http.Request) error {
 	var templateData = struct {
-		Sites []*database.SiteModel
-	}{}
+		Sites       []*database.SiteModel
+		Storage     *core.StorageUsage
+		BrokenSites map[string]string
+		User        *core.User
+		Analytics   bool
+	}{
+		User:      userFromContext(rq.Context()),
+		Analytics: mr.config.Platform.AccessLogRetentionDays != 0,
+	}
 
 	s, err := database.GetSitesWithRoutes(mr.core.Database)
 	if err != nil {
@@ -57,6 +77,16 @@ func (mr *managementRoutes) index(rw http.ResponseWriter, rq *http.Request) erro
 	})
 	
 	templateData.Sites = s
+
+	templateData.Storage, err = mr.core.GetStorageUsage()
+	if err != nil {
+		return fmt.Errorf("get storage usage: %w", err)
+	}
+
+	templateData.BrokenSites = make(map[string]string)
+	for _, p := range mr.core.ArchiveProblems() {
+		templateData.BrokenSites[p.Site] = p.Problem
+	}
 	
 	return mr.templates.ExecuteTemplate(rw, "index.html", &templateData)
 }
@@ -67,8 +97,27 @@ func (mr *managementRoutes) createSitePartial(rw http.ResponseWriter, _ *http.Re
 }
 
 func (mr *managementRoutes) uploadSitePartial(rw http.ResponseWriter, rq *http.Request) error {
+	var templateData = struct {
+		Slug  string
+		Git   *database.SiteGitModel
+		Build *database.SiteBuildModel
+	}{
+		Slug: rq.URL.Query().Get("slug"),
+	}
+
+	var err error
+	templateData.Git, err = database.GetSiteGit(mr.core.Database, templateData.Slug)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return fmt.Errorf("get site Git configuration: %w", err)
+	}
+
+	templateData.Build, err = database.GetSiteBuild(mr.core.Database, templateData.Slug)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return fmt.Errorf("get site build configuration: %w", err)
+	}
+
 	rw.Header().Set("Hx-Trigger-After-Swap", "showModal")
-	return mr.templates.ExecuteTemplate(rw, "uploadSite.html", rq.URL.Query().Get("slug"))
+	return mr.templates.ExecuteTemplate(rw, "uploadSite.html", &templateData)
 }
 
 func (mr *managementRoutes) deleteSitePartial(rw http.ResponseWriter, rq *http.Request) error {
@@ -88,3 +137,166 @@ func (mr *managementRoutes) deleteRoutePartial(rw http.ResponseWriter, rq *http.
 		Route string
 	}{ID: rq.URL.Query().Get("id"), Route: rq.URL.Query().Get("domain") + rq.URL.Query().Get("path")})
 }
+
+func (mr *managementRoutes) siteSettingsPartial(rw http.ResponseWriter, rq *http.Request) error {
+	site, err := database.GetSite(mr.core.Database, rq.URL.Query().Get("slug"))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			_ = badRequestResponse(rw, core.ErrInvalidSlug.Error())
+			return nil
+		}
+		return fmt.Errorf("get site: %w", err)
+	}
+
+	rw.Header().Set("Hx-Trigger-After-Swap", "showModal")
+	return mr.templates.ExecuteTemplate(rw, "siteSettings.html", site)
+}
+
+func (mr *managementRoutes) siteAccessPartial(rw http.ResponseWriter, rq *http.Request) error {
+	var templateData = struct {
+		Site        *database.SiteModel
+		Credentials []*database.SiteCredentialModel
+		OIDC        *database.SiteOIDCModel
+	}{}
+
+	var err error
+	templateData.Site, err = database.GetSite(mr.core.Database, rq.URL.Query().Get("slug"))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			_ = badRequestResponse(rw, core.ErrInvalidSlug.Error())
+			return nil
+		}
+		return fmt.Errorf("get site: %w", err)
+	}
+
+	templateData.Credentials, err = database.GetSiteCredentials(mr.core.Database, templateData.Site.Slug)
+	if err != nil {
+		return fmt.Errorf("get site credentials: %w", err)
+	}
+
+	templateData.OIDC, err = database.GetSiteOIDC(mr.core.Database, templateData.Site.Slug)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return fmt.Errorf("get site OIDC configuration: %w", err)
+	}
+
+	rw.Header().Set("Hx-Trigger-After-Swap", "showModal")
+	return mr.templates.ExecuteTemplate(rw, "siteAccess.html", &templateData)
+}
+
+func (mr *managementRoutes) siteHeadersPartial(rw http.ResponseWriter, rq *http.Request) error {
+	var templateData = struct {
+		Slug  string
+		Rules []*caddyController.HeaderRule
+		Error string
+	}{
+		Slug: rq.URL.Query().Get("slug"),
+	}
+
+	rules, err := mr.core.GetSiteHeaders(templateData.Slug)
+	if err != nil {
+		var e *core.Error
+		if errors.As(err, &e) {
+			_ = badRequestResponse(rw, err.Error())
+			return nil
+		}
+		// This is most likely an invalid headers file, which is something the user should be told about.
+		templateData.Error = err.Error()
+	}
+	templateData.Rules = rules
+
+	rw.Header().Set("Hx-Trigger-After-Swap", "showModal")
+	return mr.templates.ExecuteTemplate(rw, "siteHeaders.html", &templateData)
+}
+
+func (mr *managementRoutes) usersPartial(rw http.ResponseWriter, rq *http.Request) error {
+	if !mr.config.ManagementAuth.Enabled() {
+		_ = badRequestResponse(rw, core.ErrManagementAuthDisabled.Error())
+		return nil
+	}
+
+	users, err := database.GetUsers(mr.core.Database)
+	if err != nil {
+		return fmt.Errorf("get users: %w", err)
+	}
+
+	rw.Header().Set("Hx-Trigger-After-Swap", "showModal")
+	return mr.templates.ExecuteTemplate(rw, "users.html", &struct {
+		Users       []*database.UserModel
+		CurrentUser *core.User
+	}{
+		Users:       users,
+		CurrentUser: userFromContext(rq.Context()),
+	})
+}
+
+func (mr *managementRoutes) auditLogPartial(rw http.ResponseWriter, _ *http.Request) error {
+	rw.Header().Set("Hx-Trigger-After-Swap", "showModal")
+	return mr.templates.ExecuteTemplate(rw, "auditLog.html", nil)
+}
+
+func (mr *managementRoutes) auditLogEntriesPartial(rw http.ResponseWriter, rq *http.Request) error {
+	query := rq.URL.Query()
+
+	filter, err := parseAuditLogFilter(query)
+	if err != nil {
+		_ = badRequestResponse(rw, err.Error())
+		return nil
+	}
+	if filter.Limit == 0 {
+		filter.Limit = 100
+	}
+
+	entries, err := mr.core.QueryAuditLog(filter)
+	if err != nil {
+		return fmt.Errorf("query audit log: %w", err)
+	}
+
+	// The export link should include every matching entry, not just those that are shown
+	query.Del("limit")
+	query.Set("format", "jsonl")
+
+	return mr.templates.ExecuteTemplate(rw, "auditLogEntries", &struct {
+		Entries   []*database.AuditLogModel
+		Limit     int
+		ExportURL string
+	}{
+		Entries:   entries,
+		Limit:     filter.Limit,
+		ExportURL: "/api/audit?" + query.Encode(),
+	})
+}
+
+func (mr *managementRoutes) siteGitPartial(rw http.ResponseWriter, rq *http.Request) error {
+	var templateData = struct {
+		Slug        string
+		Git         *database.SiteGitModel
+		WebhookURL  string
+		Deployments []*database.DeploymentModel
+	}{
+		Slug: rq.URL.Query().Get("slug"),
+	}
+
+	if _, err := database.GetSite(mr.core.Database, templateData.Slug); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			_ = badRequestResponse(rw, core.ErrInvalidSlug.Error())
+			return nil
+		}
+		return fmt.Errorf("get site: %w", err)
+	}
+
+	var err error
+	templateData.Git, err = database.GetSiteGit(mr.core.Database, templateData.Slug)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return fmt.Errorf("get site Git configuration: %w", err)
+	}
+
+	templateData.WebhookURL = mr.managementBaseURL(rq) + "/hooks/git/" + templateData.Slug
+
+	templateData.Deployments, err = database.GetDeployments(mr.core.Database, templateData.Slug, 10)
+	if err != nil {
+		return fmt.Errorf("get deployments: %w", err)
+	}
+
+	rw.Header().Set("Hx-Trigger-After-Swap", "showModal")
+	return mr.templates.ExecuteTemplate(rw, "siteGit.html", &templateData)
+}
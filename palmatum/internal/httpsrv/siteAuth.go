@@ -0,0 +1,109 @@
+package httpsrv
+
+import (
+	"errors"
+	"fmt"
+	"git.tdpain.net/codemicro/palmatum/palmatum/internal/caddyController"
+	"git.tdpain.net/codemicro/palmatum/palmatum/internal/core"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// These routes are used by Caddy to authenticate visitors to sites that are protected with single sign-on. forwardAuth
+// is called by the forward_auth directive for every request to a protected site, and siteLoginCallback is reverse
+// proxied from caddyController.SiteLoginCallbackPath on the site's own domain.
+
+func (mr *managementRoutes) siteHost(rq *http.Request) string {
+	if h := rq.Header.Get("X-Forwarded-Host"); h != "" {
+		return h
+	}
+	return rq.Host
+}
+
+func (mr *managementRoutes) siteLoginRedirectURL(rq *http.Request) string {
+	return (&url.URL{
+		Scheme: mr.config.HTTP.SitesPublicScheme,
+		Host:   mr.siteHost(rq),
+		Path:   caddyController.SiteLoginCallbackPath,
+	}).String()
+}
+
+func (mr *managementRoutes) forwardAuth(rw http.ResponseWriter, rq *http.Request) error {
+	siteSlug := rq.URL.Query().Get("site")
+
+	if cookie, err := rq.Cookie(core.SiteSessionCookieName(siteSlug)); err == nil {
+		if _, err := mr.core.CheckSiteSession(siteSlug, cookie.Value); err == nil {
+			rw.WriteHeader(http.StatusOK)
+			return nil
+		}
+	}
+
+	authURL, nonce, err := mr.core.BeginSiteLogin(rq.Context(), siteSlug, mr.siteLoginRedirectURL(rq), rq.Header.Get("X-Forwarded-Uri"))
+	if err != nil {
+		var e *core.Error
+		if errors.As(err, &e) {
+			_ = badRequestResponse(rw, err.Error())
+			return nil
+		}
+		return fmt.Errorf("begin site login: %w", err)
+	}
+
+	http.SetCookie(rw, &http.Cookie{
+		Name:     core.SiteLoginNonceCookieName,
+		Value:    nonce,
+		Path:     caddyController.SiteLoginCallbackPath,
+		MaxAge:   int((time.Minute * 10).Seconds()),
+		HttpOnly: true,
+		Secure:   mr.config.HTTP.SitesPublicScheme == "https",
+		SameSite: http.SameSiteLaxMode,
+	})
+	http.Redirect(rw, rq, authURL, http.StatusFound)
+	return nil
+}
+
+func (mr *managementRoutes) siteLoginCallback(rw http.ResponseWriter, rq *http.Request) error {
+	if errMsg := rq.URL.Query().Get("error"); errMsg != "" {
+		_ = badRequestResponse(rw, "Login failed: "+errMsg)
+		return nil
+	}
+
+	var nonce string
+	if cookie, err := rq.Cookie(core.SiteLoginNonceCookieName); err == nil {
+		nonce = cookie.Value
+	}
+
+	token, session, returnTo, err := mr.core.CompleteSiteLogin(rq.Context(), rq.URL.Query().Get("state"), rq.URL.Query().Get("code"), nonce, mr.siteLoginRedirectURL(rq))
+	if err != nil {
+		if errors.Is(err, core.ErrAccessDenied) {
+			rw.WriteHeader(http.StatusForbidden)
+			_, _ = rw.Write([]byte(err.Error()))
+			return nil
+		}
+		var e *core.Error
+		if errors.As(err, &e) {
+			_ = badRequestResponse(rw, err.Error())
+			return nil
+		}
+		return fmt.Errorf("complete site login: %w", err)
+	}
+
+	mr.logger.Debug("visitor logged in to site", "site", session.Site, "subject", session.Subject, "email", session.Email)
+
+	http.SetCookie(rw, &http.Cookie{
+		Name:   core.SiteLoginNonceCookieName,
+		Path:   caddyController.SiteLoginCallbackPath,
+		MaxAge: -1,
+	})
+	http.SetCookie(rw, &http.Cookie{
+		Name:     core.SiteSessionCookieName(session.Site),
+		Value:    token,
+		Path:     "/",
+		Expires:  time.Unix(session.Expires, 0),
+		HttpOnly: true,
+		Secure:   mr.config.HTTP.SitesPublicScheme == "https",
+		SameSite: http.SameSiteLaxMode,
+	})
+	http.Redirect(rw, rq, returnTo, http.StatusFound)
+	return nil
+}
@@ -0,0 +1,61 @@
+package httpsrv
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+func (mr *managementRoutes) apiGetStorageUsage(rw http.ResponseWriter, _ *http.Request) error {
+	usage, err := mr.core.GetStorageUsage()
+	if err != nil {
+		return fmt.Errorf("get storage usage: %w", err)
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(rw).Encode(usage)
+}
+
+func (mr *managementRoutes) apiCollectOrphanedArchives(rw http.ResponseWriter, rq *http.Request) error {
+	job, err := mr.core.QueueOrphanCollection(rq.Context())
+	if err != nil {
+		return fmt.Errorf("queue orphaned archive collection: %w", err)
+	}
+	return mr.jobAcceptedResponse(rw, rq, job)
+}
+
+func (mr *managementRoutes) apiGetBackup(rw http.ResponseWriter, rq *http.Request) error {
+	backup, err := mr.core.CreateBackup(rq.Context())
+	if err != nil {
+		return fmt.Errorf("create backup: %w", err)
+	}
+	defer backup.Close()
+
+	rw.Header().Set("Content-Type", "application/x-tar")
+	rw.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="palmatum-backup-%s.tar"`, time.Now().UTC().Format("20060102-150405")))
+	rw.Header().Set("Cache-Control", "no-store")
+
+	if err := backup.Write(rw); err != nil {
+		// The response has already been started, so the only way to tell the client that the backup is incomplete is
+		// to abort the connection. The backup won't have a manifest, so it can't be restored by mistake either.
+		mr.logger.Error("unable to write backup", "error", err)
+		panic(http.ErrAbortHandler)
+	}
+
+	return nil
+}
+
+// formatBytes formats n as a number of bytes using decimal units, which are also used for quotas and upload limits.
+func formatBytes(n int64) string {
+	const unit = 1000
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %cB", float64(n)/float64(div), "kMGTPE"[exp])
+}
@@ -0,0 +1,73 @@
+package httpsrv
+
+import (
+	"bytes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	semconv "go.opentelemetry.io/otel/semconv/v1.24.0"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestManagementRequestTracing(t *testing.T) {
+	spans := tracetest.NewInMemoryExporter()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSyncer(spans))
+
+	var logs bytes.Buffer
+	logger := slog.New(slog.NewTextHandler(&logs, &slog.HandlerOptions{Level: slog.LevelDebug}))
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /api/job", func(rw http.ResponseWriter, rq *http.Request) {
+		_, _ = rw.Write([]byte("ok"))
+	})
+	mux.HandleFunc("GET /healthz", func(rw http.ResponseWriter, rq *http.Request) {
+		_, _ = rw.Write([]byte("ok"))
+	})
+	handler := instrumentManagementHandler(logger, tp, mux)
+
+	const traceID = "0af7651916cd43dd8448eb211c80319c"
+	rq := httptest.NewRequest(http.MethodGet, "/api/job?id=1", nil)
+	rq.Header.Set("traceparent", "00-"+traceID+"-b7ad6b7169203331-01")
+	handler.ServeHTTP(httptest.NewRecorder(), rq)
+
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/healthz", nil))
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/nothing/here", nil))
+
+	recorded := spans.GetSpans()
+	if len(recorded) != 2 {
+		t.Fatalf("expected 2 spans, got %d: %v", len(recorded), recorded.Snapshots())
+	}
+
+	// The span continues the caller's trace and is named after the route, not the path, so that IDs in paths don't
+	// create a new span name for every request
+	job := recorded[0]
+	if job.Name != "GET /api/job" || job.SpanContext.TraceID().String() != traceID || job.Parent.SpanID().String() != "b7ad6b7169203331" {
+		t.Errorf("unexpected span %s in trace %s", job.Name, job.SpanContext.TraceID())
+	}
+	var hasRoute bool
+	for _, attr := range job.Attributes {
+		if attr == semconv.HTTPRoute("GET /api/job") {
+			hasRoute = true
+		}
+	}
+	if !hasRoute {
+		t.Errorf("route missing from span attributes %v", job.Attributes)
+	}
+
+	// Requests that don't match a route keep the default name
+	if recorded[1].Name != "management request" {
+		t.Errorf("unexpected span name %q for unmatched request", recorded[1].Name)
+	}
+
+	// Monitoring requests aren't traced, but are still logged
+	out := logs.String()
+	if !strings.Contains(out, "path=/healthz") {
+		t.Errorf("health check wasn't logged: %s", out)
+	}
+	if !strings.Contains(out, "path=/api/job") || !strings.Contains(out, "traceID="+traceID) {
+		t.Errorf("trace ID missing from request log: %s", out)
+	}
+}
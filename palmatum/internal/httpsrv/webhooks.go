@@ -0,0 +1,98 @@
+package httpsrv
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"git.tdpain.net/codemicro/palmatum/palmatum/internal/core"
+	"git.tdpain.net/codemicro/palmatum/palmatum/internal/database"
+	"net/http"
+	"strconv"
+)
+
+func (mr *managementRoutes) apiCreateWebhook(rw http.ResponseWriter, rq *http.Request) error {
+	webhookURL := rq.FormValue("url")
+	// FormValue has parsed the form, so multiple values can be read directly
+	events := rq.Form["events"]
+
+	if _, err := mr.core.CreateWebhook(webhookURL, events, rq.FormValue("secret")); err != nil {
+		var e *core.Error
+		if errors.As(err, &e) {
+			_ = badRequestResponse(rw, err.Error())
+			return nil
+		}
+		return fmt.Errorf("create webhook: %w", err)
+	}
+
+	rw.Header().Set("HX-Refresh", "true")
+	rw.WriteHeader(http.StatusCreated)
+	return nil
+}
+
+func (mr *managementRoutes) apiDeleteWebhook(rw http.ResponseWriter, rq *http.Request) error {
+	webhookID, err := strconv.Atoi(rq.FormValue("id"))
+	if err != nil {
+		_ = badRequestResponse(rw, "invalid webhook ID")
+		return nil
+	}
+
+	if err := mr.core.DeleteWebhook(webhookID); err != nil {
+		var e *core.Error
+		if errors.As(err, &e) {
+			_ = badRequestResponse(rw, err.Error())
+			return nil
+		}
+		return fmt.Errorf("delete webhook: %w", err)
+	}
+
+	rw.Header().Set("HX-Refresh", "true")
+	rw.WriteHeader(http.StatusOK)
+	return nil
+}
+
+func (mr *managementRoutes) webhooksPartial(rw http.ResponseWriter, _ *http.Request) error {
+	webhooks, err := database.GetWebhooks(mr.core.Database)
+	if err != nil {
+		return fmt.Errorf("get webhooks: %w", err)
+	}
+
+	rw.Header().Set("Hx-Trigger-After-Swap", "showModal")
+	return mr.templates.ExecuteTemplate(rw, "webhooks.html", &struct {
+		Webhooks []*database.WebhookModel
+		Events   []string
+	}{
+		Webhooks: webhooks,
+		Events:   core.WebhookEvents,
+	})
+}
+
+func (mr *managementRoutes) webhookDeliveriesPartial(rw http.ResponseWriter, rq *http.Request) error {
+	webhookID, err := strconv.Atoi(rq.URL.Query().Get("id"))
+	if err != nil {
+		_ = badRequestResponse(rw, "invalid webhook ID")
+		return nil
+	}
+
+	webhook, err := database.GetWebhook(mr.core.Database, webhookID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			_ = badRequestResponse(rw, core.ErrWebhookNotFound.Error())
+			return nil
+		}
+		return fmt.Errorf("get webhook: %w", err)
+	}
+
+	deliveries, err := database.GetWebhookDeliveries(mr.core.Database, webhookID, 50)
+	if err != nil {
+		return fmt.Errorf("get webhook deliveries: %w", err)
+	}
+
+	rw.Header().Set("Hx-Trigger-After-Swap", "showModal")
+	return mr.templates.ExecuteTemplate(rw, "webhookDeliveries.html", &struct {
+		Webhook    *database.WebhookModel
+		Deliveries []*database.WebhookDeliveryModel
+	}{
+		Webhook:    webhook,
+		Deliveries: deliveries,
+	})
+}
@@ -0,0 +1,68 @@
+package logging
+
+import (
+	"context"
+	"git.tdpain.net/codemicro/palmatum/palmatum/internal/config"
+	"io"
+	"log/slog"
+)
+
+// AreaKey is the attribute that identifies which part of Palmatum a log message came from. Loggers for each part
+// should be created with logger.With(AreaKey, "name") so that their level can be configured separately.
+const AreaKey = "area"
+
+// New creates a logger that writes to w in the format set in conf.
+func New(w io.Writer, conf *config.Logging) *slog.Logger {
+	// The underlying handler lets everything through, since areaHandler decides what's written.
+	opts := &slog.HandlerOptions{Level: slog.Level(-1 << 10)}
+
+	var h slog.Handler
+	if conf.Format == "json" {
+		h = slog.NewJSONHandler(w, opts)
+	} else {
+		h = slog.NewTextHandler(w, opts)
+	}
+
+	return slog.New(&areaHandler{
+		handler: h,
+		conf:    conf,
+		level:   conf.Level,
+	})
+}
+
+// areaHandler filters log messages using the level configured for the area of the logger they came from.
+type areaHandler struct {
+	handler slog.Handler
+	conf    *config.Logging
+	level   slog.Level
+}
+
+func (h *areaHandler) Enabled(_ context.Context, level slog.Level) bool {
+	return level >= h.level
+}
+
+func (h *areaHandler) Handle(ctx context.Context, record slog.Record) error {
+	return h.handler.Handle(ctx, record)
+}
+
+func (h *areaHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	level := h.level
+	for _, attr := range attrs {
+		if attr.Key == AreaKey {
+			level = h.conf.LevelFor(attr.Value.String())
+		}
+	}
+	return &areaHandler{
+		handler: h.handler.WithAttrs(attrs),
+		conf:    h.conf,
+		level:   level,
+	}
+}
+
+func (h *areaHandler) WithGroup(name string) slog.Handler {
+	return &areaHandler{
+		handler: h.handler.WithGroup(name),
+		conf:    h.conf,
+		level:   h.level,
+	}
+}
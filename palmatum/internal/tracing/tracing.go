@@ -0,0 +1,72 @@
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"git.tdpain.net/codemicro/palmatum/palmatum/internal/config"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.24.0"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
+	"go.uber.org/fx"
+	"log/slog"
+)
+
+// Propagator carries trace context between Palmatum, Caddy and anything that calls the management API.
+var Propagator propagation.TextMapPropagator = propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{})
+
+// NewTracerProvider returns a TracerProvider that exports spans to the OTLP endpoint in conf, or one that discards
+// them if tracing isn't enabled.
+func NewTracerProvider(lc fx.Lifecycle, conf *config.Config, logger *slog.Logger) (trace.TracerProvider, error) {
+	if !conf.Tracing.Enabled() {
+		return noop.NewTracerProvider(), nil
+	}
+
+	exporter, err := otlptracegrpc.New(context.Background(), otlptracegrpc.WithEndpointURL(conf.Tracing.OTLPEndpoint))
+	if err != nil {
+		return nil, fmt.Errorf("create OTLP exporter: %w", err)
+	}
+
+	res, err := resource.Merge(resource.Default(), resource.NewWithAttributes(
+		semconv.SchemaURL,
+		semconv.ServiceName(conf.Tracing.ServiceName),
+	))
+	if err != nil {
+		return nil, fmt.Errorf("create resource: %w", err)
+	}
+
+	tp := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+		// The decision of a remote caller is respected so that traces aren't left with gaps in them
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(SampleRatio(conf.Tracing)))),
+	)
+
+	lc.Append(fx.Hook{
+		OnStop: func(ctx context.Context) error {
+			// Any spans that haven't been exported yet are sent before stopping
+			if err := tp.Shutdown(ctx); err != nil {
+				logger.Warn("unable to flush traces", "error", err)
+			}
+			return nil
+		},
+	})
+
+	logger.Info("exporting traces", "endpoint", conf.Tracing.OTLPEndpoint, "samplePercent", conf.Tracing.SamplePercent)
+
+	return tp, nil
+}
+
+// SampleRatio returns the fraction of traces that are sampled.
+func SampleRatio(conf *config.Tracing) float64 {
+	return float64(conf.SamplePercent) / 100
+}
+
+// HasSpan reports whether ctx contains a span. It's used to avoid starting new traces for work that isn't part of an
+// operation that's being traced already, such as polling.
+func HasSpan(ctx context.Context) bool {
+	return trace.SpanContextFromContext(ctx).IsValid()
+}
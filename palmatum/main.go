@@ -6,6 +6,8 @@ import (
 	"git.tdpain.net/codemicro/palmatum/palmatum/internal/core"
 	"git.tdpain.net/codemicro/palmatum/palmatum/internal/database"
 	"git.tdpain.net/codemicro/palmatum/palmatum/internal/httpsrv"
+	"git.tdpain.net/codemicro/palmatum/palmatum/internal/logging"
+	"git.tdpain.net/codemicro/palmatum/palmatum/internal/tracing"
 	"go.uber.org/fx"
 	"go.uber.org/fx/fxevent"
 	"log/slog"
@@ -14,12 +16,24 @@ import (
 )
 
 func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "fsck":
+			os.Exit(fsck(os.Args[2:]))
+		case "backup":
+			os.Exit(backup(os.Args[2:]))
+		case "restore":
+			os.Exit(restore(os.Args[2:]))
+		}
+	}
+
 	fx.New(
 		fx.Provide(provideLogger),
 		fx.WithLogger(provideFxLogger),
 
 		fx.Provide(
 			config.Load,
+			tracing.NewTracerProvider,
 			database.New,
 			caddyController.NewController,
 			core.New,
@@ -38,11 +52,9 @@ func main() {
 }
 
 func provideLogger(conf *config.Config) *slog.Logger {
-	level := new(slog.LevelVar)
-	l := slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: level}))
+	l := logging.New(os.Stderr, conf.Logging)
 
 	if conf.Debug {
-		level.Set(slog.LevelDebug)
 		l.Debug("debug mode enabled")
 	}
 
@@ -51,7 +63,7 @@ func provideLogger(conf *config.Config) *slog.Logger {
 
 func provideFxLogger(l *slog.Logger) fxevent.Logger {
 	fxel := &fxevent.SlogLogger{
-		Logger: l.With("area", "fx"),
+		Logger: l.With(logging.AreaKey, "fx"),
 	}
 	fxel.UseLogLevel(slog.LevelDebug)
 	return fxel